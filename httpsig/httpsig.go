@@ -0,0 +1,224 @@
+// Package httpsig verifies the HTTP Message Signatures (RFC 9421) JWT Auth Proxy adds to requests
+// forwarded to upstream services, so upstreams can reject requests not passing through the proxy.
+//
+// Usage:
+//
+//	publicKey, err := httpsig.ParsePublicKeyPEM(pemBytes)
+//	verifier := &httpsig.Verifier{KeyID: "jwt-auth-proxy", PublicKey: publicKey}
+//	http.Handle("/", verifier.Middleware(handler))
+package httpsig
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Label is the label of the proxy's signature in the Signature and Signature-Input headers
+const Label = "proxy"
+
+// DefaultMaxAge is the maximum age of a signature if Verifier.MaxAge is not set
+const DefaultMaxAge = 30 * time.Second
+
+// DefaultIdentityHeaders lists the headers the proxy uses to forward the authenticated identity
+var DefaultIdentityHeaders = []string{"X-Auth-UserID", "X-Auth-ClientID"}
+
+var (
+	ErrMissingSignature = errors.New("httpsig: missing signature")
+	ErrInvalidSignature = errors.New("httpsig: invalid signature")
+	ErrStaleSignature   = errors.New("httpsig: signature is stale")
+	ErrUncoveredHeader  = errors.New("httpsig: identity header not covered by signature")
+)
+
+// Verifier checks the proxy's signature on incoming requests
+type Verifier struct {
+	// KeyID must match the proxy's UPSTREAM_SIGNATURE_KEY_ID
+	KeyID string
+	// PublicKey is the public key matching the proxy's UPSTREAM_SIGNATURE_KEY_FILE
+	PublicKey ed25519.PublicKey
+	// MaxAge is the maximum age of a signature, defaults to DefaultMaxAge
+	MaxAge time.Duration
+	// IdentityHeaders must be covered by the signature if present, defaults to DefaultIdentityHeaders
+	IdentityHeaders []string
+}
+
+// ParsePublicKeyPEM parses a PKIX encoded Ed25519 public key,
+// i.e. as output by 'openssl pkey -in upstream.key -pubout'
+func ParsePublicKeyPEM(pemBytes []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("httpsig: could not decode PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("httpsig: not an Ed25519 public key")
+	}
+	return publicKey, nil
+}
+
+// Verify checks that the request carries a valid, recent signature by the proxy
+// covering method, path, query and all identity headers present
+func (v *Verifier) Verify(r *http.Request) error {
+	input := dictionaryMember(r.Header.Get("Signature-Input"), Label)
+	signature := dictionaryMember(r.Header.Get("Signature"), Label)
+	if input == "" || signature == "" {
+		return ErrMissingSignature
+	}
+	components, params, err := parseSignatureInput(input)
+	if err != nil {
+		return err
+	}
+	if params["keyid"] != v.KeyID || params["alg"] != "ed25519" {
+		return ErrInvalidSignature
+	}
+	for _, required := range []string{"@method", "@path", "@query"} {
+		if !contains(components, required) {
+			return ErrInvalidSignature
+		}
+	}
+	for _, header := range v.identityHeaders() {
+		if _, ok := r.Header[http.CanonicalHeaderKey(header)]; ok && !contains(components, strings.ToLower(header)) {
+			return ErrUncoveredHeader
+		}
+	}
+	created, err := strconv.ParseInt(params["created"], 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	maxAge := v.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	age := time.Since(time.Unix(created, 0))
+	if age > maxAge || age < -maxAge {
+		return ErrStaleSignature
+	}
+	if !strings.HasPrefix(signature, ":") || !strings.HasSuffix(signature, ":") || len(signature) < 2 {
+		return ErrInvalidSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature[1 : len(signature)-1])
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	base := signatureBase(r, components, input)
+	if len(v.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(v.PublicKey, []byte(base), sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Middleware rejects requests without a valid signature with 401
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (v *Verifier) identityHeaders() []string {
+	if v.IdentityHeaders != nil {
+		return v.IdentityHeaders
+	}
+	return DefaultIdentityHeaders
+}
+
+// signatureBase returns the signature base for the covered components (RFC 9421, section 2.5)
+func signatureBase(r *http.Request, components []string, params string) string {
+	var b strings.Builder
+	for _, c := range components {
+		var value string
+		switch c {
+		case "@method":
+			value = r.Method
+		case "@path":
+			value = r.URL.EscapedPath()
+			if value == "" {
+				value = "/"
+			}
+		case "@query":
+			value = "?" + r.URL.RawQuery
+		default:
+			values := r.Header[http.CanonicalHeaderKey(c)]
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.TrimSpace(v)
+			}
+			value = strings.Join(trimmed, ", ")
+		}
+		b.WriteString(strconv.Quote(c) + ": " + value + "\n")
+	}
+	b.WriteString("\"@signature-params\": " + params)
+	return b.String()
+}
+
+// dictionaryMember returns the value of the member with the given label from a structured field dictionary
+func dictionaryMember(header, label string) string {
+	for _, member := range strings.Split(header, ",") {
+		member = strings.TrimSpace(member)
+		if strings.HasPrefix(member, label+"=") {
+			return strings.TrimPrefix(member, label+"=")
+		}
+	}
+	return ""
+}
+
+// parseSignatureInput parses an inner list of covered components followed by parameters, i.e.
+// ("@method" "@path");created=1618884473;keyid="test-key". The parameters are returned with their unquoted values.
+func parseSignatureInput(input string) ([]string, map[string]string, error) {
+	if !strings.HasPrefix(input, "(") {
+		return nil, nil, ErrInvalidSignature
+	}
+	end := strings.Index(input, ")")
+	if end < 0 {
+		return nil, nil, ErrInvalidSignature
+	}
+	components := make([]string, 0)
+	for _, item := range strings.Fields(input[1:end]) {
+		c, err := strconv.Unquote(item)
+		if err != nil {
+			return nil, nil, ErrInvalidSignature
+		}
+		components = append(components, c)
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(input[end+1:], ";") {
+		if param == "" {
+			continue
+		}
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, ErrInvalidSignature
+		}
+		value := kv[1]
+		if strings.HasPrefix(value, "\"") {
+			var err error
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, nil, ErrInvalidSignature
+			}
+		}
+		params[kv[0]] = value
+	}
+	return components, params, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
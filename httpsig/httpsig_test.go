@@ -0,0 +1,78 @@
+package httpsig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signTestRequest(r *http.Request, key ed25519.PrivateKey, components []string, created int64) {
+	params := "("
+	for i, c := range components {
+		if i > 0 {
+			params += " "
+		}
+		params += strconv.Quote(c)
+	}
+	params += ");created=" + strconv.FormatInt(created, 10) + ";keyid=\"test-key\";alg=\"ed25519\""
+	sig := ed25519.Sign(key, []byte(signatureBase(r, components, params)))
+	r.Header.Set("Signature-Input", Label+"="+params)
+	r.Header.Set("Signature", Label+"=:"+base64.StdEncoding.EncodeToString(sig)+":")
+}
+
+func newTestVerifier() (*Verifier, ed25519.PrivateKey) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	return &Verifier{KeyID: "test-key", PublicKey: publicKey}, privateKey
+}
+
+func TestVerify(t *testing.T) {
+	v, key := newTestVerifier()
+	r, _ := http.NewRequest("GET", "http://upstream/some/path?a=1", nil)
+	r.Header.Set("X-Auth-UserID", "1234")
+	signTestRequest(r, key, []string{"@method", "@path", "@query", "x-auth-userid"}, time.Now().Unix())
+	if err := v.Verify(r); err != nil {
+		t.Fatal("Expected valid signature, got", err)
+	}
+}
+
+func TestVerifyModifiedRequest(t *testing.T) {
+	v, key := newTestVerifier()
+	r, _ := http.NewRequest("GET", "http://upstream/some/path", nil)
+	r.Header.Set("X-Auth-UserID", "1234")
+	signTestRequest(r, key, []string{"@method", "@path", "@query", "x-auth-userid"}, time.Now().Unix())
+	r.Header.Set("X-Auth-UserID", "5678")
+	if err := v.Verify(r); err != ErrInvalidSignature {
+		t.Fatal("Expected ErrInvalidSignature, got", err)
+	}
+}
+
+func TestVerifyUncoveredIdentityHeader(t *testing.T) {
+	v, key := newTestVerifier()
+	r, _ := http.NewRequest("GET", "http://upstream/some/path", nil)
+	signTestRequest(r, key, []string{"@method", "@path", "@query"}, time.Now().Unix())
+	r.Header.Set("X-Auth-ClientID", "cron")
+	if err := v.Verify(r); err != ErrUncoveredHeader {
+		t.Fatal("Expected ErrUncoveredHeader, got", err)
+	}
+}
+
+func TestVerifyStaleSignature(t *testing.T) {
+	v, key := newTestVerifier()
+	r, _ := http.NewRequest("GET", "http://upstream/some/path", nil)
+	signTestRequest(r, key, []string{"@method", "@path", "@query"}, time.Now().Add(-time.Minute).Unix())
+	if err := v.Verify(r); err != ErrStaleSignature {
+		t.Fatal("Expected ErrStaleSignature, got", err)
+	}
+}
+
+func TestVerifyMissingSignature(t *testing.T) {
+	v, _ := newTestVerifier()
+	r, _ := http.NewRequest("GET", "http://upstream/some/path", nil)
+	if err := v.Verify(r); err != ErrMissingSignature {
+		t.Fatal("Expected ErrMissingSignature, got", err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -34,6 +35,9 @@ type App struct {
 	Proxy                     *httputil.ReverseProxy
 	CleanRefreshTokensTicker  *time.Ticker
 	CleanPendingActionsTicker *time.Ticker
+	RotateSigningKeysTicker   *time.Ticker
+	SyncRevokedTokensTicker   *time.Ticker
+	CleanOIDCCodesTicker      *time.Ticker
 }
 
 func (a *App) InitializePublicRouter() {
@@ -49,7 +53,7 @@ func (a *App) InitializePublicRouter() {
 		a.PublicRouter.PathPrefix("/").Methods("OPTIONS").HandlerFunc(CorsHandler)
 		a.PublicRouter.Use(CorsMiddleware)
 	}
-	a.PublicRouter.PathPrefix("/").HandlerFunc(ProxyHandler)
+	a.PublicRouter.PathPrefix("/").Handler(PolicyMiddleware(AccessRuleMiddleware(http.HandlerFunc(ProxyHandler))))
 	a.PublicRouter.Use(VerifyJwtMiddleware)
 }
 
@@ -57,6 +61,10 @@ func (a *App) InitializeBackendRouter() {
 	a.BackendRouter = mux.NewRouter()
 	routers := make(map[string]Route)
 	routers["/users/"] = &UserRouter{}
+	routers["/oidc/clients/"] = &OIDCClientRouter{}
+	routers["/clients/"] = &ServiceClientRouter{}
+	routers["/tokens/"] = &TokenRouter{}
+	routers["/policy/"] = &PolicyRouter{}
 	for route, router := range routers {
 		subRouter := a.BackendRouter.PathPrefix(route).Subrouter()
 		router.setupRoutes(subRouter)
@@ -80,7 +88,8 @@ func (a *App) InitializeProxy() {
 			req.Header.Set("User-Agent", "")
 		}
 	}
-	a.Proxy = &httputil.ReverseProxy{Director: director}
+	// The transport signs after the target path has been joined, so the upstream sees the signed path
+	a.Proxy = &httputil.ReverseProxy{Director: director, Transport: &upstreamSigningTransport{next: http.DefaultTransport}}
 }
 
 func (a *App) InitializeTimers() {
@@ -91,6 +100,7 @@ func (a *App) InitializeTimers() {
 			case <-a.CleanRefreshTokensTicker.C:
 				log.Println("Cleaning up expired refresh tokens...")
 				GetRefreshTokenRepository().CleanUp()
+				GetPhantomTokenRepository().CleanUp()
 			}
 		}
 	}()
@@ -104,6 +114,39 @@ func (a *App) InitializeTimers() {
 			}
 		}
 	}()
+	a.CleanOIDCCodesTicker = time.NewTicker(time.Minute * 10)
+	go func() {
+		for {
+			select {
+			case <-a.CleanOIDCCodesTicker.C:
+				GetAuthorizationCodeRepository().CleanUp()
+			}
+		}
+	}()
+	a.RotateSigningKeysTicker = time.NewTicker(time.Minute * 1)
+	go func() {
+		for {
+			select {
+			case <-a.RotateSigningKeysTicker.C:
+				GetKeyring().RotateIfDue()
+			}
+		}
+	}()
+	a.SyncRevokedTokensTicker = time.NewTicker(time.Second * GetConfig().RevocationSyncInterval)
+	go func() {
+		for {
+			select {
+			case <-a.SyncRevokedTokensTicker.C:
+				GetRevokedTokenRepository().CleanUp()
+				GetRevokedTokenRepository().SyncCache()
+				GetTokenVersionCache().CleanUp()
+				GetDPoPReplayCache().CleanUp()
+				for _, iss := range GetConfig().ExternalIssuers {
+					iss.CleanUp()
+				}
+			}
+		}
+	}()
 }
 
 func (a *App) GenerateBackendCert() {
@@ -178,6 +221,15 @@ func (a *App) Run(publicListenAddr, backendListenAddr string) {
 		}
 	}()
 	log.Println("Backend HTTPS Server listening on", backendListenAddr)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := ReloadPolicy(); err != nil {
+				log.Println("Could not reload policy:", err)
+			}
+		}
+	}()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
@@ -186,6 +238,9 @@ func (a *App) Run(publicListenAddr, backendListenAddr string) {
 	defer cancel()
 	a.CleanPendingActionsTicker.Stop()
 	a.CleanRefreshTokensTicker.Stop()
+	a.RotateSigningKeysTicker.Stop()
+	a.SyncRevokedTokensTicker.Stop()
+	a.CleanOIDCCodesTicker.Stop()
 	backendServer.Shutdown(ctx)
 	publicServer.Shutdown(ctx)
 }
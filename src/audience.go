@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Audience holds the 'aud' claim, which is either a single string or an array of strings (RFC 7519, section 4.1.3)
+type Audience []string
+
+// Contains checks if the audience includes the given value
+func (a Audience) Contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAny checks if the audience includes at least one of the given values
+func (a Audience) ContainsAny(auds []string) bool {
+	for _, aud := range auds {
+		if a.Contains(aud) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON encodes a single audience as string and multiple audiences as array
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return errors.New("Invalid audience claim")
+	}
+	*a = Audience(l)
+	return nil
+}
+
+// RouteAudience requires access tokens for proxied requests matching PathPrefix to contain Audience
+type RouteAudience struct {
+	PathPrefix string
+	Audience   string
+}
+
+// ParseRouteAudiences parses a comma-separated list of 'prefix:audience' pairs, e.g. '/billing:billing-api'
+func ParseRouteAudiences(s string) ([]*RouteAudience, error) {
+	res := make([]*RouteAudience, 0)
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid route audience: " + pair)
+		}
+		ra := &RouteAudience{
+			PathPrefix: strings.TrimSpace(parts[0]),
+			Audience:   strings.TrimSpace(parts[1]),
+		}
+		if !strings.HasPrefix(ra.PathPrefix, "/") || ra.Audience == "" {
+			return nil, errors.New("Invalid route audience: " + pair)
+		}
+		res = append(res, ra)
+	}
+	return res, nil
+}
+
+// GetRequiredAudiences returns the audiences required by all route audiences matching the URL
+func GetRequiredAudiences(url string) []string {
+	res := make([]string, 0)
+	for _, ra := range GetConfig().RouteAudiences {
+		if IsPathPrefixMatch(url, ra.PathPrefix) {
+			res = append(res, ra.Audience)
+		}
+	}
+	return res
+}
+
+// HasRequiredAudiences checks if the claims contain all audiences required for the URL
+func HasRequiredAudiences(url string, claims *Claims) bool {
+	for _, aud := range GetRequiredAudiences(url) {
+		if !claims.Audience.Contains(aud) {
+			return false
+		}
+	}
+	return true
+}
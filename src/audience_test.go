@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestAudienceJSON(t *testing.T) {
+	b, _ := json.Marshal(Audience{"api"})
+	checkTestString(t, `"api"`, string(b))
+	b, _ = json.Marshal(Audience{"api", "billing"})
+	checkTestString(t, `["api","billing"]`, string(b))
+
+	var aud Audience
+	if err := json.Unmarshal([]byte(`"api"`), &aud); err != nil || !aud.Contains("api") {
+		t.Fatal("Expected single audience to be parsed")
+	}
+	if err := json.Unmarshal([]byte(`["api","billing"]`), &aud); err != nil || !aud.Contains("billing") {
+		t.Fatal("Expected audience array to be parsed")
+	}
+	if err := json.Unmarshal([]byte(`123`), &aud); err == nil {
+		t.Fatal("Expected invalid audience to fail")
+	}
+}
+
+func TestParseRouteAudiences(t *testing.T) {
+	res, err := ParseRouteAudiences("/billing:billing-api, /reports/:https://reports.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 route audiences, got %d", len(res))
+	}
+	checkTestString(t, "/reports/", res[1].PathPrefix)
+	checkTestString(t, "https://reports.example.com", res[1].Audience)
+
+	for _, s := range []string{"billing:api", "/billing", "/billing:"} {
+		if _, err := ParseRouteAudiences(s); err == nil {
+			t.Fatalf("Expected '%s' to be invalid", s)
+		}
+	}
+}
+
+func TestAccessTokenRegisteredClaims(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	req := newHTTPRequest("GET", "/some/route/test.html", loginResponse.AccessToken, nil)
+	claims, _, err := ExtractClaimsFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, GetConfig().JwtIssuer, claims.Issuer)
+	checkTestString(t, user.ID.Hex(), claims.Subject)
+	if !claims.Audience.ContainsAny(GetConfig().JwtAudience) {
+		t.Fatal("Expected configured audience")
+	}
+	if claims.NotBefore == 0 || claims.IssuedAt == 0 {
+		t.Fatal("Expected nbf and iat to be set")
+	}
+}
+
+func TestAccessTokenForeignIssuerRejected(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+
+	for _, modify := range []func(c *Claims){
+		func(c *Claims) { c.Issuer = "other-deployment" },
+		func(c *Claims) { c.Audience = Audience{"other-api"} },
+		func(c *Claims) { c.Subject = "" },
+		func(c *Claims) { c.NotBefore = time.Now().Add(time.Minute).Unix() },
+	} {
+		claims := NewAccessTokenClaims(user, 5)
+		modify(claims)
+		jwtString, _ := SignAccessToken(claims)
+		req := newHTTPRequest("GET", "/auth/ping", jwtString, nil)
+		res := executePublicTestRequest(req)
+		checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+	}
+}
+
+func TestRouteAudienceRequired(t *testing.T) {
+	clearTestDB()
+	createTestUser(true)
+	GetConfig().RouteAudiences = []*RouteAudience{{PathPrefix: "/some/route", Audience: "billing-api"}}
+	defer func() { GetConfig().RouteAudiences = []*RouteAudience{} }()
+
+	loginResponse := loginUser("foo@bar.com", "12345678")
+	req := newHTTPRequest("GET", "/some/route/test.html", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	claims := &Claims{}
+	new(jwt.Parser).ParseUnverified(loginResponse.AccessToken, claims)
+	claims.Audience = append(claims.Audience, "billing-api")
+	jwtString, _ := SignAccessToken(claims)
+	req = newHTTPRequest("GET", "/some/route/test.html", jwtString, nil)
+	res = executePublicTestRequest(req)
+	// Proxy target is down, but the request passed the middleware
+	checkTestResponseCode(t, http.StatusBadGateway, res.Code)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AuditActionImpersonate = "impersonate"
+)
+
+// AuditLogEntry records a security relevant action performed via the backend API
+type AuditLogEntry struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Action     string             `json:"action" bson:"action"`
+	UserID     primitive.ObjectID `json:"userId" bson:"userId"`
+	Actor      string             `json:"actor" bson:"actor"`
+	Reason     string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	TokenID    string             `json:"jti,omitempty" bson:"jti,omitempty"`
+	RemoteAddr string             `json:"remoteAddr" bson:"remoteAddr"`
+	CreateDate time.Time          `json:"createDate" bson:"createDate"`
+	ExpiryDate time.Time          `json:"expiryDate,omitempty" bson:"expiryDate,omitempty"`
+}
+
+type AuditLogRepository struct {
+}
+
+var _auditLogRepositoryInstance *AuditLogRepository
+var _auditLogRepositoryOnce sync.Once
+
+func GetAuditLogRepository() *AuditLogRepository {
+	_auditLogRepositoryOnce.Do(func() {
+		_auditLogRepositoryInstance = &AuditLogRepository{}
+		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
+		// Create non-unique index on 'userId'
+		mod := mongo.IndexModel{
+			Keys: bson.M{
+				"userId": 1,
+			},
+			Options: options.Index().SetUnique(false),
+		}
+		_, err := _auditLogRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return _auditLogRepositoryInstance
+}
+
+func (r *AuditLogRepository) GetCollection() *mongo.Collection {
+	return GetDatatabase().Database.Collection("audit_log")
+}
+
+func (r *AuditLogRepository) Create(e *AuditLogEntry) error {
+	res, err := r.GetCollection().InsertOne(context.TODO(), e)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	e.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetAllForUser returns the audit log entries of the user, newest first
+func (r *AuditLogRepository) GetAllForUser(userID string) []*AuditLogEntry {
+	results := make([]*AuditLogEntry, 0)
+	cur, err := r.GetCollection().Find(context.TODO(), bson.M{"userId": GetDatatabase().GetObjectID(userID)}, options.Find().SetSort(bson.M{"createDate": -1}))
+	if err != nil {
+		log.Println(err)
+		return results
+	}
+	for cur.Next(context.TODO()) {
+		var e AuditLogEntry
+		err := cur.Decode(&e)
+		if err != nil {
+			return results
+		}
+		results = append(results, &e)
+	}
+	cur.Close(context.TODO())
+	return results
+}
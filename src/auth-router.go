@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"image/png"
 	"log"
 	"net/http"
@@ -10,8 +11,10 @@ import (
 	"time"
 
 	"github.com/pquerna/otp/totp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/dgrijalva/jwt-go"
+	guuid "github.com/google/uuid"
 
 	"github.com/gorilla/mux"
 )
@@ -25,6 +28,11 @@ func (router *AuthRouter) setupRoutes(s *mux.Router) {
 	s.HandleFunc("/refresh", router.Refresh).Methods("POST")
 	s.HandleFunc("/logout", router.Logout).Methods("POST")
 	s.HandleFunc("/ping", router.Ping).Methods("GET")
+	s.HandleFunc("/stepup", router.StepUp).Methods("POST")
+	s.HandleFunc("/sessions", router.GetSessions).Methods("GET")
+	s.HandleFunc("/sessions/revoke-others", router.RevokeOtherSessions).Methods("POST")
+	s.HandleFunc("/sessions/{id}", router.RevokeSession).Methods("DELETE")
+	s.HandleFunc("/.well-known/jwks.json", router.JWKS).Methods("GET")
 	if GetConfig().AllowSignup {
 		s.HandleFunc("/signup", router.Signup).Methods("POST")
 	}
@@ -45,6 +53,13 @@ func (router *AuthRouter) setupRoutes(s *mux.Router) {
 		s.HandleFunc("/otp/confirm", router.OTPConfirm).Methods("POST")
 		s.HandleFunc("/otp/disable", router.OTPDisable).Methods("POST")
 	}
+	if GetConfig().EnableClientCredentials {
+		s.HandleFunc("/token", router.Token).Methods("POST")
+	}
+	if GetConfig().EnableOIDC {
+		oidcRouter := &OIDCRouter{authRouter: router}
+		oidcRouter.setupRoutes(s)
+	}
 	s.HandleFunc("/confirm/{id}", router.Confirm).Methods("POST")
 	s.PathPrefix("/").Methods("OPTIONS").HandlerFunc(CorsHandler)
 	s.PathPrefix("/").HandlerFunc(router.NotFound)
@@ -63,6 +78,20 @@ func (router *AuthRouter) Login(w http.ResponseWriter, r *http.Request) {
 		SendBadRequest(w)
 		return
 	}
+	requestedScopes, err := ParseScope(data.Scope)
+	if err != nil {
+		log.Println("Invalid login attempt:", err)
+		SendBadRequest(w)
+		return
+	}
+	jkt := ""
+	if GetConfig().DPoPEnable && (GetConfig().DPoPRequired || HasDPoPProof(r)) {
+		if jkt, err = VerifyDPoPProof(r, ""); err != nil {
+			log.Println("Invalid login attempt: DPoP proof verification failed:", err)
+			SendDPoPTokenError(w, err)
+			return
+		}
+	}
 	user := GetUserRepository().GetByEmail(data.Email)
 	if user == nil {
 		log.Println("Invalid login attempt: invalid username", data.Email)
@@ -96,19 +125,25 @@ func (router *AuthRouter) Login(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	amr := authenticationMethods(user.OTPEnabled && GetConfig().EnableTOTP)
+	for _, scope := range requestedScopes {
+		if !ContainsScope(GetUserScopes(user), scope) {
+			log.Println("Invalid login attempt: scope", scope, "not granted to UserID", user.ID.Hex())
+			SendForbidden(w)
+			return
+		}
+	}
 	log.Println("Successful login for UserID", user.ID.Hex())
-	refreshToken := router._CreateRefreshToken(user)
-	accessToken := router._CreateAccessToken(user)
-	SendJSON(w, &LoginResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken.Token,
-	})
+	profile := GetSessionProfile(data.RememberMe)
+	refreshToken := router._CreateRefreshToken(user, r, jkt, strings.Join(requestedScopes, " "), amr, profile)
+	accessToken := router._CreateAccessToken(user, refreshToken)
+	router._SendTokens(w, accessToken, refreshToken)
 }
 
 // Refresh handles /refresh requests
 func (router *AuthRouter) Refresh(w http.ResponseWriter, r *http.Request) {
-	var data RefreshRequest
-	if UnmarshalValidateBody(r, &data) != nil {
+	data, err := router._ReadRefreshRequest(r)
+	if err != nil {
 		log.Println("Invalid token refresh attempt: failed unmarshalling request")
 		SendBadRequest(w)
 		return
@@ -124,6 +159,40 @@ func (router *AuthRouter) Refresh(w http.ResponseWriter, r *http.Request) {
 		SendBadRequest(w)
 		return
 	}
+	if refreshToken.IsBeyondMaxAge(time.Now()) || refreshToken.IsIdle(time.Now()) {
+		log.Println("Invalid token refresh attempt: session exceeded maximum age or idle timeout for UserID", refreshToken.UserID.Hex())
+		GetRefreshTokenRepository().DeleteFamily(refreshToken.GetFamilyID())
+		SendBadRequest(w)
+		return
+	}
+	if refreshToken.UserID.Hex() != GetUserIDFromContext(r) {
+		log.Println("Invalid token refresh attempt: refresh token does not belong to UserID", GetUserIDFromContext(r))
+		SendUnauthorized(w)
+		return
+	}
+	if refreshToken.JWKThumbprint != "" {
+		claims := GetClaimsFromContext(r)
+		if claims == nil || claims.Confirmation == nil || claims.Confirmation.JWKThumbprint != refreshToken.JWKThumbprint {
+			log.Println("Invalid token refresh attempt: missing DPoP proof for DPoP-bound refresh token of UserID", refreshToken.UserID.Hex())
+			SendDPoPTokenError(w, errors.New("DPoP proof required"))
+			return
+		}
+	}
+	consumed := false
+	if !refreshToken.Consumed {
+		var err error
+		if consumed, err = GetRefreshTokenRepository().MarkConsumed(refreshToken); err != nil {
+			log.Println("Could not consume refresh token of UserID", refreshToken.UserID.Hex(), "-", err)
+			SendInternalServerError(w)
+			return
+		}
+	}
+	if !consumed {
+		log.Println("Security event: reuse of consumed refresh token detected for UserID", refreshToken.UserID.Hex(), "- revoking token family", refreshToken.GetFamilyID().Hex())
+		GetRefreshTokenRepository().DeleteFamily(refreshToken.GetFamilyID())
+		SendUnauthorized(w)
+		return
+	}
 	user := GetUserRepository().GetOne(GetUserIDFromContext(r))
 	if user == nil {
 		log.Println("Invalid token refresh attempt: invalid UserID", GetUserIDFromContext(r))
@@ -141,17 +210,15 @@ func (router *AuthRouter) Refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("Successful token refresh for UserID", user.ID.Hex())
-	accessToken := router._CreateAccessToken(user)
-	SendJSON(w, &LoginResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken.Token,
-	})
+	newRefreshToken := router._RotateRefreshToken(refreshToken, r)
+	accessToken := router._CreateAccessToken(user, newRefreshToken)
+	router._SendTokens(w, accessToken, newRefreshToken)
 }
 
 // Logout handles /logout requests
 func (router *AuthRouter) Logout(w http.ResponseWriter, r *http.Request) {
-	var data RefreshRequest
-	if UnmarshalValidateBody(r, &data) != nil {
+	data, err := router._ReadRefreshRequest(r)
+	if err != nil {
 		log.Println("Invalid logout attempt: failed unmarshalling request")
 		SendBadRequest(w)
 		return
@@ -162,7 +229,94 @@ func (router *AuthRouter) Logout(w http.ResponseWriter, r *http.Request) {
 		SendBadRequest(w)
 		return
 	}
-	GetRefreshTokenRepository().Delete(refreshToken)
+	GetRefreshTokenRepository().DeleteFamily(refreshToken.GetFamilyID())
+	if claims := GetClaimsFromContext(r); claims != nil {
+		if err := GetRevokedTokenRepository().RevokeToken(claims); err != nil {
+			log.Println("Could not revoke access token on logout:", err)
+			SendInternalServerError(w)
+			return
+		}
+	}
+	if GetConfig().EnableCookies {
+		ClearSessionCookies(w)
+	}
+	SendUpdated(w)
+}
+
+// _ReadRefreshRequest reads the refresh token from the session cookie in cookie mode or from the request body
+func (router *AuthRouter) _ReadRefreshRequest(r *http.Request) (*RefreshRequest, error) {
+	if GetConfig().EnableCookies {
+		if token := GetCookieValue(r, GetConfig().CookieRefreshTokenName); token != "" {
+			return &RefreshRequest{RefreshToken: token}, nil
+		}
+	}
+	var data RefreshRequest
+	if err := UnmarshalValidateBody(r, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// _SendTokens sends the issued tokens as HttpOnly cookies in cookie mode or in the response body
+func (router *AuthRouter) _SendTokens(w http.ResponseWriter, accessToken string, refreshToken *RefreshToken) {
+	tokenType := ""
+	if refreshToken.JWKThumbprint != "" {
+		tokenType = "DPoP"
+	}
+	if GetConfig().DPoPNonceEnable {
+		w.Header().Set(dpopNonceHeader, GetDPoPNonceSource().Current())
+	}
+	res := &LoginResponse{
+		TokenType:        tokenType,
+		ExpiresIn:        int64((GetConfig().AccessTokenLifetime * time.Minute).Seconds()),
+		RefreshExpiresIn: int64(time.Until(refreshToken.ExpiryDate).Seconds()),
+		SessionProfile:   refreshToken.Profile,
+	}
+	if GetConfig().EnableCookies {
+		if err := SetSessionCookies(w, accessToken, refreshToken.Token, refreshToken.ExpiryDate); err != nil {
+			log.Println("Could not set session cookies:", err)
+			SendInternalServerError(w)
+			return
+		}
+		SendJSON(w, res)
+		return
+	}
+	res.AccessToken = accessToken
+	res.RefreshToken = refreshToken.Token
+	SendJSON(w, res)
+}
+
+// GetSessions handles GET /sessions requests
+func (router *AuthRouter) GetSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := GetRefreshTokenRepository().GetSessionsForUser(GetUserIDFromContext(r))
+	if claims := GetClaimsFromContext(r); claims != nil {
+		for _, session := range sessions {
+			session.Current = (session.ID == claims.SessionID)
+		}
+	}
+	SendJSON(w, sessions)
+}
+
+// RevokeSession handles DELETE /sessions/{id} requests
+func (router *AuthRouter) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !GetRefreshTokenRepository().DeleteSession(GetUserIDFromContext(r), vars["id"]) {
+		SendNotFound(w)
+		return
+	}
+	log.Println("Revoked session", vars["id"], "for UserID", GetUserIDFromContext(r))
+	SendUpdated(w)
+}
+
+// RevokeOtherSessions handles /sessions/revoke-others requests
+func (router *AuthRouter) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	claims := GetClaimsFromContext(r)
+	if claims == nil || claims.SessionID == "" {
+		SendBadRequest(w)
+		return
+	}
+	GetRefreshTokenRepository().DeleteOtherSessions(claims.UserID, claims.SessionID)
+	log.Println("Revoked all other sessions for UserID", claims.UserID)
 	SendUpdated(w)
 }
 
@@ -171,22 +325,212 @@ func (router *AuthRouter) Ping(w http.ResponseWriter, r *http.Request) {
 	SendUpdated(w)
 }
 
-func (router *AuthRouter) _CreateAccessToken(user *User) string {
-	claims := &Claims{
-		Email:  user.Email,
-		UserID: user.ID.Hex(),
+// StepUp handles /stepup requests, re-verifying the user's OTP (if enabled) or password.
+// It issues a short-lived access token with a fresh auth_time for routes requiring a recent authentication.
+func (router *AuthRouter) StepUp(w http.ResponseWriter, r *http.Request) {
+	var data StepUpRequest
+	if UnmarshalBody(r, &data) != nil {
+		SendBadRequest(w)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	user := GetUserRepository().GetOne(GetUserIDFromContext(r))
+	if claims == nil || user == nil || !user.Enabled {
+		SendUnauthorized(w)
+		return
+	}
+	var amr []string
+	if user.OTPEnabled && GetConfig().EnableTOTP {
+		if !router._IsValidOTP(user, data.OTP) {
+			log.Println("Invalid step-up attempt: OTP invalid for UserID", user.ID.Hex())
+			SendUnauthorized(w)
+			return
+		}
+		amr = []string{"otp"}
+	} else {
+		if data.Password == "" || !GetUserRepository().CheckPassword(user.HashedPassword, data.Password) {
+			log.Println("Invalid step-up attempt: invalid password for UserID", user.ID.Hex())
+			SendUnauthorized(w)
+			return
+		}
+		amr = []string{"pwd"}
+	}
+	stepUpClaims := NewAccessTokenClaims(user, GetConfig().StepUpTokenLifetime)
+	stepUpClaims.SessionID = claims.SessionID
+	stepUpClaims.Scope = claims.Scope
+	stepUpClaims.Confirmation = claims.Confirmation
+	stepUpClaims.AuthTime = stepUpClaims.IssuedAt
+	stepUpClaims.AuthMethods = amr
+	stepUpClaims.AuthContext = authenticationContextClass(amr)
+	accessToken := router._IssueAccessToken(stepUpClaims)
+	if accessToken == "" {
+		SendInternalServerError(w)
+		return
+	}
+	log.Println("Successful step-up authentication for UserID", user.ID.Hex())
+	tokenType := ""
+	if claims.Confirmation != nil {
+		tokenType = "DPoP"
+	}
+	res := &LoginResponse{
+		TokenType: tokenType,
+		ExpiresIn: int64((GetConfig().StepUpTokenLifetime * time.Minute).Seconds()),
+	}
+	if GetConfig().EnableCookies {
+		SetAccessTokenCookie(w, accessToken, GetConfig().StepUpTokenLifetime)
+		SendJSON(w, res)
+		return
+	}
+	res.AccessToken = accessToken
+	SendJSON(w, res)
+}
+
+// _CreateAccessToken issues an access token for the user, bound to the login session, DPoP key
+// and requested scope of the given refresh token (if any). In phantom token mode, an opaque reference token is returned.
+func (router *AuthRouter) _CreateAccessToken(user *User, session *RefreshToken) string {
+	claims := NewAccessTokenClaims(user, GetConfig().AccessTokenLifetime)
+	if session != nil {
+		claims.SessionID = session.GetFamilyID().Hex()
+		claims.Scope = strings.Join(NarrowScope(GetUserScopes(user), strings.Fields(session.Scope)), " ")
+		claims.AuthTime = session.GetSession().CreateDate.Unix()
+		if len(session.AuthMethods) > 0 {
+			claims.AuthMethods = session.AuthMethods
+			claims.AuthContext = authenticationContextClass(session.AuthMethods)
+		}
+		if session.JWKThumbprint != "" {
+			claims.Confirmation = &ConfirmationClaim{JWKThumbprint: session.JWKThumbprint}
+		}
+	}
+	return router._IssueAccessToken(claims)
+}
+
+// _IssueAccessToken signs the claims. In phantom token mode, an opaque reference token is returned.
+func (router *AuthRouter) _IssueAccessToken(claims *Claims) string {
+	if GetConfig().PhantomTokenEnable {
+		phantomToken, err := GetPhantomTokenRepository().Create(claims)
+		if err != nil {
+			log.Println("Could not create reference token:", err)
+			return ""
+		}
+		return phantomToken.Token
+	}
+	jwtString, err := SignAccessToken(claims)
+	if err != nil {
+		log.Println("Could not sign access token:", err)
+		return ""
+	}
+	return jwtString
+}
+
+// NewAccessTokenClaims returns the claims of a new access token for the user, valid for lifetime minutes
+func NewAccessTokenClaims(user *User, lifetime time.Duration) *Claims {
+	claims := NewClaims(user.ID.Hex(), lifetime)
+	claims.Email = user.Email
+	claims.UserID = user.ID.Hex()
+	claims.TokenVersion = user.TokenVersion
+	claims.Scope = strings.Join(GetUserScopes(user), " ")
+	claims.Roles = user.Roles
+	claims.Groups = user.Groups
+	claims.Custom = MapUserClaims(user)
+	return claims
+}
+
+// NewClaims returns the registered claims of a new access token for the subject, valid for lifetime minutes
+func NewClaims(subject string, lifetime time.Duration) *Claims {
+	now := time.Now()
+	return &Claims{
+		Audience: Audience(GetConfig().JwtAudience),
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(GetConfig().AccessTokenLifetime * time.Minute).Unix(),
+			Id:        guuid.New().String(),
+			Issuer:    GetConfig().JwtIssuer,
+			Subject:   subject,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(lifetime * time.Minute).Unix(),
 		},
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	jwtString, err := accessToken.SignedString([]byte(GetConfig().JwtSigningKey))
+}
+
+// SignAccessToken signs the claims with the active signing key
+func SignAccessToken(claims *Claims) (string, error) {
+	return GetKeyring().SignedString(claims)
+}
+
+// Token handles /token requests using the OAuth2 client credentials grant (RFC 6749, section 4.4)
+func (router *AuthRouter) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "client_credentials" {
+		SendOAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client := GetServiceClientRepository().GetByClientID(clientID)
+	if client == nil || !client.Enabled || !GetServiceClientRepository().CheckSecret(client, secret) {
+		log.Println("Invalid token request: client authentication failed for ClientID", clientID)
+		SendOAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	scopes := client.Scopes
+	if requested := strings.Fields(r.PostForm.Get("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !client.HasScope(scope) {
+				log.Println("Invalid token request: scope", scope, "not allowed for ClientID", clientID)
+				SendOAuthError(w, http.StatusBadRequest, "invalid_scope")
+				return
+			}
+		}
+		scopes = requested
+	}
+	scope := strings.Join(scopes, " ")
+	accessToken := router._CreateClientAccessToken(client, scope)
+	if accessToken == "" {
+		SendInternalServerError(w)
+		return
+	}
+	log.Println("Issued access token for ClientID", client.ClientID)
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64((GetConfig().AccessTokenLifetime * time.Minute).Seconds()),
+		Scope:       scope,
+	})
+}
+
+func (router *AuthRouter) _CreateClientAccessToken(client *ServiceClient, scope string) string {
+	claims := NewClaims(client.ClientID, GetConfig().AccessTokenLifetime)
+	claims.ClientID = client.ClientID
+	claims.Scope = scope
+	jwtString, err := SignAccessToken(claims)
 	if err != nil {
+		log.Println("Could not sign access token:", err)
 		return ""
 	}
 	return jwtString
 }
 
+// JWKS handles /.well-known/jwks.json requests
+func (router *AuthRouter) JWKS(w http.ResponseWriter, r *http.Request) {
+	res := &JWKSet{Keys: make([]*JWK, 0)}
+	for _, key := range GetKeyring().PublicKeys() {
+		jwk, err := key.JWK()
+		if err != nil {
+			log.Println("Could not create JWK:", err)
+			SendInternalServerError(w)
+			return
+		}
+		res.Keys = append(res.Keys, jwk)
+	}
+	SendJSON(w, res)
+}
+
 // Signup handles /signup requests
 func (router *AuthRouter) Signup(w http.ResponseWriter, r *http.Request) {
 	var data SignupRequest
@@ -237,6 +581,7 @@ func (router *AuthRouter) ChangePassword(w http.ResponseWriter, r *http.Request)
 	}
 	user.HashedPassword = GetUserRepository().GetHashedPassword(data.NewPassword)
 	GetUserRepository().Update(user)
+	GetUserRepository().BumpTokenVersion(user)
 	SendUpdated(w)
 }
 
@@ -310,6 +655,11 @@ func (router *AuthRouter) DeleteAccount(w http.ResponseWriter, r *http.Request)
 		SendUnauthorized(w)
 		return
 	}
+	if err := GetRevokedTokenRepository().RevokeAllForUser(user.ID.Hex()); err != nil {
+		log.Println("Could not revoke access tokens of UserID", user.ID.Hex(), "- account not deleted:", err)
+		SendInternalServerError(w)
+		return
+	}
 	GetUserRepository().Delete(user)
 	SendUpdated(w)
 }
@@ -389,6 +739,7 @@ func (router *AuthRouter) OTPDisable(w http.ResponseWriter, r *http.Request) {
 	user.OTPSecret = ""
 	user.OTPEnabled = false
 	GetUserRepository().Update(user)
+	GetUserRepository().BumpTokenVersion(user)
 	SendUpdated(w)
 }
 
@@ -416,6 +767,7 @@ func (router *AuthRouter) OTPConfirm(w http.ResponseWriter, r *http.Request) {
 	}
 	user.OTPEnabled = true
 	GetUserRepository().Update(user)
+	GetUserRepository().BumpTokenVersion(user)
 	SendUpdated(w)
 }
 
@@ -438,6 +790,7 @@ func (router *AuthRouter) _ConfirmAccountActivation(w http.ResponseWriter, pa *P
 func (router *AuthRouter) _ConfirmEmailChange(w http.ResponseWriter, pa *PendingAction, user *User) {
 	user.Email = pa.Payload
 	GetUserRepository().Update(user)
+	GetUserRepository().BumpTokenVersion(user)
 	GetPendingActionRepository().Delete(pa)
 	SendUpdated(w)
 }
@@ -446,17 +799,67 @@ func (router *AuthRouter) _ConfirmPasswordReset(w http.ResponseWriter, pa *Pendi
 	password := GetConfig().GenerateRandomPassword(8)
 	user.HashedPassword = GetUserRepository().GetHashedPassword(password)
 	GetUserRepository().Update(user)
+	GetUserRepository().BumpTokenVersion(user)
 	GetPendingActionRepository().Delete(pa)
 	router._SendNewPassword(user, password)
 	SendUpdated(w)
 }
 
-func (router *AuthRouter) _CreateRefreshToken(user *User) *RefreshToken {
+// _CreateRefreshToken starts a new login session, bound to the DPoP key with the given thumbprint (if any)
+// and limited to the requested scope (if any). amr records the authentication methods used for the login.
+// The session's lifetime, sliding expiration and maximum number of sessions are taken from the session profile.
+func (router *AuthRouter) _CreateRefreshToken(user *User, r *http.Request, jkt string, scope string, amr []string, profile *SessionProfile) *RefreshToken {
+	now := time.Now()
 	e := &RefreshToken{
-		Token:      GetRefreshTokenRepository().FindUnusedToken(),
-		CreateDate: time.Now(),
-		ExpiryDate: time.Now().Add(time.Duration(time.Minute) * GetConfig().RefreshTokenLifetime),
-		UserID:     user.ID,
+		Token:             GetRefreshTokenRepository().FindUnusedToken(),
+		CreateDate:        now,
+		UserID:            user.ID,
+		FamilyID:          primitive.NewObjectID(),
+		SessionCreateDate: now,
+		LastUsedDate:      now,
+		IPAddress:         GetRemoteIP(r),
+		UserAgent:         r.UserAgent(),
+		JWKThumbprint:     jkt,
+		Sliding:           profile.Sliding,
+		IdleTimeout:       int(GetConfig().SessionIdleTimeout),
+		Scope:             scope,
+		AuthMethods:       amr,
+		Profile:           profile.Name,
+		Lifetime:          int(profile.Lifetime),
+	}
+	if GetConfig().SessionMaxAge > 0 {
+		e.MaxExpiryDate = now.Add(time.Duration(time.Minute) * GetConfig().SessionMaxAge)
+	}
+	e.ExpiryDate = e.NextExpiryDate(now)
+	GetRefreshTokenRepository().Create(e)
+	if profile.MaxSessions > 0 {
+		GetRefreshTokenRepository().DeleteExcessSessions(user.ID.Hex(), profile.Name, profile.MaxSessions)
+	}
+	return e
+}
+
+// _RotateRefreshToken issues the successor of a consumed refresh token within the same token family.
+// The successor's expiry slides forward if the session uses sliding expiration.
+func (router *AuthRouter) _RotateRefreshToken(old *RefreshToken, r *http.Request) *RefreshToken {
+	now := time.Now()
+	e := &RefreshToken{
+		Token:             GetRefreshTokenRepository().FindUnusedToken(),
+		CreateDate:        now,
+		ExpiryDate:        old.NextExpiryDate(now),
+		UserID:            old.UserID,
+		FamilyID:          old.GetFamilyID(),
+		SessionCreateDate: old.GetSession().CreateDate,
+		LastUsedDate:      now,
+		IPAddress:         GetRemoteIP(r),
+		UserAgent:         r.UserAgent(),
+		JWKThumbprint:     old.JWKThumbprint,
+		Sliding:           old.Sliding,
+		MaxExpiryDate:     old.MaxExpiryDate,
+		IdleTimeout:       old.IdleTimeout,
+		Scope:             old.Scope,
+		AuthMethods:       old.AuthMethods,
+		Profile:           old.Profile,
+		Lifetime:          old.Lifetime,
 	}
 	GetRefreshTokenRepository().Create(e)
 	return e
@@ -517,9 +920,11 @@ func (router *AuthRouter) _SendNewPassword(user *User, password string) {
 
 // LoginRequest holds the POST payload for login requests
 type LoginRequest struct {
-	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8,max=32"`
-	OTP      string `json:"otp"`
+	Email      string `json:"email" validate:"required,email"`
+	Password   string `json:"password" validate:"required,min=8,max=32"`
+	OTP        string `json:"otp"`
+	Scope      string `json:"scope"`
+	RememberMe bool   `json:"rememberMe"`
 }
 
 type ForgotPasswordRequest struct {
@@ -533,16 +938,39 @@ type RefreshRequest struct {
 
 // Claims holds payload the issued JWTs
 type Claims struct {
-	Email  string `json:"email"`
-	UserID string `json:"userID"`
+	Email           string                 `json:"email,omitempty"`
+	UserID          string                 `json:"userID,omitempty"`
+	ClientID        string                 `json:"client_id,omitempty"`
+	Scope           string                 `json:"scope,omitempty"`
+	Actor           *ActorClaim            `json:"act,omitempty"`
+	SessionID       string                 `json:"sid,omitempty"`
+	Confirmation    *ConfirmationClaim     `json:"cnf,omitempty"`
+	TokenVersion    int                    `json:"tokenVersion,omitempty"`
+	AuthTime        int64                  `json:"auth_time,omitempty"`
+	AuthMethods     []string               `json:"amr,omitempty"`
+	AuthContext     string                 `json:"acr,omitempty"`
+	Roles           []string               `json:"roles,omitempty"`
+	Groups          []string               `json:"groups,omitempty"`
+	AuthorizedParty string                 `json:"azp,omitempty"`
+	Audience        Audience               `json:"aud,omitempty"`
+	Custom          map[string]interface{} `json:"-"`
 	jwt.StandardClaims
 }
 
+// ActorClaim identifies the party acting on behalf of the token's subject (RFC 8693, section 4.1)
+type ActorClaim struct {
+	Subject string `json:"sub"`
+}
+
 // LoginResponse holds the response payload for login responses
 type LoginResponse struct {
-	RequireOTP   bool   `json:"otpRequired"`
-	AccessToken  string `json:"accessToken"`
-	RefreshToken string `json:"refreshToken"`
+	RequireOTP       bool   `json:"otpRequired"`
+	AccessToken      string `json:"accessToken,omitempty"`
+	RefreshToken     string `json:"refreshToken,omitempty"`
+	TokenType        string `json:"tokenType,omitempty"`
+	ExpiresIn        int64  `json:"expiresIn,omitempty"`
+	RefreshExpiresIn int64  `json:"refreshExpiresIn,omitempty"`
+	SessionProfile   string `json:"sessionProfile,omitempty"`
 }
 
 // ChangePasswordRequest holds the POST payload for password change requests
@@ -567,6 +995,12 @@ type OTPInitResponse struct {
 	Image  string `json:"image"`
 }
 
+// StepUpRequest holds the credentials re-verified by a step-up authentication
+type StepUpRequest struct {
+	Password string `json:"password"`
+	OTP      string `json:"otp"`
+}
+
 type OTPValidateRequest struct {
 	Passcode string `json:"passcode" validate:"required,min=6,max=6"`
 }
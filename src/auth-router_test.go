@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/pquerna/otp/totp"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -633,3 +635,246 @@ func TestDisableTOTP(t *testing.T) {
 		t.Fatal("Expected access and refresh tokens to be non-empty without OTP")
 	}
 }
+
+func TestJWKSSymmetric(t *testing.T) {
+	req := newHTTPRequest("GET", "/auth/.well-known/jwks.json", "", nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+
+	var jwks JWKSet
+	json.Unmarshal(res.Body.Bytes(), &jwks)
+	if len(jwks.Keys) != 0 {
+		t.Fatal("Expected no published keys for HMAC signing")
+	}
+}
+
+func refreshTokens(accessToken, refreshToken string) (*LoginResponse, int) {
+	payload := "{\"refreshToken\": \"" + refreshToken + "\"}"
+	req := newHTTPRequest("POST", "/auth/refresh", accessToken, bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	var loginResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &loginResponse)
+	return &loginResponse, res.Code
+}
+
+func TestRefreshRotatesRefreshToken(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+
+	loginResponse2, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+	checkStringNotEmpty(t, loginResponse2.RefreshToken)
+	if loginResponse2.RefreshToken == loginResponse.RefreshToken {
+		t.Fatal("Expected new refresh token")
+	}
+
+	loginResponse3, code := refreshTokens(loginResponse2.AccessToken, loginResponse2.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+	checkStringNotEmpty(t, loginResponse3.AccessToken)
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	otherSession := loginUser("foo@bar.com", "12345678")
+
+	loginResponse2, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+
+	// Reuse consumed token
+	_, code = refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusUnauthorized, code)
+
+	// Successor is revoked as well
+	_, code = refreshTokens(loginResponse2.AccessToken, loginResponse2.RefreshToken)
+	checkTestResponseCode(t, http.StatusBadRequest, code)
+
+	// Other sessions are not affected
+	_, code = refreshTokens(otherSession.AccessToken, otherSession.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+}
+
+func TestRefreshForeignRefreshToken(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	user2 := &User{
+		Email:          "foo2@bar.com",
+		CreateDate:     time.Now(),
+		HashedPassword: GetUserRepository().GetHashedPassword("12345678"),
+		Confirmed:      true,
+		Enabled:        true,
+	}
+	GetUserRepository().Create(user2)
+	loginResponse2 := loginUser("foo2@bar.com", "12345678")
+
+	_, code := refreshTokens(loginResponse2.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusUnauthorized, code)
+}
+
+func TestRefreshSlidingExpiry(t *testing.T) {
+	GetConfig().RefreshTokenSliding = true
+	defer func() { GetConfig().RefreshTokenSliding = false }()
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	GetRefreshTokenRepository().GetCollection().UpdateOne(context.TODO(), bson.M{"tokenHash": HashToken(loginResponse.RefreshToken)}, bson.M{"$set": bson.M{"expiryDate": time.Now().Add(time.Minute)}})
+
+	loginResponse2, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+	refreshToken := GetRefreshTokenRepository().GetByToken(loginResponse2.RefreshToken)
+	if refreshToken.ExpiryDate.Before(time.Now().Add(time.Duration(time.Minute) * (GetConfig().RefreshTokenLifetime - 1))) {
+		t.Error("Expected expiry date to slide forward")
+	}
+	if !refreshToken.Sliding {
+		t.Error("Expected successor to use sliding expiration")
+	}
+}
+
+func TestRefreshFixedExpiry(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	expiryDate := GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken).ExpiryDate
+
+	loginResponse2, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+	refreshToken := GetRefreshTokenRepository().GetByToken(loginResponse2.RefreshToken)
+	if !refreshToken.ExpiryDate.Equal(expiryDate) {
+		t.Error("Expected expiry date to be kept")
+	}
+}
+
+func TestRefreshIdleTimeout(t *testing.T) {
+	GetConfig().SessionIdleTimeout = 10
+	defer func() { GetConfig().SessionIdleTimeout = 0 }()
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	refreshToken := GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken)
+	checkTestInt(t, 10, refreshToken.IdleTimeout)
+	if refreshToken.ExpiryDate.After(time.Now().Add(10 * time.Minute)) {
+		t.Error("Expected expiry date to be limited by the idle timeout")
+	}
+	GetRefreshTokenRepository().GetCollection().UpdateOne(context.TODO(), bson.M{"tokenHash": HashToken(loginResponse.RefreshToken)}, bson.M{"$set": bson.M{
+		"lastUsedDate": time.Now().Add(-20 * time.Minute),
+		"expiryDate":   time.Now().Add(time.Hour),
+	}})
+
+	_, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusBadRequest, code)
+	if GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken) != nil {
+		t.Error("Expected idle session to be deleted")
+	}
+}
+
+func TestRefreshMaxSessionAge(t *testing.T) {
+	GetConfig().SessionMaxAge = 60
+	defer func() { GetConfig().SessionMaxAge = 0 }()
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	refreshToken := GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken)
+	if refreshToken.MaxExpiryDate.IsZero() || refreshToken.ExpiryDate.After(refreshToken.MaxExpiryDate) {
+		t.Fatal("Expected expiry date to be limited by the maximum session age")
+	}
+	GetRefreshTokenRepository().GetCollection().UpdateOne(context.TODO(), bson.M{"tokenHash": HashToken(loginResponse.RefreshToken)}, bson.M{"$set": bson.M{
+		"maxExpiryDate": time.Now().Add(-time.Minute),
+	}})
+
+	_, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusBadRequest, code)
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+
+	payload := "{\"refreshToken\": \"" + loginResponse.RefreshToken + "\"}"
+	req := newHTTPRequest("POST", "/auth/logout", loginResponse.AccessToken, bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func getSessions(t *testing.T, accessToken string) []*Session {
+	req := newHTTPRequest("GET", "/auth/sessions", accessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var sessions []*Session
+	json.Unmarshal(res.Body.Bytes(), &sessions)
+	return sessions
+}
+
+func TestListSessions(t *testing.T) {
+	clearTestDB()
+	createTestUser(true)
+	payload := `{"email": "foo@bar.com", "password": "12345678"}`
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBufferString(payload))
+	req.Header.Set("User-Agent", "TestBrowser/1.0")
+	req.RemoteAddr = "192.0.2.1:1234"
+	res := executePublicTestRequest(req)
+	var loginResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &loginResponse)
+	loginUser("foo@bar.com", "12345678")
+
+	sessions := getSessions(t, loginResponse.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	var current *Session
+	for _, s := range sessions {
+		if s.Current {
+			current = s
+		}
+	}
+	if current == nil {
+		t.Fatal("Expected current session to be flagged")
+	}
+	checkTestString(t, "TestBrowser/1.0", current.UserAgent)
+	checkTestString(t, "192.0.2.1", current.IPAddress)
+
+	// Refreshing keeps the session
+	loginResponse2, _ := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	sessions = getSessions(t, loginResponse2.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions after refresh, got %d", len(sessions))
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	loginResponse2 := loginUser("foo@bar.com", "12345678")
+
+	var other *Session
+	for _, s := range getSessions(t, loginResponse.AccessToken) {
+		if !s.Current {
+			other = s
+		}
+	}
+	req := newHTTPRequest("DELETE", "/auth/sessions/"+other.ID, loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	_, code := refreshTokens(loginResponse2.AccessToken, loginResponse2.RefreshToken)
+	checkTestResponseCode(t, http.StatusBadRequest, code)
+
+	req = newHTTPRequest("DELETE", "/auth/sessions/"+other.ID, loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	loginUser("foo@bar.com", "12345678")
+	loginUser("foo@bar.com", "12345678")
+
+	req := newHTTPRequest("POST", "/auth/sessions/revoke-others", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	sessions := getSessions(t, loginResponse.AccessToken)
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Fatal("Expected only the current session to remain")
+	}
+}
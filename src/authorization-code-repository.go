@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuthorizationCode holds an OAuth2 authorization code issued to an OIDC client on behalf of a user
+type AuthorizationCode struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Code          string             `json:"code" bson:"code"`
+	ClientID      string             `json:"clientId" bson:"clientId"`
+	UserID        primitive.ObjectID `json:"userId" bson:"userId"`
+	RedirectURI   string             `json:"redirectUri" bson:"redirectUri"`
+	Scope         string             `json:"scope" bson:"scope"`
+	Nonce         string             `json:"nonce" bson:"nonce,omitempty"`
+	CodeChallenge string             `json:"codeChallenge" bson:"codeChallenge"`
+	CreateDate    time.Time          `json:"createDate" bson:"createDate"`
+	ExpiryDate    time.Time          `json:"expiryDate" bson:"expiryDate"`
+}
+
+type AuthorizationCodeRepository struct {
+}
+
+var _authorizationCodeRepositoryInstance *AuthorizationCodeRepository
+var _authorizationCodeRepositoryOnce sync.Once
+
+func GetAuthorizationCodeRepository() *AuthorizationCodeRepository {
+	_authorizationCodeRepositoryOnce.Do(func() {
+		_authorizationCodeRepositoryInstance = &AuthorizationCodeRepository{}
+		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
+		// Create unique index on 'code'
+		mod := mongo.IndexModel{
+			Keys: bson.M{
+				"code": 1,
+			},
+			Options: options.Index().SetUnique(true),
+		}
+		_, err := _authorizationCodeRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return _authorizationCodeRepositoryInstance
+}
+
+func (r *AuthorizationCodeRepository) GetCollection() *mongo.Collection {
+	return GetDatatabase().Database.Collection("oidc_codes")
+}
+
+func (r *AuthorizationCodeRepository) Create(c *AuthorizationCode) {
+	res, err := r.GetCollection().InsertOne(context.TODO(), c)
+	if err != nil {
+		log.Println(err)
+	}
+	c.ID = res.InsertedID.(primitive.ObjectID)
+}
+
+func (r *AuthorizationCodeRepository) GetByCode(code string) *AuthorizationCode {
+	var authCode AuthorizationCode
+	err := r.GetCollection().FindOne(context.TODO(), bson.M{"code": code}).Decode(&authCode)
+	if err != nil {
+		return nil
+	}
+	return &authCode
+}
+
+// Consume deletes the code and returns it if it has not expired.
+// Each code can only be redeemed once, even by concurrent requests.
+func (r *AuthorizationCodeRepository) Consume(code string) *AuthorizationCode {
+	var authCode AuthorizationCode
+	err := r.GetCollection().FindOneAndDelete(context.TODO(), bson.M{"code": code}).Decode(&authCode)
+	if err != nil {
+		return nil
+	}
+	if authCode.ExpiryDate.Before(time.Now()) {
+		return nil
+	}
+	return &authCode
+}
+
+func (r *AuthorizationCodeRepository) DeleteAllForUser(userID string) {
+	_, err := r.GetCollection().DeleteMany(context.TODO(), bson.M{"userId": GetDatatabase().GetObjectID(userID)})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *AuthorizationCodeRepository) DeleteAllForClient(clientID string) {
+	_, err := r.GetCollection().DeleteMany(context.TODO(), bson.M{"clientId": clientID})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *AuthorizationCodeRepository) FindUnusedCode() string {
+	var code string = ""
+	for i := 1; i <= 20 && code == ""; i++ {
+		code = guuid.New().String()
+		if r.GetByCode(code) != nil {
+			code = ""
+		}
+	}
+	return code
+}
+
+func (r *AuthorizationCodeRepository) CleanUp() {
+	_, err := r.GetCollection().DeleteMany(context.TODO(), bson.M{"expiryDate": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		log.Println(err)
+	}
+}
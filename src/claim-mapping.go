@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ClaimMapping copies a user attribute (account state or a path within the user's custom data) into a JWT claim
+type ClaimMapping struct {
+	Source string
+	Claim  string
+}
+
+// registeredClaims holds the claims set by the proxy itself which can't be overridden by a claim mapping
+var registeredClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "email", "userID", "client_id", "scope", "act", "sid", "tokenVersion", "cnf", "auth_time", "amr", "acr", "roles", "groups", "azp"}
+
+var userClaimSources = []string{"email", "confirmed", "enabled", "otpEnabled", "createDate"}
+
+var claimNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_\-]*$`)
+
+// ParseClaimMappings parses a comma-separated list of 'source:claim' pairs, e.g. 'data.plan:plan,otpEnabled:otp'.
+// Former mappings to the 'amr' claim are skipped as it is set by the proxy with the same meaning.
+// Former mappings to the 'roles' and 'groups' claims are skipped, their values are migrated on startup (see ObsoleteRoleMappings).
+func ParseClaimMappings(s string) ([]*ClaimMapping, error) {
+	res := make([]*ClaimMapping, 0)
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	claims := make(map[string]bool)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid claim mapping: " + pair)
+		}
+		m := &ClaimMapping{
+			Source: strings.TrimSpace(parts[0]),
+			Claim:  strings.TrimSpace(parts[1]),
+		}
+		if m.Claim == "amr" {
+			log.Println("Ignoring obsolete claim mapping", pair, "- the amr claim is set by the proxy")
+			continue
+		}
+		if m.Claim == "roles" || m.Claim == "groups" {
+			log.Println("Ignoring obsolete claim mapping", strings.TrimSpace(pair), "- the", m.Claim, "claim is set from the user's", m.Claim+
+				", values from the user data are migrated on startup. Remove the mapping from JWT_CLAIM_MAPPING once migrated.")
+			continue
+		}
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+		if claims[m.Claim] {
+			return nil, errors.New("Duplicate claim in claim mapping: " + m.Claim)
+		}
+		claims[m.Claim] = true
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// ObsoleteRoleMappings returns the former 'data.<path>:roles' and 'data.<path>:groups' pairs of a JWT_CLAIM_MAPPING value,
+// which are migrated on startup as if they were set in ROLE_MIGRATION
+func ObsoleteRoleMappings(s string) []*ClaimMapping {
+	res := make([]*ClaimMapping, 0)
+	if strings.TrimSpace(s) == "" {
+		return res
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if migrations, err := ParseRoleMigrations(pair); err == nil {
+			res = append(res, migrations...)
+		}
+	}
+	return res
+}
+
+func (m *ClaimMapping) Validate() error {
+	if !claimNameRegexp.MatchString(m.Claim) {
+		return errors.New("Invalid claim name in claim mapping: " + m.Claim)
+	}
+	if IsRegisteredClaim(m.Claim) {
+		return errors.New("Claim can't be overridden by claim mapping: " + m.Claim)
+	}
+	if !IsValidUserSource(m.Source) {
+		return errors.New("Invalid source in claim mapping: " + m.Source)
+	}
+	return nil
+}
+
+// IsValidUserSource checks if the source refers to a user attribute or a path within the user's custom data
+func IsValidUserSource(source string) bool {
+	if source == "data" || (strings.HasPrefix(source, "data.") && !strings.Contains(source, "..") && !strings.HasSuffix(source, ".")) {
+		return true
+	}
+	for _, s := range userClaimSources {
+		if source == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the value of the mapping's source for the given user or nil if it is not set
+func (m *ClaimMapping) Resolve(user *User) interface{} {
+	switch m.Source {
+	case "email":
+		return user.Email
+	case "confirmed":
+		return user.Confirmed
+	case "enabled":
+		return user.Enabled
+	case "otpEnabled":
+		return user.OTPEnabled && GetConfig().EnableTOTP
+	case "createDate":
+		return user.CreateDate.Unix()
+	}
+	value := NormalizeBSONValue(user.Data)
+	for _, key := range strings.Split(m.Source, ".")[1:] {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[key]
+	}
+	return value
+}
+
+func IsRegisteredClaim(claim string) bool {
+	for _, registered := range registeredClaims {
+		if claim == registered {
+			return true
+		}
+	}
+	return false
+}
+
+// MapUserClaims applies the configured claim mappings to the user.
+// Unset values are skipped, values exceeding JWT_CLAIM_MAX_SIZE or JWT_CLAIMS_MAX_SIZE are dropped.
+func MapUserClaims(user *User) map[string]interface{} {
+	res := make(map[string]interface{})
+	total := 0
+	for _, m := range GetConfig().ClaimMappings {
+		value := m.Resolve(user)
+		if value == nil {
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			log.Println("Could not map claim", m.Claim, "for UserID", user.ID.Hex(), ":", err)
+			continue
+		}
+		if len(encoded) > GetConfig().ClaimMaxSize {
+			log.Println("Dropping claim", m.Claim, "for UserID", user.ID.Hex(), ": value exceeds", GetConfig().ClaimMaxSize, "bytes")
+			continue
+		}
+		if total+len(encoded) > GetConfig().ClaimsMaxSize {
+			log.Println("Dropping claim", m.Claim, "for UserID", user.ID.Hex(), ": mapped claims exceed", GetConfig().ClaimsMaxSize, "bytes")
+			continue
+		}
+		total += len(encoded)
+		res[m.Claim] = value
+	}
+	return res
+}
+
+// NormalizeBSONValue converts documents and arrays decoded from MongoDB into plain maps and slices
+func NormalizeBSONValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case primitive.D:
+		res := make(map[string]interface{})
+		for _, e := range value {
+			res[e.Key] = NormalizeBSONValue(e.Value)
+		}
+		return res
+	case primitive.M:
+		res := make(map[string]interface{})
+		for k, e := range value {
+			res[k] = NormalizeBSONValue(e)
+		}
+		return res
+	case map[string]interface{}:
+		return NormalizeBSONValue(primitive.M(value))
+	case primitive.A:
+		res := make([]interface{}, len(value))
+		for i, e := range value {
+			res[i] = NormalizeBSONValue(e)
+		}
+		return res
+	case []interface{}:
+		return NormalizeBSONValue(primitive.A(value))
+	case primitive.DateTime:
+		return value.Time().UTC().Format(time.RFC3339)
+	case primitive.ObjectID:
+		return value.Hex()
+	}
+	return v
+}
+
+// MarshalJSON adds the custom claims to the JSON representation of the claims
+func (c Claims) MarshalJSON() ([]byte, error) {
+	type claimsAlias Claims
+	b, err := json.Marshal(claimsAlias(c))
+	if err != nil || len(c.Custom) == 0 {
+		return b, err
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	for k, v := range c.Custom {
+		if _, ok := res[k]; !ok {
+			res[k] = v
+		}
+	}
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON reads the registered claims into the struct fields and all other claims into Custom
+func (c *Claims) UnmarshalJSON(b []byte) error {
+	type claimsAlias Claims
+	var alias claimsAlias
+	if err := json.Unmarshal(b, &alias); err != nil {
+		return err
+	}
+	var custom map[string]interface{}
+	if err := json.Unmarshal(b, &custom); err != nil {
+		return err
+	}
+	for _, claim := range registeredClaims {
+		delete(custom, claim)
+	}
+	*c = Claims(alias)
+	c.Custom = nil
+	if len(custom) > 0 {
+		c.Custom = custom
+	}
+	return nil
+}
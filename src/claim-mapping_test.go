@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseClaimMappings(t *testing.T) {
+	mappings, err := ParseClaimMappings("data.plan:plan, otpEnabled:otp, otpEnabled:amr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 2 {
+		t.Fatalf("Expected 2 mappings, got %d", len(mappings))
+	}
+	checkTestString(t, "data.plan", mappings[0].Source)
+	checkTestString(t, "plan", mappings[0].Claim)
+	checkTestString(t, "otp", mappings[1].Claim)
+
+	// Roles and groups are no longer mapped from the user data, but migrated
+	mappings, err = ParseClaimMappings("data.plan:plan, data.roles:roles, data.teams:groups, email:roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 1 {
+		t.Fatalf("Expected 1 mapping, got %d", len(mappings))
+	}
+	migrations := ObsoleteRoleMappings("data.plan:plan, data.roles:roles, data.teams:groups, email:roles")
+	if len(migrations) != 2 {
+		t.Fatalf("Expected 2 role migrations, got %d", len(migrations))
+	}
+	checkTestString(t, "data.roles", migrations[0].Source)
+	checkTestString(t, "groups", migrations[1].Claim)
+
+	for _, s := range []string{"data.roles", "data.roles:exp", "password:pw", "data..x:x", "data.a:a,data.b:a", "email:in valid"} {
+		if _, err := ParseClaimMappings(s); err == nil {
+			t.Errorf("Expected error for claim mapping '%s'", s)
+		}
+	}
+}
+
+func TestClaimMappingResolveNested(t *testing.T) {
+	user := &User{
+		Data: primitive.D{
+			{Key: "plan", Value: primitive.D{{Key: "tier", Value: "pro"}}},
+			{Key: "roles", Value: primitive.A{"admin", "user"}},
+		},
+	}
+	m := &ClaimMapping{Source: "data.plan.tier", Claim: "tier"}
+	checkTestString(t, "pro", m.Resolve(user).(string))
+	m = &ClaimMapping{Source: "data.roles", Claim: "roles"}
+	if roles := m.Resolve(user).([]interface{}); len(roles) != 2 {
+		t.Fatalf("Expected 2 roles, got %d", len(roles))
+	}
+	m = &ClaimMapping{Source: "data.plan.tier.x", Claim: "x"}
+	if m.Resolve(user) != nil {
+		t.Fatal("Expected nil for non-existing path")
+	}
+}
+
+func TestClaimsCustomJSON(t *testing.T) {
+	key, _ := NewSigningKey("ES256")
+	claims := &Claims{
+		Email:  "foo@bar.com",
+		UserID: "123",
+		Custom: map[string]interface{}{"plan": "pro", "email": "evil@bar.com"},
+	}
+	jwtString, err := key.SignedString(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &Claims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(jwtString, res); err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, "foo@bar.com", res.Email)
+	checkTestString(t, "pro", res.Custom["plan"].(string))
+	if _, ok := res.Custom["email"]; ok {
+		t.Fatal("Expected registered claims not to be contained in custom claims")
+	}
+}
+
+func TestLoginClaimMapping(t *testing.T) {
+	os.Setenv("JWT_CLAIM_MAPPING", "data.plan:plan,data.bio:bio,otpEnabled:amr,confirmed:confirmed")
+	os.Setenv("JWT_CLAIM_MAX_SIZE", "64")
+	GetConfig().ReadConfig()
+	defer func() {
+		os.Setenv("JWT_CLAIM_MAPPING", "")
+		os.Setenv("JWT_CLAIM_MAX_SIZE", "")
+		GetConfig().ReadConfig()
+	}()
+
+	clearTestDB()
+	user := createTestUser(true)
+	payload := `{"plan": "pro", "bio": "` + strings.Repeat("x", 100) + `"}`
+	req, _ := http.NewRequest("PUT", "/users/"+user.ID.Hex()+"/data", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	loginResponse := loginUser("foo@bar.com", "12345678")
+	claims := &Claims{}
+	new(jwt.Parser).ParseUnverified(loginResponse.AccessToken, claims)
+	if claims.Custom["plan"] != "pro" {
+		t.Fatalf("Expected plan claim pro, got %v", claims.Custom["plan"])
+	}
+	if len(claims.AuthMethods) != 1 || claims.AuthMethods[0] != "pwd" {
+		t.Fatalf("Expected amr claim [pwd], got %v", claims.AuthMethods)
+	}
+	if claims.Custom["confirmed"] != true {
+		t.Fatal("Expected confirmed claim to be true")
+	}
+	if _, ok := claims.Custom["bio"]; ok {
+		t.Fatal("Expected oversized claim to be dropped")
+	}
+
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -14,6 +15,28 @@ import (
 
 type Config struct {
 	JwtSigningKey           string
+	JwtSigningMethod        string
+	JwtPrivateKeyFile       string
+	JwtKeyEncryptionKey     string
+	JwtKeyRotationInterval  time.Duration
+	JwtKeyRetiredCount      int
+	ClaimMappings           []*ClaimMapping
+	ClaimMaxSize            int
+	ClaimsMaxSize           int
+	HeaderMappings          []*HeaderMapping
+	JwtIssuer               string
+	JwtAudience             []string
+	RouteAudiences          []*RouteAudience
+	UserScopes              []string
+	RoleScopes              []*RoleScope
+	RouteScopes             []*RouteScope
+	StepUpRoutes            []*StepUpRoute
+	AccessRules             []*AccessRule
+	RoleMigrations          []*ClaimMapping
+	PolicyFile              string
+	StepUpTokenLifetime     time.Duration
+	ExternalIssuers         []*ExternalIssuer
+	ExternalJWKSRefresh     time.Duration
 	PublicListenAddr        string
 	PublicAPIPath           string
 	BackendListenAddr       string
@@ -30,6 +53,13 @@ type Config struct {
 	EnableCors              bool
 	CorsOrigin              string
 	CorsHeaders             string
+	EnableCookies           bool
+	CookieDomain            string
+	CookieSecure            bool
+	CookieSameSite          http.SameSite
+	CookieAccessTokenName   string
+	CookieRefreshTokenName  string
+	CookieCSRFName          string
 	SMTPServer              string
 	SMTPSenderAddr          string
 	AllowSignup             bool
@@ -40,12 +70,38 @@ type Config struct {
 	EnableTOTP              bool
 	TOTPIssuer              string
 	TOTPSecretEncryptionKey string
+	EnableOIDC              bool
+	OIDCIssuer              string
+	OIDCLoginURL            string
+	OIDCCodeLifetime        time.Duration
+	EnableClientCredentials bool
 	ProxyTarget             *url.URL
 	ProxyWhitelist          []string
 	ProxyBlacklist          []string
 	AccessTokenLifetime     time.Duration
 	RefreshTokenLifetime    time.Duration
+	RefreshTokenSliding     bool
+	SessionMaxAge           time.Duration
+	SessionIdleTimeout      time.Duration
+	SessionProfiles         []*SessionProfile
+	SessionProfile          string
+	RememberMeProfile       string
 	PendingActionLifetime   time.Duration
+	RevocationSyncInterval  time.Duration
+	ImpersonationLifetime   time.Duration
+	ImpersonationDenyOTP    bool
+	TokenVersionCacheTTL    time.Duration
+	DPoPEnable              bool
+	DPoPRequired            bool
+	DPoPProofMaxAge         time.Duration
+	DPoPNonceEnable         bool
+	DPoPNonceLifetime       time.Duration
+	DPoPPublicURL           string
+	PhantomTokenEnable      bool
+	PhantomTokenCacheTTL    time.Duration
+	UpstreamSigningEnable   bool
+	UpstreamSigningKeyFile  string
+	UpstreamSigningKeyID    string
 }
 
 var _configInstance *Config
@@ -71,9 +127,63 @@ func (c *Config) GenerateRandomPassword(length int) string {
 	return b.String()
 }
 
+// MaxAccessTokenLifetime returns the longest lifetime in minutes of the access tokens issued by the proxy
+func (c *Config) MaxAccessTokenLifetime() time.Duration {
+	res := c.AccessTokenLifetime
+	for _, lifetime := range []time.Duration{c.StepUpTokenLifetime, c.ImpersonationLifetime} {
+		if lifetime > res {
+			res = lifetime
+		}
+	}
+	return res
+}
+
 func (c *Config) ReadConfig() {
 	log.Println("Reading config...")
 	c.JwtSigningKey = c._GetEnv("JWT_SIGNING_KEY", c.GenerateRandomPassword(32))
+	c.JwtSigningMethod = c._GetEnv("JWT_SIGNING_METHOD", "HS512")
+	if !IsSupportedSigningMethod(c.JwtSigningMethod) {
+		log.Fatal("Unsupported JWT_SIGNING_METHOD: ", c.JwtSigningMethod)
+	}
+	c.JwtPrivateKeyFile = c._GetEnv("JWT_PRIVATE_KEY_FILE", "")
+	c.JwtKeyEncryptionKey = c._GetEnv("JWT_KEY_ENCRYPT_KEY", "")
+	if c.JwtKeyEncryptionKey != "" && len(c.JwtKeyEncryptionKey) < 16 {
+		log.Fatal("JWT_KEY_ENCRYPT_KEY must have a minimum length of 16 bytes")
+	}
+	if i, err := strconv.Atoi(c._GetEnv("JWT_KEY_ROTATION_INTERVAL", "0")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.JwtKeyRotationInterval = time.Duration(i)
+	}
+	if c.JwtKeyRotationInterval > 0 && c.JwtKeyEncryptionKey == "" {
+		// Without shared keys, each replica would rotate to its own key and reject the other replicas' tokens
+		log.Fatal("JWT_KEY_ROTATION_INTERVAL requires JWT_KEY_ENCRYPT_KEY")
+	}
+	if i, err := strconv.Atoi(c._GetEnv("JWT_KEY_RETIRED_COUNT", "2")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.JwtKeyRetiredCount = i
+	}
+	if mappings, err := ParseClaimMappings(c._GetEnv("JWT_CLAIM_MAPPING", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.ClaimMappings = mappings
+	}
+	if mappings, err := ParseHeaderMappings(c._GetEnv("PROXY_HEADER_MAPPING", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.HeaderMappings = mappings
+	}
+	if i, err := strconv.Atoi(c._GetEnv("JWT_CLAIM_MAX_SIZE", "1024")); err != nil || i <= 0 {
+		log.Fatal("Invalid JWT_CLAIM_MAX_SIZE")
+	} else {
+		c.ClaimMaxSize = i
+	}
+	if i, err := strconv.Atoi(c._GetEnv("JWT_CLAIMS_MAX_SIZE", "4096")); err != nil || i <= 0 {
+		log.Fatal("Invalid JWT_CLAIMS_MAX_SIZE")
+	} else {
+		c.ClaimsMaxSize = i
+	}
 	c.PublicListenAddr = c._GetEnv("PUBLIC_LISTEN_ADDR", "0.0.0.0:8080")
 	c.PublicAPIPath = c._GetEnv("PUBLIC_API_PATH", "/auth/")
 	if !strings.HasSuffix(c.PublicAPIPath, "/") {
@@ -100,6 +210,25 @@ func (c *Config) ReadConfig() {
 	c.EnableCors = (c._GetEnv("CORS_ENABLE", "0") == "1")
 	c.CorsOrigin = c._GetEnv("CORS_ORIGIN", "*")
 	c.CorsHeaders = c._GetEnv("CORS_HEADERS", "*")
+	c.EnableCookies = (c._GetEnv("COOKIE_ENABLE", "0") == "1")
+	c.CookieDomain = c._GetEnv("COOKIE_DOMAIN", "")
+	c.CookieSecure = (c._GetEnv("COOKIE_SECURE", "1") == "1")
+	switch strings.ToLower(c._GetEnv("COOKIE_SAMESITE", "strict")) {
+	case "strict":
+		c.CookieSameSite = http.SameSiteStrictMode
+	case "lax":
+		c.CookieSameSite = http.SameSiteLaxMode
+	case "none":
+		c.CookieSameSite = http.SameSiteNoneMode
+	default:
+		log.Fatal("Invalid COOKIE_SAMESITE")
+	}
+	if c.CookieSameSite == http.SameSiteNoneMode && !c.CookieSecure {
+		log.Fatal("COOKIE_SAMESITE=none requires COOKIE_SECURE=1")
+	}
+	c.CookieAccessTokenName = c._GetEnv("COOKIE_ACCESS_TOKEN_NAME", "access_token")
+	c.CookieRefreshTokenName = c._GetEnv("COOKIE_REFRESH_TOKEN_NAME", "refresh_token")
+	c.CookieCSRFName = c._GetEnv("COOKIE_CSRF_NAME", "csrf_token")
 	c.SMTPServer = c._GetEnv("SMTP_SERVER", "127.0.0.1:25")
 	c.SMTPSenderAddr = c._GetEnv("SMTP_SENDER_ADDR", "no-reply@localhost")
 	c.AllowSignup = (c._GetEnv("ALLOW_SIGNUP", "1") == "1")
@@ -113,6 +242,92 @@ func (c *Config) ReadConfig() {
 	if c.EnableTOTP && len(c.TOTPSecretEncryptionKey) < 16 {
 		log.Fatal("TOTP_ENCRYPT_KEY with minimum length of 16 bytes required")
 	}
+	c.EnableOIDC = (c._GetEnv("OIDC_ENABLE", "0") == "1")
+	c.OIDCIssuer = strings.TrimSuffix(c._GetEnv("OIDC_ISSUER", ""), "/")
+	c.OIDCLoginURL = c._GetEnv("OIDC_LOGIN_URL", "")
+	if c.EnableOIDC {
+		if IsSymmetricSigningMethod(c.JwtSigningMethod) {
+			log.Fatal("OIDC_ENABLE requires an asymmetric JWT_SIGNING_METHOD")
+		}
+		if c.OIDCIssuer == "" || c.OIDCLoginURL == "" {
+			log.Fatal("OIDC_ISSUER and OIDC_LOGIN_URL required if OIDC_ENABLE=1")
+		}
+	}
+	defaultIssuer := "jwt-auth-proxy"
+	if c.OIDCIssuer != "" {
+		defaultIssuer = c.OIDCIssuer
+	}
+	c.JwtIssuer = c._GetEnv("JWT_ISSUER", defaultIssuer)
+	c.JwtAudience = make([]string, 0)
+	for _, aud := range strings.Split(c._GetEnv("JWT_AUDIENCE", c.JwtIssuer), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			c.JwtAudience = append(c.JwtAudience, aud)
+		}
+	}
+	if len(c.JwtAudience) == 0 {
+		log.Fatal("Invalid JWT_AUDIENCE")
+	}
+	if routeAudiences, err := ParseRouteAudiences(c._GetEnv("JWT_ROUTE_AUDIENCE", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.RouteAudiences = routeAudiences
+	}
+	if scopes, err := ParseScope(c._GetEnv("JWT_USER_SCOPE", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.UserScopes = scopes
+	}
+	if roleScopes, err := ParseRoleScopes(c._GetEnv("JWT_ROLE_SCOPE", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.RoleScopes = roleScopes
+	}
+	if routeScopes, err := ParseRouteScopes(c._GetEnv("JWT_ROUTE_SCOPE", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.RouteScopes = routeScopes
+	}
+	if accessRules, err := ParseAccessRules(c._GetEnv("PROXY_ACCESS_RULES", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.AccessRules = accessRules
+	}
+	if migrations, err := ParseRoleMigrations(c._GetEnv("ROLE_MIGRATION", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.RoleMigrations = append(migrations, ObsoleteRoleMappings(c._GetEnv("JWT_CLAIM_MAPPING", ""))...)
+	}
+	if stepUpRoutes, err := ParseStepUpRoutes(c._GetEnv("STEPUP_ROUTES", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.StepUpRoutes = stepUpRoutes
+	}
+	if i, err := strconv.Atoi(c._GetEnv("STEPUP_TOKEN_LIFETIME", "5")); err != nil || i <= 0 {
+		log.Fatal("Invalid STEPUP_TOKEN_LIFETIME")
+	} else {
+		c.StepUpTokenLifetime = time.Duration(i)
+	}
+	if issuers, err := LoadExternalIssuers(c._GetEnv("EXTERNAL_ISSUERS_FILE", "")); err != nil {
+		log.Fatal(err)
+	} else {
+		c.ExternalIssuers = issuers
+	}
+	for _, iss := range c.ExternalIssuers {
+		if iss.Issuer == c.JwtIssuer {
+			log.Fatal("External issuer must differ from JWT_ISSUER: ", iss.Issuer)
+		}
+	}
+	if i, err := strconv.Atoi(c._GetEnv("EXTERNAL_JWKS_REFRESH_INTERVAL", "60")); err != nil || i <= 0 {
+		log.Fatal("Invalid EXTERNAL_JWKS_REFRESH_INTERVAL")
+	} else {
+		c.ExternalJWKSRefresh = time.Duration(i)
+	}
+	if i, err := strconv.Atoi(c._GetEnv("OIDC_CODE_LIFETIME", "60")); err != nil || i <= 0 {
+		log.Fatal("Invalid OIDC_CODE_LIFETIME")
+	} else {
+		c.OIDCCodeLifetime = time.Duration(i)
+	}
+	c.EnableClientCredentials = (c._GetEnv("CLIENT_CREDENTIALS_ENABLE", "0") == "1")
 	if proxyTaget, err := url.Parse(c._GetEnv("PROXY_TARGET", "http://127.0.0.1:80")); err != nil {
 		log.Fatal(err)
 	} else {
@@ -129,6 +344,10 @@ func (c *Config) ReadConfig() {
 	if len(c.ProxyBlacklist) > 0 && len(c.ProxyWhitelist) > 0 {
 		log.Fatal("Can't set both PROXY_WHITELIST and PROXY_BLACKLIST")
 	}
+	c.PolicyFile = c._GetEnv("POLICY_FILE", "")
+	if c.PolicyFile != "" && (len(c.ProxyBlacklist) > 0 || len(c.ProxyWhitelist) > 0) {
+		log.Fatal("Can't set POLICY_FILE together with PROXY_WHITELIST or PROXY_BLACKLIST")
+	}
 	if i, err := strconv.Atoi(c._GetEnv("ACCESS_TOKEN_LIFETIME", "5")); err != nil {
 		log.Fatal(err)
 	} else {
@@ -139,11 +358,84 @@ func (c *Config) ReadConfig() {
 	} else {
 		c.RefreshTokenLifetime = time.Duration(i)
 	}
+	c.RefreshTokenSliding = (c._GetEnv("REFRESH_TOKEN_SLIDING", "0") == "1")
+	if i, err := strconv.Atoi(c._GetEnv("SESSION_MAX_AGE", "0")); err != nil || i < 0 {
+		log.Fatal("Invalid SESSION_MAX_AGE")
+	} else {
+		c.SessionMaxAge = time.Duration(i)
+	}
+	if i, err := strconv.Atoi(c._GetEnv("SESSION_IDLE_TIMEOUT", "0")); err != nil || i < 0 {
+		log.Fatal("Invalid SESSION_IDLE_TIMEOUT")
+	} else {
+		c.SessionIdleTimeout = time.Duration(i)
+	}
+	defaultProfile := &SessionProfile{
+		Name:     defaultSessionProfile,
+		Lifetime: c.RefreshTokenLifetime,
+		Sliding:  c.RefreshTokenSliding,
+	}
+	if profiles, err := ParseSessionProfiles(c._GetEnv("SESSION_PROFILES", ""), defaultProfile); err != nil {
+		log.Fatal(err)
+	} else {
+		c.SessionProfiles = profiles
+	}
+	c.SessionProfile = c._GetEnv("SESSION_PROFILE", defaultSessionProfile)
+	c.RememberMeProfile = c._GetEnv("SESSION_PROFILE_REMEMBER_ME", c.SessionProfile)
+	for _, name := range []string{c.SessionProfile, c.RememberMeProfile} {
+		if FindSessionProfile(c.SessionProfiles, name) == nil {
+			log.Fatal("Unknown session profile: ", name)
+		}
+	}
 	if i, err := strconv.Atoi(c._GetEnv("PENDING_ACTION_LIFETIME", strconv.Itoa(24*60))); err != nil {
 		log.Fatal(err)
 	} else {
 		c.PendingActionLifetime = time.Duration(i)
 	}
+	if i, err := strconv.Atoi(c._GetEnv("REVOCATION_SYNC_INTERVAL", "10")); err != nil || i <= 0 {
+		log.Fatal("Invalid REVOCATION_SYNC_INTERVAL")
+	} else {
+		c.RevocationSyncInterval = time.Duration(i)
+	}
+	if i, err := strconv.Atoi(c._GetEnv("IMPERSONATION_TOKEN_LIFETIME", "5")); err != nil || i <= 0 {
+		log.Fatal("Invalid IMPERSONATION_TOKEN_LIFETIME")
+	} else {
+		c.ImpersonationLifetime = time.Duration(i)
+	}
+	c.ImpersonationDenyOTP = (c._GetEnv("IMPERSONATION_DENY_OTP_USERS", "0") == "1")
+	if i, err := strconv.Atoi(c._GetEnv("TOKEN_VERSION_CACHE_TTL", "5")); err != nil || i < 0 {
+		log.Fatal("Invalid TOKEN_VERSION_CACHE_TTL")
+	} else {
+		c.TokenVersionCacheTTL = time.Duration(i)
+	}
+	c.DPoPEnable = (c._GetEnv("DPOP_ENABLE", "0") == "1")
+	c.DPoPRequired = (c._GetEnv("DPOP_REQUIRED", "0") == "1")
+	if c.DPoPRequired && !c.DPoPEnable {
+		log.Fatal("DPOP_REQUIRED=1 requires DPOP_ENABLE=1")
+	}
+	if i, err := strconv.Atoi(c._GetEnv("DPOP_PROOF_MAX_AGE", "60")); err != nil || i <= 0 {
+		log.Fatal("Invalid DPOP_PROOF_MAX_AGE")
+	} else {
+		c.DPoPProofMaxAge = time.Duration(i)
+	}
+	c.DPoPNonceEnable = (c._GetEnv("DPOP_NONCE_ENABLE", "0") == "1")
+	if i, err := strconv.Atoi(c._GetEnv("DPOP_NONCE_LIFETIME", "300")); err != nil || i <= 0 {
+		log.Fatal("Invalid DPOP_NONCE_LIFETIME")
+	} else {
+		c.DPoPNonceLifetime = time.Duration(i)
+	}
+	c.DPoPPublicURL = strings.TrimSuffix(c._GetEnv("DPOP_PUBLIC_URL", ""), "/")
+	c.PhantomTokenEnable = (c._GetEnv("PHANTOM_TOKEN_ENABLE", "0") == "1")
+	if i, err := strconv.Atoi(c._GetEnv("PHANTOM_TOKEN_CACHE_TTL", "30")); err != nil || i < 0 {
+		log.Fatal("Invalid PHANTOM_TOKEN_CACHE_TTL")
+	} else {
+		c.PhantomTokenCacheTTL = time.Duration(i)
+	}
+	c.UpstreamSigningEnable = (c._GetEnv("UPSTREAM_SIGNATURE_ENABLE", "0") == "1")
+	c.UpstreamSigningKeyFile = c._GetEnv("UPSTREAM_SIGNATURE_KEY_FILE", "")
+	c.UpstreamSigningKeyID = c._GetEnv("UPSTREAM_SIGNATURE_KEY_ID", "jwt-auth-proxy")
+	if c.UpstreamSigningEnable && c.UpstreamSigningKeyFile == "" {
+		log.Fatal("UPSTREAM_SIGNATURE_KEY_FILE required if UPSTREAM_SIGNATURE_ENABLE=1")
+	}
 }
 
 func (c *Config) _GetEnv(key, defaultValue string) string {
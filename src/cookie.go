@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// csrfHeader is the request header the frontend copies the CSRF cookie's value to
+const csrfHeader = "X-CSRF-Token"
+
+// SetSessionCookies sets the HttpOnly access and refresh token cookies plus a new CSRF token cookie readable by JavaScript.
+// The refresh token and CSRF cookies expire with the session's refresh token.
+func SetSessionCookies(w http.ResponseWriter, accessToken, refreshToken string, refreshExpiry time.Time) error {
+	csrfToken, err := GenerateCSRFToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	http.SetCookie(w, newSessionCookie(GetConfig().CookieAccessTokenName, accessToken, "/", true, now.Add(GetConfig().AccessTokenLifetime*time.Minute)))
+	http.SetCookie(w, newSessionCookie(GetConfig().CookieRefreshTokenName, refreshToken, GetConfig().PublicAPIPath, true, refreshExpiry))
+	http.SetCookie(w, newSessionCookie(GetConfig().CookieCSRFName, csrfToken, "/", false, refreshExpiry))
+	return nil
+}
+
+// SetAccessTokenCookie replaces the HttpOnly access token cookie, keeping the refresh token and CSRF cookies
+func SetAccessTokenCookie(w http.ResponseWriter, accessToken string, lifetime time.Duration) {
+	http.SetCookie(w, newSessionCookie(GetConfig().CookieAccessTokenName, accessToken, "/", true, time.Now().Add(lifetime*time.Minute)))
+}
+
+// ClearSessionCookies instructs the browser to delete the session cookies
+func ClearSessionCookies(w http.ResponseWriter) {
+	for _, c := range []*http.Cookie{
+		newSessionCookie(GetConfig().CookieAccessTokenName, "", "/", true, time.Unix(0, 0)),
+		newSessionCookie(GetConfig().CookieRefreshTokenName, "", GetConfig().PublicAPIPath, true, time.Unix(0, 0)),
+		newSessionCookie(GetConfig().CookieCSRFName, "", "/", false, time.Unix(0, 0)),
+	} {
+		c.MaxAge = -1
+		http.SetCookie(w, c)
+	}
+}
+
+func newSessionCookie(name, value, path string, httpOnly bool, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   GetConfig().CookieDomain,
+		Expires:  expires,
+		Secure:   GetConfig().CookieSecure,
+		HttpOnly: httpOnly,
+		SameSite: GetConfig().CookieSameSite,
+	}
+}
+
+// GetCookieValue returns the value of the named cookie or an empty string
+func GetCookieValue(r *http.Request, name string) string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// GenerateCSRFToken returns a random token for double-submit CSRF protection
+func GenerateCSRFToken() (string, error) {
+	return GenerateRandomToken()
+}
+
+// IsStateChangingMethod checks if the HTTP method is not safe according to RFC 7231, section 4.2.1
+func IsStateChangingMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
+	}
+	return true
+}
+
+// IsValidCSRFRequest checks if the CSRF header matches the CSRF cookie (double-submit cookie pattern)
+func IsValidCSRFRequest(r *http.Request) bool {
+	cookie := GetCookieValue(r, GetConfig().CookieCSRFName)
+	header := r.Header.Get(csrfHeader)
+	if cookie == "" || header == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+// StripSessionCookies removes the access and refresh token cookies from the request before it is proxied
+func StripSessionCookies(r *http.Request) {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	var res []string
+	for _, c := range cookies {
+		if c.Name == GetConfig().CookieAccessTokenName || c.Name == GetConfig().CookieRefreshTokenName {
+			continue
+		}
+		res = append(res, c.Name+"="+c.Value)
+	}
+	r.Header.Del("Cookie")
+	if len(res) > 0 {
+		r.Header.Set("Cookie", strings.Join(res, "; "))
+	}
+}
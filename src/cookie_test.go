@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func setupCookieTest() func() {
+	GetConfig().EnableCookies = true
+	return func() {
+		GetConfig().EnableCookies = false
+	}
+}
+
+func getResponseCookie(res *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range res.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func loginCookieUser(t *testing.T) (*http.Cookie, *http.Cookie, *http.Cookie) {
+	payload := `{"email": "foo@bar.com", "password": "12345678"}`
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var loginResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &loginResponse)
+	checkTestString(t, "", loginResponse.AccessToken)
+	checkTestString(t, "", loginResponse.RefreshToken)
+	accessCookie := getResponseCookie(res, "access_token")
+	refreshCookie := getResponseCookie(res, "refresh_token")
+	csrfCookie := getResponseCookie(res, "csrf_token")
+	if accessCookie == nil || refreshCookie == nil || csrfCookie == nil {
+		t.Fatal("Expected access, refresh and CSRF cookies")
+	}
+	if !accessCookie.HttpOnly || !refreshCookie.HttpOnly || csrfCookie.HttpOnly {
+		t.Fatal("Expected token cookies to be HttpOnly and CSRF cookie to be readable")
+	}
+	if !accessCookie.Secure || accessCookie.SameSite != http.SameSiteStrictMode {
+		t.Fatal("Expected Secure and SameSite=Strict cookies")
+	}
+	checkTestString(t, "/auth/", refreshCookie.Path)
+	return accessCookie, refreshCookie, csrfCookie
+}
+
+func TestCookieLoginPing(t *testing.T) {
+	defer setupCookieTest()()
+	clearTestDB()
+	createTestUser(true)
+	accessCookie, _, _ := loginCookieUser(t)
+
+	req, _ := http.NewRequest("GET", "/auth/ping", nil)
+	req.AddCookie(accessCookie)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+}
+
+func TestCookieCSRFProtection(t *testing.T) {
+	defer setupCookieTest()()
+	clearTestDB()
+	createTestUser(true)
+	accessCookie, _, csrfCookie := loginCookieUser(t)
+
+	// Safe methods don't require a CSRF token
+	req, _ := http.NewRequest("GET", "/some/route/test.html", nil)
+	req.AddCookie(accessCookie)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadGateway, res.Code)
+
+	req, _ = http.NewRequest("POST", "/some/route/test.html", nil)
+	req.AddCookie(accessCookie)
+	req.AddCookie(csrfCookie)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+
+	req, _ = http.NewRequest("POST", "/some/route/test.html", nil)
+	req.AddCookie(accessCookie)
+	req.AddCookie(csrfCookie)
+	req.Header.Set("X-CSRF-Token", "invalid")
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+
+	req, _ = http.NewRequest("POST", "/some/route/test.html", nil)
+	req.AddCookie(accessCookie)
+	req.AddCookie(csrfCookie)
+	req.Header.Set("X-CSRF-Token", csrfCookie.Value)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadGateway, res.Code)
+}
+
+func TestCookieRefreshLogout(t *testing.T) {
+	defer setupCookieTest()()
+	clearTestDB()
+	createTestUser(true)
+	accessCookie, refreshCookie, csrfCookie := loginCookieUser(t)
+
+	req, _ := http.NewRequest("POST", "/auth/refresh", nil)
+	req.AddCookie(accessCookie)
+	req.AddCookie(refreshCookie)
+	req.AddCookie(csrfCookie)
+	req.Header.Set("X-CSRF-Token", csrfCookie.Value)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	newRefreshCookie := getResponseCookie(res, "refresh_token")
+	if newRefreshCookie == nil || newRefreshCookie.Value == refreshCookie.Value {
+		t.Fatal("Expected rotated refresh token cookie")
+	}
+	newCSRFCookie := getResponseCookie(res, "csrf_token")
+
+	req, _ = http.NewRequest("POST", "/auth/logout", nil)
+	req.AddCookie(getResponseCookie(res, "access_token"))
+	req.AddCookie(newRefreshCookie)
+	req.AddCookie(newCSRFCookie)
+	req.Header.Set("X-CSRF-Token", newCSRFCookie.Value)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+	if c := getResponseCookie(res, "access_token"); c == nil || c.MaxAge >= 0 {
+		t.Fatal("Expected access token cookie to be cleared")
+	}
+	if GetRefreshTokenRepository().GetByToken(newRefreshCookie.Value) != nil {
+		t.Fatal("Expected refresh token to be deleted")
+	}
+}
+
+func TestStripSessionCookies(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: "a"})
+	req.AddCookie(&http.Cookie{Name: "lang", Value: "en"})
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: "r"})
+	StripSessionCookies(req)
+	checkTestString(t, "lang=en", req.Header.Get("Cookie"))
+}
@@ -4,8 +4,12 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"io"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func Encrypt(passphrase, s string) (string, error) {
@@ -49,3 +53,39 @@ func Decrypt(passphrase, s string) (string, error) {
 	}
 	return string(res), nil
 }
+
+// GenerateRandomToken returns 256 bits from the CSPRNG, base64url encoded
+func GenerateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a token, so tokens can be looked up without storing them in plain text
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateClientSecret returns a new random client secret and its bcrypt hash
+func GenerateClientSecret() (string, string, error) {
+	secret, err := GenerateRandomToken()
+	if err != nil {
+		return "", "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, string(hash), nil
+}
+
+func CheckClientSecret(hashedSecret, secret string) bool {
+	if hashedSecret == "" || secret == "" {
+		return false
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hashedSecret), []byte(secret))
+	return err == nil
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -61,3 +62,37 @@ func (db *Database) GetIDFilter(id string) primitive.M {
 	objID := db.GetObjectID(id)
 	return bson.M{"_id": objID}
 }
+
+// MigrateTokenHashes replaces the plain text tokens stored by previous versions in the collection's 'token' field
+// with their hashes in the 'tokenHash' field. The unique index on 'token' is dropped, as documents without the field would collide.
+func (db *Database) MigrateTokenHashes(col *mongo.Collection) {
+	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+	// The index might not exist, so errors are ignored
+	col.Indexes().DropOne(ctx, "token_1")
+	cur, err := col.Find(ctx, bson.M{"token": bson.M{"$exists": true}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cur.Close(ctx)
+	count := 0
+	for cur.Next(ctx) {
+		var doc struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Token string             `bson:"token"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			log.Fatal(err)
+		}
+		_, err := col.UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{
+			"$set":   bson.M{"tokenHash": HashToken(doc.Token)},
+			"$unset": bson.M{"token": ""},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		count++
+	}
+	if count > 0 {
+		log.Println("Migrated", count, "plain text tokens in", col.Name(), "to hashes")
+	}
+}
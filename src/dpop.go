@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// dpopHeader is the request header carrying the DPoP proof (RFC 9449, section 4.1)
+const dpopHeader = "DPoP"
+
+// dpopNonceHeader is the response header carrying the server-provided nonce (RFC 9449, section 8)
+const dpopNonceHeader = "DPoP-Nonce"
+
+// ErrDPoPNonceRequired is returned if a DPoP proof lacks a valid server-provided nonce
+var ErrDPoPNonceRequired = errors.New("DPoP proof requires a valid nonce")
+
+// dpopSigningMethods lists the asymmetric algorithms accepted for DPoP proofs
+var dpopSigningMethods = []string{"ES256", "RS256", "PS256", "EdDSA"}
+
+// ConfirmationClaim binds an access token to the key of a DPoP proof (RFC 9449, section 6.1)
+type ConfirmationClaim struct {
+	JWKThumbprint string `json:"jkt"`
+}
+
+// DPoPProofClaims holds the payload of a DPoP proof JWT (RFC 9449, section 4.2)
+type DPoPProofClaims struct {
+	TokenID         string `json:"jti"`
+	HTTPMethod      string `json:"htm"`
+	HTTPURI         string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	Nonce           string `json:"nonce,omitempty"`
+	AccessTokenHash string `json:"ath,omitempty"`
+}
+
+// Valid is called by the JWT parser; the proof's claims are checked by VerifyDPoPProof instead
+func (c *DPoPProofClaims) Valid() error {
+	return nil
+}
+
+// HasDPoPProof checks if the request carries a DPoP header
+func HasDPoPProof(r *http.Request) bool {
+	return len(r.Header[http.CanonicalHeaderKey(dpopHeader)]) > 0
+}
+
+// VerifyDPoPProof validates the request's DPoP proof and returns the JWK thumbprint of the proof's key.
+// If accessToken is not empty, the proof must contain the access token's hash.
+func VerifyDPoPProof(r *http.Request, accessToken string) (string, error) {
+	values := r.Header[http.CanonicalHeaderKey(dpopHeader)]
+	if len(values) != 1 || values[0] == "" {
+		return "", errors.New("exactly one DPoP header required")
+	}
+	var jwk *JWK
+	claims := &DPoPProofClaims{}
+	token, err := jwt.ParseWithClaims(values[0], claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, errors.New("invalid typ header")
+		}
+		if !_IsDPoPSigningMethod(token.Method.Alg()) {
+			return nil, errors.New("unsupported signing method: " + token.Method.Alg())
+		}
+		b, err := json.Marshal(token.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		jwk = &JWK{}
+		if err := json.Unmarshal(b, jwk); err != nil {
+			return nil, errors.New("invalid jwk header")
+		}
+		return jwk.PublicKey()
+	})
+	if err != nil {
+		return "", errors.New("parsing DPoP proof failed with: " + err.Error())
+	}
+	if !token.Valid {
+		return "", errors.New("invalid DPoP proof")
+	}
+	if claims.TokenID == "" {
+		return "", errors.New("missing jti claim")
+	}
+	if claims.HTTPMethod != r.Method {
+		return "", errors.New("htm claim does not match request method")
+	}
+	if !_IsDPoPURIMatch(claims.HTTPURI, GetDPoPRequestURI(r)) {
+		return "", errors.New("htu claim does not match request URI")
+	}
+	maxAge := GetConfig().DPoPProofMaxAge * time.Second
+	iat := time.Unix(claims.IssuedAt, 0)
+	if iat.Before(time.Now().Add(-maxAge)) || iat.After(time.Now().Add(maxAge)) {
+		return "", errors.New("iat claim outside of acceptable window")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		ath := base64.RawURLEncoding.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(ath), []byte(claims.AccessTokenHash)) != 1 {
+			return "", errors.New("ath claim does not match access token")
+		}
+	}
+	if GetConfig().DPoPNonceEnable && !GetDPoPNonceSource().IsValid(claims.Nonce) {
+		return "", ErrDPoPNonceRequired
+	}
+	jkt, err := jwk.Thumbprint()
+	if err != nil {
+		return "", err
+	}
+	if !GetDPoPReplayCache().Add(jkt+":"+claims.TokenID, iat.Add(maxAge)) {
+		return "", errors.New("DPoP proof has already been used")
+	}
+	return jkt, nil
+}
+
+// VerifyDPoPRequest checks that DPoP-bound access tokens are accompanied by a valid DPoP proof for their key
+// and that the DPoP authorization scheme is only used with DPoP-bound access tokens
+func VerifyDPoPRequest(r *http.Request, claims *Claims, accessToken string) error {
+	isDPoPScheme := strings.HasPrefix(r.Header.Get("Authorization"), "DPoP ")
+	if claims.Confirmation == nil {
+		if isDPoPScheme {
+			return errors.New("DPoP authorization scheme requires a DPoP-bound access token")
+		}
+		return nil
+	}
+	if !GetConfig().DPoPEnable {
+		return errors.New("DPoP-bound access tokens are not accepted")
+	}
+	jkt, err := VerifyDPoPProof(r, accessToken)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(jkt), []byte(claims.Confirmation.JWKThumbprint)) != 1 {
+		return errors.New("DPoP proof key does not match access token binding")
+	}
+	return nil
+}
+
+// GetDPoPRequestURI returns the URI a DPoP proof for the request must be issued for, without query and fragment
+func GetDPoPRequestURI(r *http.Request) string {
+	if GetConfig().DPoPPublicURL != "" {
+		return GetConfig().DPoPPublicURL + r.URL.Path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+// SendDPoPError responds with 401 and a WWW-Authenticate challenge for the DPoP scheme (RFC 9449, section 7.1)
+func SendDPoPError(w http.ResponseWriter, err error) {
+	errCode := "invalid_dpop_proof"
+	if err == ErrDPoPNonceRequired {
+		errCode = "use_dpop_nonce"
+		w.Header().Set(dpopNonceHeader, GetDPoPNonceSource().Current())
+	}
+	w.Header().Set("WWW-Authenticate", `DPoP error="`+errCode+`", algs="`+strings.Join(dpopSigningMethods, " ")+`"`)
+	SendUnauthorized(w)
+}
+
+// SendDPoPTokenError responds with an OAuth2 error for invalid DPoP proofs at token endpoints (RFC 9449, section 5)
+func SendDPoPTokenError(w http.ResponseWriter, err error) {
+	if err == ErrDPoPNonceRequired {
+		w.Header().Set(dpopNonceHeader, GetDPoPNonceSource().Current())
+		SendOAuthError(w, http.StatusBadRequest, "use_dpop_nonce")
+		return
+	}
+	SendOAuthError(w, http.StatusBadRequest, "invalid_dpop_proof")
+}
+
+func _IsDPoPSigningMethod(alg string) bool {
+	for _, s := range dpopSigningMethods {
+		if s == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// _IsDPoPURIMatch compares the htu claim to the request URI, ignoring query, fragment and the case of scheme and host
+func _IsDPoPURIMatch(htu, requestURI string) bool {
+	u1, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	u2, err := url.Parse(requestURI)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u1.Scheme, u2.Scheme) && strings.EqualFold(u1.Host, u2.Host) && u1.Path == u2.Path
+}
+
+// DPoPReplayCache remembers the IDs of recently used DPoP proofs, so a proof can't be used twice
+type DPoPReplayCache struct {
+	mutex   sync.Mutex
+	entries map[string]time.Time
+}
+
+var _dpopReplayCacheInstance *DPoPReplayCache
+var _dpopReplayCacheOnce sync.Once
+
+func GetDPoPReplayCache() *DPoPReplayCache {
+	_dpopReplayCacheOnce.Do(func() {
+		_dpopReplayCacheInstance = &DPoPReplayCache{
+			entries: make(map[string]time.Time),
+		}
+	})
+	return _dpopReplayCacheInstance
+}
+
+// Add records the proof ID until expiryDate and returns false if it has been seen before
+func (c *DPoPReplayCache) Add(id string, expiryDate time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[id]; ok && e.After(time.Now()) {
+		return false
+	}
+	c.entries[id] = expiryDate
+	return true
+}
+
+// CleanUp removes the expired entries
+func (c *DPoPReplayCache) CleanUp() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, e := range c.entries {
+		if e.Before(time.Now()) {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// DPoPNonceSource provides server-generated nonces for DPoP proofs.
+// Nonces are rotated after DPoPNonceLifetime; the previous nonce remains valid for another period.
+type DPoPNonceSource struct {
+	mutex      sync.Mutex
+	current    string
+	previous   string
+	rotateDate time.Time
+}
+
+var _dpopNonceSourceInstance *DPoPNonceSource
+var _dpopNonceSourceOnce sync.Once
+
+func GetDPoPNonceSource() *DPoPNonceSource {
+	_dpopNonceSourceOnce.Do(func() {
+		_dpopNonceSourceInstance = &DPoPNonceSource{}
+	})
+	return _dpopNonceSourceInstance
+}
+
+// Current returns the current nonce, rotating it if it is due
+func (s *DPoPNonceSource) Current() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s._RotateIfDue()
+	return s.current
+}
+
+// IsValid checks if the nonce equals the current or the previous nonce
+func (s *DPoPNonceSource) IsValid(nonce string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s._RotateIfDue()
+	if nonce == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(nonce), []byte(s.current)) == 1 ||
+		(s.previous != "" && subtle.ConstantTimeCompare([]byte(nonce), []byte(s.previous)) == 1)
+}
+
+func (s *DPoPNonceSource) _RotateIfDue() {
+	if s.current != "" && time.Now().Before(s.rotateDate) {
+		return
+	}
+	nonce, err := GenerateRandomToken()
+	if err != nil {
+		return
+	}
+	s.previous = s.current
+	s.current = nonce
+	s.rotateDate = time.Now().Add(GetConfig().DPoPNonceLifetime * time.Second)
+}
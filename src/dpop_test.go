@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	guuid "github.com/google/uuid"
+)
+
+const dpopTestHost = "proxy.example.com"
+
+func setupDPoPTest() func() {
+	GetConfig().DPoPEnable = true
+	return func() {
+		GetConfig().DPoPEnable = false
+		GetConfig().DPoPRequired = false
+		GetConfig().DPoPNonceEnable = false
+	}
+}
+
+func createDPoPTestKey() *ecdsa.PrivateKey {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return key
+}
+
+func getDPoPTestThumbprint(key *ecdsa.PrivateKey) string {
+	jwk, _ := NewJWK(&key.PublicKey, "ES256", "")
+	jkt, _ := jwk.Thumbprint()
+	return jkt
+}
+
+func createDPoPProof(key *ecdsa.PrivateKey, method, path, accessToken, nonce string) string {
+	claims := &DPoPProofClaims{
+		TokenID:    guuid.New().String(),
+		HTTPMethod: method,
+		HTTPURI:    "http://" + dpopTestHost + path,
+		IssuedAt:   time.Now().Unix(),
+		Nonce:      nonce,
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims.AccessTokenHash = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	jwk, _ := NewJWK(&key.PublicKey, "ES256", "")
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = jwk
+	s, _ := token.SignedString(key)
+	return s
+}
+
+func newDPoPTestRequest(method, path, accessToken, proof string) *http.Request {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Host = dpopTestHost
+	if accessToken != "" {
+		req.Header.Set("Authorization", "DPoP "+accessToken)
+	}
+	if proof != "" {
+		req.Header.Set("DPoP", proof)
+	}
+	return req
+}
+
+func loginDPoPUser(t *testing.T, key *ecdsa.PrivateKey) *LoginResponse {
+	payload := `{"email": "foo@bar.com", "password": "12345678"}`
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBufferString(payload))
+	req.Host = dpopTestHost
+	req.Header.Set("DPoP", createDPoPProof(key, "POST", "/auth/login", "", ""))
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var loginResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &loginResponse)
+	checkTestString(t, "DPoP", loginResponse.TokenType)
+	return &loginResponse
+}
+
+func TestDPoPLoginBindsTokens(t *testing.T) {
+	defer setupDPoPTest()()
+	clearTestDB()
+	createTestUser(true)
+	key := createDPoPTestKey()
+	loginResponse := loginDPoPUser(t, key)
+
+	claims, err := ParseAccessToken(loginResponse.AccessToken)
+	if err != nil || claims.Confirmation == nil {
+		t.Fatal("Expected access token with cnf claim")
+	}
+	checkTestString(t, getDPoPTestThumbprint(key), claims.Confirmation.JWKThumbprint)
+	refreshToken := GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken)
+	checkTestString(t, getDPoPTestThumbprint(key), refreshToken.JWKThumbprint)
+
+	// Valid proof
+	proof := createDPoPProof(key, "GET", "/auth/ping", loginResponse.AccessToken, "")
+	req := newDPoPTestRequest("GET", "/auth/ping", loginResponse.AccessToken, proof)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	// Replayed proof
+	req = newDPoPTestRequest("GET", "/auth/ping", loginResponse.AccessToken, proof)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+	checkTestString(t, `DPoP error="invalid_dpop_proof", algs="ES256 RS256 PS256 EdDSA"`, res.Header().Get("WWW-Authenticate"))
+
+	// Bound token used as bearer token
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestDPoPInvalidProofs(t *testing.T) {
+	defer setupDPoPTest()()
+	clearTestDB()
+	createTestUser(true)
+	key := createDPoPTestKey()
+	loginResponse := loginDPoPUser(t, key)
+
+	proofs := map[string]string{
+		"wrong method": createDPoPProof(key, "POST", "/auth/ping", loginResponse.AccessToken, ""),
+		"wrong path":   createDPoPProof(key, "GET", "/auth/sessions", loginResponse.AccessToken, ""),
+		"missing ath":  createDPoPProof(key, "GET", "/auth/ping", "", ""),
+		"other key":    createDPoPProof(createDPoPTestKey(), "GET", "/auth/ping", loginResponse.AccessToken, ""),
+		"missing":      "",
+	}
+	for name, proof := range proofs {
+		req := newDPoPTestRequest("GET", "/auth/ping", loginResponse.AccessToken, proof)
+		res := executePublicTestRequest(req)
+		if res.Code != http.StatusUnauthorized {
+			t.Errorf("Expected HTTP Status %d for %s proof, but got %d", http.StatusUnauthorized, name, res.Code)
+		}
+	}
+}
+
+func TestDPoPSchemeWithUnboundToken(t *testing.T) {
+	defer setupDPoPTest()()
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	checkTestString(t, "", loginResponse.TokenType)
+
+	key := createDPoPTestKey()
+	proof := createDPoPProof(key, "GET", "/auth/ping", loginResponse.AccessToken, "")
+	req := newDPoPTestRequest("GET", "/auth/ping", loginResponse.AccessToken, proof)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestDPoPRefresh(t *testing.T) {
+	defer setupDPoPTest()()
+	clearTestDB()
+	createTestUser(true)
+	key := createDPoPTestKey()
+	loginResponse := loginDPoPUser(t, key)
+
+	payload := `{"refreshToken": "` + loginResponse.RefreshToken + `"}`
+	req, _ := http.NewRequest("POST", "/auth/refresh", bytes.NewBufferString(payload))
+	req.Host = dpopTestHost
+	req.Header.Set("Authorization", "DPoP "+loginResponse.AccessToken)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	req, _ = http.NewRequest("POST", "/auth/refresh", bytes.NewBufferString(payload))
+	req.Host = dpopTestHost
+	req.Header.Set("Authorization", "DPoP "+loginResponse.AccessToken)
+	req.Header.Set("DPoP", createDPoPProof(key, "POST", "/auth/refresh", loginResponse.AccessToken, ""))
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var refreshResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &refreshResponse)
+	checkTestString(t, "DPoP", refreshResponse.TokenType)
+	claims, err := ParseAccessToken(refreshResponse.AccessToken)
+	if err != nil || claims.Confirmation == nil {
+		t.Fatal("Expected refreshed access token with cnf claim")
+	}
+	checkTestString(t, getDPoPTestThumbprint(key), claims.Confirmation.JWKThumbprint)
+}
+
+func TestDPoPRequired(t *testing.T) {
+	defer setupDPoPTest()()
+	GetConfig().DPoPRequired = true
+	clearTestDB()
+	createTestUser(true)
+
+	payload := `{"email": "foo@bar.com", "password": "12345678"}`
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadRequest, res.Code)
+	var oauthError OAuthError
+	json.Unmarshal(res.Body.Bytes(), &oauthError)
+	checkTestString(t, "invalid_dpop_proof", oauthError.Error)
+
+	loginDPoPUser(t, createDPoPTestKey())
+}
+
+func TestDPoPNonce(t *testing.T) {
+	defer setupDPoPTest()()
+	GetConfig().DPoPNonceEnable = true
+	clearTestDB()
+	createTestUser(true)
+	key := createDPoPTestKey()
+
+	payload := `{"email": "foo@bar.com", "password": "12345678"}`
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBufferString(payload))
+	req.Host = dpopTestHost
+	req.Header.Set("DPoP", createDPoPProof(key, "POST", "/auth/login", "", ""))
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadRequest, res.Code)
+	var oauthError OAuthError
+	json.Unmarshal(res.Body.Bytes(), &oauthError)
+	checkTestString(t, "use_dpop_nonce", oauthError.Error)
+	nonce := res.Header().Get("DPoP-Nonce")
+	checkStringNotEmpty(t, nonce)
+
+	req, _ = http.NewRequest("POST", "/auth/login", bytes.NewBufferString(payload))
+	req.Host = dpopTestHost
+	req.Header.Set("DPoP", createDPoPProof(key, "POST", "/auth/login", "", nonce))
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var loginResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &loginResponse)
+
+	req = newDPoPTestRequest("GET", "/auth/ping", loginResponse.AccessToken, createDPoPProof(key, "GET", "/auth/ping", loginResponse.AccessToken, "invalid"))
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+	checkTestString(t, nonce, res.Header().Get("DPoP-Nonce"))
+}
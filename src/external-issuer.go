@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// externalJWKSMinRefetch is the minimum interval between two JWKS requests to the same issuer
+const externalJWKSMinRefetch = time.Minute
+
+// externalJWKSMaxSize is the maximum size in bytes of a JWKS document
+const externalJWKSMaxSize = 1 << 20
+
+// externalAlgorithms lists the signing algorithms accepted for external access tokens
+var externalAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "EdDSA"}
+
+var externalHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// ExternalIssuer is an identity provider whose access tokens are accepted for proxied requests.
+// The token's subject is mapped to a local user, which can be created on first use.
+type ExternalIssuer struct {
+	Issuer        string   `json:"issuer"`
+	JWKSURL       string   `json:"jwksUrl"`
+	Keys          []*JWK   `json:"keys"`
+	Audience      []string `json:"audience"`
+	Algorithms    []string `json:"algorithms"`
+	SubjectClaim  string   `json:"subjectClaim"`
+	EmailClaim    string   `json:"emailClaim"`
+	LinkByEmail   bool     `json:"linkByEmail"`
+	AutoProvision bool     `json:"autoProvision"`
+	TrustAuthTime bool     `json:"trustAuthTime"`
+
+	mutex       sync.RWMutex
+	fetchMutex  sync.Mutex
+	jwks        []*JWK
+	fetchDate   time.Time
+	attemptDate time.Time
+	users       map[string]*externalUserCacheEntry
+}
+
+// ExternalIdentity links a local user to the subject of an external issuer
+type ExternalIdentity struct {
+	Issuer  string `json:"issuer" bson:"issuer"`
+	Subject string `json:"subject" bson:"subject"`
+}
+
+type externalUserCacheEntry struct {
+	UserID     string
+	Email      string
+	Roles      []string
+	Groups     []string
+	Scope      string
+	ExpiryDate time.Time
+}
+
+// LoadExternalIssuers reads the JSON array of external issuers from a file
+func LoadExternalIssuers(fileName string) ([]*ExternalIssuer, error) {
+	res := make([]*ExternalIssuer, 0)
+	if fileName == "" {
+		return res, nil
+	}
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, errors.New("Invalid external issuers file: " + err.Error())
+	}
+	issuers := make(map[string]bool)
+	for _, iss := range res {
+		if err := iss.Validate(); err != nil {
+			return nil, err
+		}
+		if issuers[iss.Issuer] {
+			return nil, errors.New("Duplicate external issuer: " + iss.Issuer)
+		}
+		issuers[iss.Issuer] = true
+	}
+	return res, nil
+}
+
+// Validate checks the issuer's settings and applies the defaults
+func (iss *ExternalIssuer) Validate() error {
+	if iss.Issuer == "" {
+		return errors.New("External issuer requires 'issuer'")
+	}
+	if iss.JWKSURL == "" && len(iss.Keys) == 0 {
+		return errors.New("External issuer requires 'jwksUrl' or 'keys': " + iss.Issuer)
+	}
+	if iss.JWKSURL != "" && !strings.HasPrefix(iss.JWKSURL, "https://") && !strings.HasPrefix(iss.JWKSURL, "http://") {
+		return errors.New("Invalid JWKS URL for external issuer: " + iss.Issuer)
+	}
+	for _, jwk := range iss.Keys {
+		if _, err := jwk.PublicKey(); err != nil {
+			return fmt.Errorf("Invalid key for external issuer %s: %v", iss.Issuer, err)
+		}
+	}
+	if len(iss.Audience) == 0 {
+		return errors.New("External issuer requires 'audience': " + iss.Issuer)
+	}
+	if len(iss.Algorithms) == 0 {
+		iss.Algorithms = externalAlgorithms
+	}
+	for _, alg := range iss.Algorithms {
+		if !iss._IsSupportedAlgorithm(alg) {
+			return errors.New("Unsupported algorithm for external issuer " + iss.Issuer + ": " + alg)
+		}
+	}
+	if iss.SubjectClaim == "" {
+		iss.SubjectClaim = "sub"
+	}
+	if iss.EmailClaim == "" {
+		iss.EmailClaim = "email"
+	}
+	iss.users = make(map[string]*externalUserCacheEntry)
+	return nil
+}
+
+// GetExternalIssuer returns the configured external issuer named in the token's unverified 'iss' claim, or nil
+func GetExternalIssuer(tokenString string) *ExternalIssuer {
+	if len(GetConfig().ExternalIssuers) == 0 || IsReferenceToken(tokenString) {
+		return nil
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims); err != nil {
+		return nil
+	}
+	issuer, _ := claims["iss"].(string)
+	if issuer == "" || issuer == GetConfig().JwtIssuer {
+		return nil
+	}
+	for _, iss := range GetConfig().ExternalIssuers {
+		if iss.Issuer == issuer {
+			return iss
+		}
+	}
+	return nil
+}
+
+// IsExternalToken checks if the claims belong to an access token of an external issuer
+func IsExternalToken(claims *Claims) bool {
+	return claims.Issuer != GetConfig().JwtIssuer
+}
+
+// ParseToken verifies the signature, expiry, issuer and audience of an external access token
+// and returns its claims, with UserID, Email, roles, groups and scopes set to those of the mapped local user
+func (iss *ExternalIssuer) ParseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	parser := &jwt.Parser{ValidMethods: iss.Algorithms}
+	token, err := parser.ParseWithClaims(tokenString, claims, iss._KeyFunc)
+	if err != nil {
+		return nil, errors.New("parsing external JWT failed with: " + err.Error())
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid external JWT")
+	}
+	if claims.Issuer != iss.Issuer {
+		return nil, fmt.Errorf("invalid issuer: %v", claims.Issuer)
+	}
+	if !claims.Audience.ContainsAny(iss.Audience) {
+		return nil, errors.New("invalid audience")
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("missing expiry claim")
+	}
+	user, err := iss._ResolveUser(claims)
+	if err != nil {
+		return nil, err
+	}
+	// Claims with a meaning specific to tokens issued by the proxy are discarded
+	claims.UserID = user.UserID
+	claims.Email = user.Email
+	claims.Roles = user.Roles
+	claims.Groups = user.Groups
+	claims.Scope = user.Scope
+	claims.ClientID = ""
+	claims.Actor = nil
+	claims.SessionID = ""
+	claims.TokenVersion = 0
+	if !iss.TrustAuthTime {
+		// Step-up routes can only be satisfied by the issuer's authentication time if it is trusted
+		claims.AuthTime = 0
+		claims.AuthMethods = nil
+		claims.AuthContext = ""
+	}
+	if GetRevokedTokenRepository().IsRevoked(claims) {
+		return nil, errors.New("token has been revoked")
+	}
+	return claims, nil
+}
+
+func (iss *ExternalIssuer) _KeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	alg := token.Method.Alg()
+	jwk := iss._FindKey(kid, alg)
+	if jwk == nil && iss.JWKSURL != "" {
+		// The issuer may have rotated its keys
+		iss.RefreshKeys(true)
+		jwk = iss._FindKey(kid, alg)
+	}
+	if jwk == nil {
+		return nil, fmt.Errorf("Unknown key ID: %v", kid)
+	}
+	publicKey, err := jwk.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	var matches bool
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		matches = strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		matches = alg == jwt.SigningMethodES256.Alg()
+	case ed25519.PublicKey:
+		matches = alg == SigningMethodEdDSA.Alg()
+	}
+	if !matches {
+		return nil, fmt.Errorf("Unexpected signing method: %v", alg)
+	}
+	return publicKey, nil
+}
+
+// _FindKey returns the signing key with the given key ID, or the only signing key if the token has no key ID
+func (iss *ExternalIssuer) _FindKey(kid, alg string) *JWK {
+	if iss.JWKSURL != "" {
+		iss.RefreshKeys(false)
+	}
+	iss.mutex.RLock()
+	defer iss.mutex.RUnlock()
+	candidates := make([]*JWK, 0)
+	for _, jwk := range append(append([]*JWK{}, iss.Keys...), iss.jwks...) {
+		if (jwk.Use != "" && jwk.Use != "sig") || (jwk.Algorithm != "" && jwk.Algorithm != alg) {
+			continue
+		}
+		if kid != "" && jwk.KeyID == kid {
+			return jwk
+		}
+		candidates = append(candidates, jwk)
+	}
+	if kid == "" && len(candidates) == 1 {
+		return candidates[0]
+	}
+	return nil
+}
+
+// RefreshKeys fetches the issuer's JWKS if the cached keys are older than EXTERNAL_JWKS_REFRESH_INTERVAL or if forced.
+// Failed requests keep the cached keys. Requests are sent at most once per minute.
+func (iss *ExternalIssuer) RefreshKeys(force bool) {
+	if !iss._IsFetchDue(force) {
+		return
+	}
+	iss.fetchMutex.Lock()
+	defer iss.fetchMutex.Unlock()
+	// Another request may have fetched the keys in the meantime
+	if !iss._IsFetchDue(force) {
+		return
+	}
+	now := time.Now()
+	iss.mutex.Lock()
+	iss.attemptDate = now
+	iss.mutex.Unlock()
+	keys, err := iss._FetchJWKS()
+	if err != nil {
+		log.Println("Could not fetch JWKS of external issuer", iss.Issuer, ":", err)
+		return
+	}
+	iss.mutex.Lock()
+	iss.jwks = keys
+	iss.fetchDate = now
+	iss.mutex.Unlock()
+}
+
+func (iss *ExternalIssuer) _IsFetchDue(force bool) bool {
+	iss.mutex.RLock()
+	defer iss.mutex.RUnlock()
+	now := time.Now()
+	if iss.attemptDate.Add(externalJWKSMinRefetch).After(now) {
+		return false
+	}
+	return force || iss.fetchDate.Add(GetConfig().ExternalJWKSRefresh*time.Minute).Before(now)
+}
+
+func (iss *ExternalIssuer) _FetchJWKS() ([]*JWK, error) {
+	res, err := externalHTTPClient.Get(iss.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	var set JWKSet
+	if err := json.NewDecoder(io.LimitReader(res.Body, externalJWKSMaxSize)).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make([]*JWK, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		// Skip keys of unsupported types, so a single unknown key doesn't invalidate the whole set
+		if _, err := jwk.PublicKey(); err == nil {
+			keys = append(keys, jwk)
+		}
+	}
+	return keys, nil
+}
+
+// _ResolveUser returns the local user linked to the token's subject.
+// Unlinked users are linked by email address or created, if allowed for the issuer.
+func (iss *ExternalIssuer) _ResolveUser(claims *Claims) (*externalUserCacheEntry, error) {
+	subject := iss._GetClaim(claims, iss.SubjectClaim)
+	if subject == "" {
+		return nil, errors.New("missing subject claim: " + iss.SubjectClaim)
+	}
+	iss.mutex.RLock()
+	e, ok := iss.users[subject]
+	iss.mutex.RUnlock()
+	if ok && e.ExpiryDate.After(time.Now()) {
+		return e, nil
+	}
+	user := GetUserRepository().GetByExternalIdentity(iss.Issuer, subject)
+	identity := ExternalIdentity{Issuer: iss.Issuer, Subject: subject}
+	email := iss._GetClaim(claims, iss.EmailClaim)
+	// Only addresses verified by the issuer may be linked to existing users or provisioned as confirmed
+	emailVerified, _ := claims.Custom["email_verified"].(bool)
+	if user == nil && email != "" && emailVerified {
+		if existing := GetUserRepository().GetByEmail(email); existing != nil {
+			if !iss.LinkByEmail {
+				return nil, errors.New("email address of external user is already registered: " + email)
+			}
+			log.Println("Linking UserID", existing.ID.Hex(), "to subject", subject, "of external issuer", iss.Issuer)
+			GetUserRepository().AddExternalIdentity(existing, identity)
+			user = existing
+		} else if iss.AutoProvision {
+			user = &User{
+				Email:      email,
+				Confirmed:  true,
+				Enabled:    true,
+				Identities: []ExternalIdentity{identity},
+				CreateDate: time.Now(),
+			}
+			GetUserRepository().Create(user)
+			log.Println("Provisioned UserID", user.ID.Hex(), "for subject", subject, "of external issuer", iss.Issuer)
+		}
+	}
+	if user == nil {
+		return nil, errors.New("no user linked to external subject: " + subject)
+	}
+	if !user.Enabled {
+		return nil, errors.New("user is disabled")
+	}
+	e = &externalUserCacheEntry{
+		UserID:     user.ID.Hex(),
+		Email:      user.Email,
+		Roles:      user.Roles,
+		Groups:     user.Groups,
+		Scope:      strings.Join(GetUserScopes(user), " "),
+		ExpiryDate: time.Now().Add(GetConfig().TokenVersionCacheTTL * time.Second),
+	}
+	iss.mutex.Lock()
+	iss.users[subject] = e
+	iss.mutex.Unlock()
+	return e, nil
+}
+
+// _GetClaim returns the string value of a claim
+func (iss *ExternalIssuer) _GetClaim(claims *Claims, name string) string {
+	switch name {
+	case "sub":
+		return claims.Subject
+	case "email":
+		return claims.Email
+	}
+	s, _ := claims.Custom[name].(string)
+	return s
+}
+
+func (iss *ExternalIssuer) _IsSupportedAlgorithm(alg string) bool {
+	for _, s := range externalAlgorithms {
+		if s == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanUp removes the expired user cache entries
+func (iss *ExternalIssuer) CleanUp() {
+	iss.mutex.Lock()
+	defer iss.mutex.Unlock()
+	for subject, e := range iss.users {
+		if e.ExpiryDate.Before(time.Now()) {
+			delete(iss.users, subject)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const externalTestIssuer = "https://idp.example.com"
+
+func setupExternalIssuerTest(t *testing.T, iss *ExternalIssuer) func() {
+	if err := iss.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	GetConfig().ExternalIssuers = []*ExternalIssuer{iss}
+	return func() {
+		GetConfig().ExternalIssuers = make([]*ExternalIssuer, 0)
+	}
+}
+
+func newExternalTestIssuer(t *testing.T, key *SigningKey) *ExternalIssuer {
+	jwk, err := key.JWK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ExternalIssuer{
+		Issuer:   externalTestIssuer,
+		Keys:     []*JWK{jwk},
+		Audience: []string{"proxy-app"},
+	}
+}
+
+func newExternalTestClaims(audience, subject, email string, lifetime time.Duration) *Claims {
+	now := time.Now()
+	return &Claims{
+		Email:    email,
+		Audience: Audience{audience},
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    externalTestIssuer,
+			Subject:   subject,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(lifetime).Unix(),
+		},
+		Custom: map[string]interface{}{"email_verified": true},
+	}
+}
+
+func newExternalTestToken(key *SigningKey, audience, subject, email string, lifetime time.Duration) string {
+	token, _ := key.SignedString(newExternalTestClaims(audience, subject, email, lifetime))
+	return token
+}
+
+func TestLoadExternalIssuers(t *testing.T) {
+	key, _ := NewSigningKey("ES256")
+	jwk, _ := key.JWK()
+	b, _ := json.Marshal(jwk)
+	file, _ := ioutil.TempFile("", "issuers*.json")
+	defer os.Remove(file.Name())
+	file.WriteString(`[{"issuer": "` + externalTestIssuer + `", "keys": [` + string(b) + `], "audience": ["proxy-app"]}]`)
+	file.Close()
+
+	issuers, err := LoadExternalIssuers(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issuers) != 1 {
+		t.Fatalf("Expected 1 issuer, got %d", len(issuers))
+	}
+	checkTestString(t, "sub", issuers[0].SubjectClaim)
+	checkTestString(t, "email", issuers[0].EmailClaim)
+
+	invalid := []*ExternalIssuer{
+		{Keys: []*JWK{jwk}, Audience: []string{"proxy-app"}},
+		{Issuer: externalTestIssuer, Audience: []string{"proxy-app"}},
+		{Issuer: externalTestIssuer, Keys: []*JWK{jwk}},
+		{Issuer: externalTestIssuer, Keys: []*JWK{jwk}, Audience: []string{"proxy-app"}, Algorithms: []string{"HS512"}},
+		{Issuer: externalTestIssuer, JWKSURL: "ftp://idp.example.com/jwks.json", Audience: []string{"proxy-app"}},
+	}
+	for i, iss := range invalid {
+		if err := iss.Validate(); err == nil {
+			t.Errorf("Expected error for external issuer #%d", i)
+		}
+	}
+}
+
+func TestExternalIssuerAutoProvision(t *testing.T) {
+	key, _ := NewSigningKey("ES256")
+	iss := newExternalTestIssuer(t, key)
+	iss.AutoProvision = true
+	defer setupExternalIssuerTest(t, iss)()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	token := newExternalTestToken(key, "proxy-app", "idp-user-1", "external@bar.com", 5*time.Minute)
+	req := newHTTPRequest("GET", "/some/route/test.html", token, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+
+	user := GetUserRepository().GetByExternalIdentity(externalTestIssuer, "idp-user-1")
+	if user == nil {
+		t.Fatal("Expected external user to be provisioned")
+	}
+	checkTestString(t, "external@bar.com", user.Email)
+	checkTestString(t, user.ID.Hex(), handler.Headers.Get("X-Auth-UserID"))
+	checkTestString(t, "Bearer "+token, handler.Headers.Get("Authorization"))
+
+	// The same user is used for subsequent requests
+	req = newHTTPRequest("GET", "/some/route/test.html", token, nil)
+	res = executePublicTestRequest(req)
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	checkTestString(t, user.ID.Hex(), handler.Headers.Get("X-Auth-UserID"))
+
+	// External tokens are not accepted for the public API
+	req = newHTTPRequest("GET", "/auth/ping", token, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestExternalIssuerLinkByEmail(t *testing.T) {
+	key, _ := NewSigningKey("EdDSA")
+	iss := newExternalTestIssuer(t, key)
+	defer setupExternalIssuerTest(t, iss)()
+	clearTestDB()
+	user := createTestUser(true)
+	token := newExternalTestToken(key, "proxy-app", "idp-user-1", "foo@bar.com", 5*time.Minute)
+
+	if _, err := ResolveAccessToken(token); err == nil {
+		t.Fatal("Expected error for email address registered by local user")
+	}
+
+	iss.LinkByEmail = true
+
+	// Unverified email addresses are not linked
+	unverifiedClaims := newExternalTestClaims("proxy-app", "idp-user-1", "foo@bar.com", 5*time.Minute)
+	for _, verified := range []interface{}{nil, false, "true"} {
+		unverifiedClaims.Custom["email_verified"] = verified
+		unverified, _ := key.SignedString(unverifiedClaims)
+		if _, err := ResolveAccessToken(unverified); err == nil {
+			t.Errorf("Expected error for email_verified claim %v", verified)
+		}
+	}
+
+	claims, err := ResolveAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, user.ID.Hex(), claims.UserID)
+	checkTestString(t, "idp-user-1", claims.Subject)
+	linked := GetUserRepository().GetByExternalIdentity(externalTestIssuer, "idp-user-1")
+	if linked == nil || linked.ID != user.ID {
+		t.Fatal("Expected external identity to be linked to existing user")
+	}
+
+	// Scopes of the external issuer don't apply
+	scopedClaims := newExternalTestClaims("proxy-app", "idp-user-1", "foo@bar.com", 5*time.Minute)
+	scopedClaims.Scope = "billing.write"
+	scoped, _ := key.SignedString(scopedClaims)
+	claims, err = ResolveAccessToken(scoped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, strings.Join(GetUserScopes(user), " "), claims.Scope)
+
+	// The issuer's authentication time is only used if trusted
+	scopedClaims.AuthTime = time.Now().Unix()
+	scopedClaims.AuthMethods = []string{"pwd", "otp", "mfa"}
+	scoped, _ = key.SignedString(scopedClaims)
+	claims, _ = ResolveAccessToken(scoped)
+	checkTestInt(t, 0, int(claims.AuthTime))
+	checkTestInt(t, 0, len(claims.AuthMethods))
+	iss.TrustAuthTime = true
+	claims, _ = ResolveAccessToken(scoped)
+	checkTestInt(t, int(scopedClaims.AuthTime), int(claims.AuthTime))
+	checkTestInt(t, 3, len(claims.AuthMethods))
+}
+
+func TestExternalIssuerInvalidTokens(t *testing.T) {
+	key, _ := NewSigningKey("ES256")
+	otherKey, _ := NewSigningKey("ES256")
+	iss := newExternalTestIssuer(t, key)
+	defer setupExternalIssuerTest(t, iss)()
+	clearTestDB()
+
+	tokens := []string{
+		newExternalTestToken(key, "other-app", "idp-user-1", "external@bar.com", 5*time.Minute),
+		newExternalTestToken(key, "proxy-app", "idp-user-1", "external@bar.com", -5*time.Minute),
+		newExternalTestToken(otherKey, "proxy-app", "idp-user-1", "external@bar.com", 5*time.Minute),
+		// Unknown users are rejected without auto-provisioning
+		newExternalTestToken(key, "proxy-app", "idp-user-1", "external@bar.com", 5*time.Minute),
+	}
+	for i, token := range tokens {
+		if _, err := ResolveAccessToken(token); err == nil {
+			t.Errorf("Expected error for external token #%d", i)
+		}
+	}
+}
+
+func TestExternalIssuerJWKS(t *testing.T) {
+	key, _ := NewSigningKey("RS256")
+	jwk, _ := key.JWK()
+	jwks := &JWKSet{Keys: []*JWK{jwk}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+	iss := &ExternalIssuer{
+		Issuer:        externalTestIssuer,
+		JWKSURL:       server.URL,
+		Audience:      []string{"proxy-app"},
+		AutoProvision: true,
+	}
+	defer setupExternalIssuerTest(t, iss)()
+	clearTestDB()
+
+	token := newExternalTestToken(key, "proxy-app", "idp-user-1", "external@bar.com", 5*time.Minute)
+	if _, err := ResolveAccessToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens signed with a rotated key trigger a new JWKS request
+	newKey, _ := NewSigningKey("RS256")
+	newJWK, _ := newKey.JWK()
+	jwks.Keys = []*JWK{newJWK}
+	token = newExternalTestToken(newKey, "proxy-app", "idp-user-1", "external@bar.com", 5*time.Minute)
+	if _, err := ResolveAccessToken(token); err == nil {
+		t.Fatal("Expected JWKS requests to be throttled")
+	}
+	iss.attemptDate = time.Time{}
+	if _, err := ResolveAccessToken(token); err != nil {
+		t.Fatal(err)
+	}
+}
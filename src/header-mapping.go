@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// HeaderMapping forwards a token claim or user attribute to the upstream in a request header
+type HeaderMapping struct {
+	Source string
+	Header string
+}
+
+// reservedHeaders holds the headers set by the proxy itself which can't be used by a header mapping
+var reservedHeaders = []string{"Authorization", "Cookie", "Host", "Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto",
+	"X-Auth-UserID", "X-Auth-ClientID", "Signature", "Signature-Input", "DPoP"}
+
+var headerNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9\-]*$`)
+
+// ParseHeaderMappings parses a comma-separated list of 'source:header' pairs, e.g. 'email:X-Auth-Email,user.data.department:X-Auth-Department'.
+// Sources are claim names (or paths within claims) of the access token; sources prefixed with 'user.' refer to the user's attributes.
+func ParseHeaderMappings(s string) ([]*HeaderMapping, error) {
+	res := make([]*HeaderMapping, 0)
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	headers := make(map[string]bool)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid header mapping: " + pair)
+		}
+		m := &HeaderMapping{
+			Source: strings.TrimSpace(parts[0]),
+			Header: http.CanonicalHeaderKey(strings.TrimSpace(parts[1])),
+		}
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+		if headers[m.Header] {
+			return nil, errors.New("Duplicate header in header mapping: " + m.Header)
+		}
+		headers[m.Header] = true
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+func (m *HeaderMapping) Validate() error {
+	if !headerNameRegexp.MatchString(m.Header) {
+		return errors.New("Invalid header name in header mapping: " + m.Header)
+	}
+	for _, reserved := range reservedHeaders {
+		if strings.EqualFold(m.Header, reserved) {
+			return errors.New("Header can't be set by header mapping: " + m.Header)
+		}
+	}
+	if m.IsUserSource() {
+		if !IsValidUserSource(m._UserSource()) {
+			return errors.New("Invalid user source in header mapping: " + m.Source)
+		}
+		return nil
+	}
+	if m.Source == "" || strings.Contains(m.Source, "..") || strings.HasPrefix(m.Source, ".") || strings.HasSuffix(m.Source, ".") {
+		return errors.New("Invalid claim source in header mapping: " + m.Source)
+	}
+	return nil
+}
+
+// IsUserSource checks if the mapping's source is a user attribute rather than a token claim
+func (m *HeaderMapping) IsUserSource() bool {
+	return strings.HasPrefix(m.Source, "user.")
+}
+
+func (m *HeaderMapping) _UserSource() string {
+	return strings.TrimPrefix(m.Source, "user.")
+}
+
+// Resolve returns the value of the mapping's source from the claims or the user (which may be nil), or nil if it is not set
+func (m *HeaderMapping) Resolve(claims map[string]interface{}, user *User) interface{} {
+	if m.IsUserSource() {
+		if user == nil {
+			return nil
+		}
+		return (&ClaimMapping{Source: m._UserSource()}).Resolve(user)
+	}
+	var value interface{} = claims
+	for _, key := range strings.Split(m.Source, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[key]
+	}
+	return value
+}
+
+// StripMappedHeaders removes all client-supplied headers a header mapping is configured for
+func StripMappedHeaders(r *http.Request) {
+	for _, m := range GetConfig().HeaderMappings {
+		r.Header.Del(m.Header)
+	}
+}
+
+// SetMappedHeaders sets the headers of the configured header mappings from the claims of the request's access token.
+// The user is only loaded if a mapping refers to a user attribute.
+func SetMappedHeaders(r *http.Request, claims *Claims) {
+	if claims == nil || len(GetConfig().HeaderMappings) == 0 {
+		return
+	}
+	claimsMap := ClaimsToMap(claims)
+	var user *User
+	for _, m := range GetConfig().HeaderMappings {
+		if m.IsUserSource() && user == nil && claims.UserID != "" {
+			user = GetUserRepository().GetOne(claims.UserID)
+		}
+		value := m.Resolve(claimsMap, user)
+		if value == nil {
+			continue
+		}
+		r.Header.Set(m.Header, FormatHeaderValue(value))
+	}
+}
+
+// ClaimsToMap returns the JSON representation of the claims (including custom claims) as a map
+func ClaimsToMap(claims *Claims) map[string]interface{} {
+	var res map[string]interface{}
+	if b, err := json.Marshal(claims); err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		decoder.Decode(&res)
+	}
+	return res
+}
+
+// FormatHeaderValue converts a claim value into a header value.
+// Lists of scalars are joined by commas, objects are JSON encoded. Control characters are removed.
+func FormatHeaderValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				b, _ := json.Marshal(v)
+				return FormatHeaderValue(string(b))
+			}
+			items = append(items, FormatHeaderValue(item))
+		}
+		s = strings.Join(items, ",")
+	case map[string]interface{}:
+		b, _ := json.Marshal(v)
+		s = string(b)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		s = fmt.Sprint(v)
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
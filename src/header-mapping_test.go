@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestParseHeaderMappings(t *testing.T) {
+	mappings, err := ParseHeaderMappings("email:x-auth-email, user.data.department:X-Auth-Department")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 2 {
+		t.Fatalf("Expected 2 mappings, got %d", len(mappings))
+	}
+	checkTestString(t, "email", mappings[0].Source)
+	checkTestString(t, "X-Auth-Email", mappings[0].Header)
+	if !mappings[1].IsUserSource() {
+		t.Fatal("Expected user source")
+	}
+
+	for _, s := range []string{"email", "email:Authorization", "email:x-auth-userid", "user.password:X-Pw", "a..b:X-A", "email:X-A,sub:x-a", "email:X A"} {
+		if _, err := ParseHeaderMappings(s); err == nil {
+			t.Errorf("Expected error for header mapping '%s'", s)
+		}
+	}
+}
+
+func TestFormatHeaderValue(t *testing.T) {
+	checkTestString(t, "admin,user", FormatHeaderValue([]interface{}{"admin", "user"}))
+	checkTestString(t, "true", FormatHeaderValue(true))
+	checkTestString(t, "1600000000", FormatHeaderValue(float64(1600000000)))
+	checkTestString(t, `{"tier":"pro"}`, FormatHeaderValue(map[string]interface{}{"tier": "pro"}))
+	checkTestString(t, "foo", FormatHeaderValue("f\r\noo"))
+}
+
+func TestProxyHeaderMapping(t *testing.T) {
+	os.Setenv("PROXY_HEADER_MAPPING", "email:X-Auth-Email,roles:X-Auth-Roles,user.data.department:X-Auth-Department,iat:X-Auth-IssuedAt")
+	GetConfig().ReadConfig()
+	defer func() {
+		os.Setenv("PROXY_HEADER_MAPPING", "")
+		GetConfig().ReadConfig()
+	}()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	user := createTestUser(true)
+	GetUserRepository().AddRole(user, "admin")
+	GetUserRepository().AddRole(user, "user")
+	payload := `{"department": "Sales"}`
+	req, _ := http.NewRequest("PUT", "/users/"+user.ID.Hex()+"/data", bytes.NewBufferString(payload))
+	executeBackendTestRequest(req)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	req = newHTTPRequest("GET", "/some/route/test.html", loginResponse.AccessToken, nil)
+	req.Header.Set("X-Auth-Email", "evil@bar.com")
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	checkTestString(t, "foo@bar.com", handler.Headers.Get("X-Auth-Email"))
+	checkTestString(t, "admin,user", handler.Headers.Get("X-Auth-Roles"))
+	checkTestString(t, "Sales", handler.Headers.Get("X-Auth-Department"))
+	checkStringNotEmpty(t, handler.Headers.Get("X-Auth-IssuedAt"))
+
+	// Client-supplied headers are stripped from unauthenticated requests
+	req = newHTTPRequest("GET", "/some/whitelist/test.html", "", nil)
+	req.Header.Set("X-Auth-Email", "evil@bar.com")
+	res = executePublicTestRequest(req)
+
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	checkTestString(t, "", handler.Headers.Get("X-Auth-Email"))
+}
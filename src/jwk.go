@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// JWK holds a public JSON Web Key (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKSet holds a JSON Web Key Set
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+func NewJWK(publicKey interface{}, alg, kid string) (*JWK, error) {
+	enc := base64.RawURLEncoding
+	jwk := &JWK{
+		Use:       "sig",
+		Algorithm: alg,
+		KeyID:     kid,
+	}
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = enc.EncodeToString(key.N.Bytes())
+		jwk.E = enc.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported elliptic curve")
+		}
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = enc.EncodeToString(jwk._PadCoordinate(key.X.Bytes(), 32))
+		jwk.Y = enc.EncodeToString(jwk._PadCoordinate(key.Y.Bytes(), 32))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = enc.EncodeToString(key)
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+	return jwk, nil
+}
+
+// PublicKey converts the JWK to a *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+func (jwk *JWK) PublicKey() (interface{}, error) {
+	dec := base64.RawURLEncoding
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := dec.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, errors.New("unsupported elliptic curve: " + jwk.Curve)
+		}
+		x, err := dec.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid elliptic curve point")
+		}
+		return key, nil
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, errors.New("unsupported curve: " + jwk.Curve)
+		}
+		x, err := dec.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported key type: " + jwk.KeyType)
+}
+
+// Thumbprint returns the base64url encoded SHA-256 JWK Thumbprint (RFC 7638)
+func (jwk *JWK) Thumbprint() (string, error) {
+	var s string
+	switch jwk.KeyType {
+	case "RSA":
+		s = `{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`
+	case "EC":
+		s = `{"crv":"` + jwk.Curve + `","kty":"EC","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`
+	case "OKP":
+		s = `{"crv":"` + jwk.Curve + `","kty":"OKP","x":"` + jwk.X + `"}`
+	default:
+		return "", errors.New("unsupported key type: " + jwk.KeyType)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func (jwk *JWK) _PadCoordinate(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	res := make([]byte, size)
+	copy(res[size-len(b):], b)
+	return res
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/ed25519"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEd25519 implements the EdDSA signing method (RFC 8037) using Ed25519 keys.
+// It expects ed25519.PrivateKey for signing and ed25519.PublicKey for verification.
+type SigningMethodEd25519 struct{}
+
+var SigningMethodEdDSA *SigningMethodEd25519
+
+func init() {
+	SigningMethodEdDSA = &SigningMethodEd25519{}
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *SigningMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *SigningMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *SigningMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	sig := ed25519.Sign(privateKey, []byte(signingString))
+	return jwt.EncodeSegment(sig), nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Keyring holds the active JWT signing key and a number of retired keys still accepted for verification.
+// If JWT_KEY_ENCRYPT_KEY is set, the keys are stored encrypted in MongoDB so that all replicas share them.
+type Keyring struct {
+	mutex      sync.RWMutex
+	entries    []*keyringEntry
+	persistent bool
+	lastReload time.Time
+}
+
+type keyringEntry struct {
+	Key        *SigningKey
+	Active     bool
+	CreateDate time.Time
+}
+
+var _keyringInstance *Keyring
+var _keyringOnce sync.Once
+
+func GetKeyring() *Keyring {
+	_keyringOnce.Do(func() {
+		_keyringInstance = &Keyring{}
+	})
+	return _keyringInstance
+}
+
+// Load initializes the keyring on startup
+func (k *Keyring) Load() {
+	alg := GetConfig().JwtSigningMethod
+	k.persistent = (GetConfig().JwtKeyEncryptionKey != "")
+	if !k.persistent {
+		key, err := LoadSigningKey(alg, GetConfig().JwtPrivateKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k._SetEntries([]*keyringEntry{{Key: key, Active: true, CreateDate: time.Now()}})
+		return
+	}
+	if err := k.Reload(); err != nil {
+		log.Fatal(err)
+	}
+	if k.ActiveKey() == nil {
+		log.Println("No JWT signing key found in database, creating initial key...")
+		key, err := LoadSigningKey(alg, GetConfig().JwtPrivateKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := k._Persist(key); err != nil {
+			log.Fatal(err)
+		}
+		if err := k.Reload(); err != nil {
+			log.Fatal(err)
+		}
+	} else if k.ActiveKey().Method.Alg() != alg {
+		log.Println("JWT signing method changed to", alg, "- rotating signing key...")
+		if err := k.Rotate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Reload reads all keys from the database.
+// If the keys can't be read or an active key can't be decrypted, the current keys are kept and an error is returned.
+func (k *Keyring) Reload() error {
+	if !k.persistent {
+		return nil
+	}
+	// Failed reloads are throttled as well
+	k.mutex.Lock()
+	k.lastReload = time.Now()
+	k.mutex.Unlock()
+	storedKeys, err := GetSigningKeyRepository().GetAll()
+	if err != nil {
+		return errors.New("Could not load JWT signing keys: " + err.Error())
+	}
+	var entries []*keyringEntry
+	for _, stored := range storedKeys {
+		key, err := k._Decrypt(stored)
+		if err != nil && stored.Active {
+			return errors.New("Could not decrypt active JWT signing key " + stored.KeyID + ": " + err.Error())
+		}
+		if err != nil {
+			log.Println("Could not decrypt JWT signing key", stored.KeyID, ":", err)
+			continue
+		}
+		entries = append(entries, &keyringEntry{Key: key, Active: stored.Active, CreateDate: stored.CreateDate})
+	}
+	k._SetEntries(entries)
+	return nil
+}
+
+// Rotate creates a new active key and retires the current one.
+// In persistent mode, the new key is stored before the current one is retired, so that replicas
+// reloading in between find two active keys and use the newer one instead of none.
+func (k *Keyring) Rotate() error {
+	key, err := k._GenerateKey()
+	if err != nil {
+		return err
+	}
+	log.Println("Rotating JWT signing key, new key ID is", key.KeyID)
+	if !k.persistent {
+		k.mutex.Lock()
+		for _, entry := range k.entries {
+			entry.Active = false
+		}
+		k.entries = append([]*keyringEntry{{Key: key, Active: true, CreateDate: time.Now()}}, k.entries...)
+		k.mutex.Unlock()
+		k._Trim()
+		return nil
+	}
+	active := k.ActiveKey()
+	if err := k._Persist(key); err != nil {
+		return err
+	}
+	if active != nil && !GetSigningKeyRepository().Retire(active.KeyID) {
+		// Keep the new key for verifying tokens replicas might already have signed with it
+		log.Println("JWT signing key has already been rotated by another instance")
+		GetSigningKeyRepository().Retire(key.KeyID)
+	}
+	if err := k.Reload(); err != nil {
+		return err
+	}
+	k._Trim()
+	return nil
+}
+
+// RotateIfDue reloads the keys and rotates the active key if it is older than the configured rotation interval.
+// Nothing is rotated if the keys could not be reloaded, as the keyring might not reflect the stored keys.
+func (k *Keyring) RotateIfDue() {
+	if err := k.Reload(); err != nil {
+		log.Println(err)
+		return
+	}
+	interval := GetConfig().JwtKeyRotationInterval * time.Minute
+	if interval <= 0 {
+		return
+	}
+	k.mutex.RLock()
+	due := true
+	for _, entry := range k.entries {
+		if entry.Active && entry.CreateDate.Add(interval).After(time.Now()) {
+			due = false
+		}
+	}
+	k.mutex.RUnlock()
+	if due {
+		if err := k.Rotate(); err != nil {
+			log.Println("Could not rotate JWT signing key:", err)
+		}
+	}
+}
+
+// ActiveKey returns the key used for signing new tokens
+func (k *Keyring) ActiveKey() *SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, entry := range k.entries {
+		if entry.Active {
+			return entry.Key
+		}
+	}
+	return nil
+}
+
+// SignedString signs the claims with the active key
+func (k *Keyring) SignedString(claims jwt.Claims) (string, error) {
+	key := k.ActiveKey()
+	if key == nil {
+		return "", errors.New("no active JWT signing key")
+	}
+	return key.SignedString(claims)
+}
+
+// GetVerificationKey returns the key with the given key ID.
+// Tokens without key ID are verified with the active key.
+func (k *Keyring) GetVerificationKey(kid string) *SigningKey {
+	if kid == "" {
+		return k.ActiveKey()
+	}
+	if key := k._Find(kid); key != nil {
+		return key
+	}
+	// Key might have been rotated by another instance
+	k.mutex.RLock()
+	reload := k.persistent && k.lastReload.Add(10*time.Second).Before(time.Now())
+	k.mutex.RUnlock()
+	if reload {
+		if err := k.Reload(); err != nil {
+			log.Println(err)
+		}
+		return k._Find(kid)
+	}
+	return nil
+}
+
+// PublicKeys returns all asymmetric keys (active and retired)
+func (k *Keyring) PublicKeys() []*SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	res := make([]*SigningKey, 0)
+	for _, entry := range k.entries {
+		if !entry.Key.IsSymmetric() {
+			res = append(res, entry.Key)
+		}
+	}
+	return res
+}
+
+func (k *Keyring) _Find(kid string) *SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, entry := range k.entries {
+		if entry.Key.KeyID == kid {
+			return entry.Key
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) _SetEntries(entries []*keyringEntry) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.entries = entries
+	k.lastReload = time.Now()
+}
+
+// _Trim removes retired keys exceeding JWT_KEY_RETIRED_COUNT
+func (k *Keyring) _Trim() {
+	k.mutex.Lock()
+	var keep []*keyringEntry
+	var remove []*keyringEntry
+	retired := 0
+	for _, entry := range k.entries {
+		if !entry.Active {
+			retired++
+			if retired > GetConfig().JwtKeyRetiredCount {
+				remove = append(remove, entry)
+				continue
+			}
+		}
+		keep = append(keep, entry)
+	}
+	k.entries = keep
+	k.mutex.Unlock()
+	if !k.persistent || len(remove) == 0 {
+		return
+	}
+	storedKeys, err := GetSigningKeyRepository().GetAll()
+	if err != nil {
+		log.Println("Could not delete retired JWT signing keys:", err)
+		return
+	}
+	for _, stored := range storedKeys {
+		for _, entry := range remove {
+			if stored.KeyID == entry.Key.KeyID {
+				log.Println("Deleting retired JWT signing key", stored.KeyID)
+				GetSigningKeyRepository().Delete(stored)
+			}
+		}
+	}
+}
+
+func (k *Keyring) _GenerateKey() (*SigningKey, error) {
+	alg := GetConfig().JwtSigningMethod
+	if IsSymmetricSigningMethod(alg) {
+		return NewRandomHMACSigningKey(alg)
+	}
+	return NewSigningKey(alg)
+}
+
+func (k *Keyring) _Persist(key *SigningKey) error {
+	var plain string
+	if key.IsSymmetric() {
+		plain = string(key.PrivateKey.([]byte))
+	} else {
+		pemBytes, err := key.MarshalPrivateKeyPEM()
+		if err != nil {
+			return err
+		}
+		plain = string(pemBytes)
+	}
+	encrypted, err := Encrypt(GetConfig().JwtKeyEncryptionKey, plain)
+	if err != nil {
+		return err
+	}
+	stored := &StoredSigningKey{
+		KeyID:        key.KeyID,
+		Algorithm:    key.Method.Alg(),
+		EncryptedKey: encrypted,
+		Active:       true,
+		CreateDate:   time.Now(),
+	}
+	return GetSigningKeyRepository().Create(stored)
+}
+
+func (k *Keyring) _Decrypt(stored *StoredSigningKey) (*SigningKey, error) {
+	plain, err := Decrypt(GetConfig().JwtKeyEncryptionKey, stored.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	if plain == "" {
+		return nil, errors.New("empty key")
+	}
+	var key *SigningKey
+	if IsSymmetricSigningMethod(stored.Algorithm) {
+		key, err = NewHMACSigningKey(stored.Algorithm, plain)
+	} else {
+		key, err = NewSigningKeyFromPEM(stored.Algorithm, []byte(plain))
+	}
+	if err != nil {
+		return nil, err
+	}
+	key.KeyID = stored.KeyID
+	return key, nil
+}
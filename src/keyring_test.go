@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestKeyringRotationKeepsOldTokensValid(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	oldKeyID := GetKeyring().ActiveKey().KeyID
+
+	if err := GetKeyring().Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if GetKeyring().ActiveKey().KeyID == oldKeyID {
+		t.Fatal("Expected new active key after rotation")
+	}
+
+	req := newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+}
+
+func TestKeyringRotationDropsExpiredKeys(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+
+	for i := 0; i <= GetConfig().JwtKeyRetiredCount; i++ {
+		GetKeyring().Rotate()
+	}
+
+	req := newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestKeyringPersistent(t *testing.T) {
+	GetSigningKeyRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetConfig().JwtKeyEncryptionKey = "MkmgjlvW4yNmIQvX"
+	defer func() {
+		GetConfig().JwtKeyEncryptionKey = ""
+		GetSigningKeyRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	}()
+
+	k1 := &Keyring{}
+	k1.Load()
+	if k1.ActiveKey() == nil {
+		t.Fatal("Expected active key")
+	}
+	k2 := &Keyring{}
+	k2.Load()
+	checkTestString(t, k1.ActiveKey().KeyID, k2.ActiveKey().KeyID)
+
+	if err := k2.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	k1.Reload()
+	checkTestString(t, k2.ActiveKey().KeyID, k1.ActiveKey().KeyID)
+	stored, _ := GetSigningKeyRepository().GetAll()
+	if len(stored) != 2 {
+		t.Fatalf("Expected 2 stored keys, got %d", len(stored))
+	}
+	if stored[0].EncryptedKey == "" || stored[0].EncryptedKey == string(k2.ActiveKey().PrivateKey.([]byte)) {
+		t.Fatal("Expected key to be stored encrypted")
+	}
+
+	// A concurrent rotation by an instance with an outdated keyring keeps the other instance's key active
+	k3 := &Keyring{}
+	k3.Load()
+	if err := k2.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := k3.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, k2.ActiveKey().KeyID, k3.ActiveKey().KeyID)
+}
+
+func TestKeyringWithoutActiveKey(t *testing.T) {
+	if _, err := (&Keyring{}).SignedString(&Claims{}); err == nil {
+		t.Fatal("Expected error when signing without active key")
+	}
+}
+
+func TestKeyringFailedReloadKeepsKeys(t *testing.T) {
+	GetSigningKeyRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetConfig().JwtKeyEncryptionKey = "MkmgjlvW4yNmIQvX"
+	GetConfig().JwtKeyRotationInterval = 1
+	defer func() {
+		GetConfig().JwtKeyEncryptionKey = ""
+		GetConfig().JwtKeyRotationInterval = 0
+		GetSigningKeyRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	}()
+
+	k := &Keyring{}
+	k.Load()
+	keyID := k.ActiveKey().KeyID
+	GetSigningKeyRepository().Create(&StoredSigningKey{
+		KeyID:        "broken",
+		Algorithm:    GetConfig().JwtSigningMethod,
+		EncryptedKey: "invalid",
+		Active:       true,
+		CreateDate:   time.Now().Add(-time.Hour),
+	})
+	GetSigningKeyRepository().GetCollection().UpdateOne(context.TODO(), bson.M{"keyId": keyID}, bson.M{"$set": bson.M{"createDate": time.Now().Add(-time.Hour)}})
+
+	if err := k.Reload(); err == nil {
+		t.Fatal("Expected error when an active key can't be decrypted")
+	}
+	checkTestString(t, keyID, k.ActiveKey().KeyID)
+	k.RotateIfDue()
+	checkTestString(t, keyID, k.ActiveKey().KeyID)
+	stored, _ := GetSigningKeyRepository().GetAll()
+	if len(stored) != 2 {
+		t.Fatalf("Expected no rotation after a failed reload, got %d stored keys", len(stored))
+	}
+}
@@ -9,6 +9,14 @@ func main() {
 	log.Println("Starting server...")
 	a := GetApp()
 	GetDatatabase().connectMongoDb(GetConfig().MongoDbURL, GetConfig().MongoDbName)
+	GetKeyring().Load()
+	GetUpstreamSigner().Load()
+	if err := MigrateRoleData(GetConfig().RoleMigrations); err != nil {
+		log.Fatal(err)
+	}
+	if err := ReloadPolicy(); err != nil {
+		log.Fatal(err)
+	}
 	a.InitializePublicRouter()
 	a.InitializeBackendRouter()
 	a.InitializeTimers()
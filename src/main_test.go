@@ -27,6 +27,7 @@ func TestMain(m *testing.M) {
 	os.Setenv("CORS_ENABLE", "1")
 	os.Setenv("TOTP_ENABLE", "1")
 	os.Setenv("TOTP_ENCRYPT_KEY", "w66iO0l3Kru7Qgpx")
+	os.Setenv("CLIENT_CREDENTIALS_ENABLE", "1")
 	GetConfig().ReadConfig()
 	smtpClient = func(addr string) (dialer, error) {
 		client := &smtpDialerMock{}
@@ -34,6 +35,7 @@ func TestMain(m *testing.M) {
 	}
 	a := GetApp()
 	GetDatatabase().connectMongoDb("mongodb://localhost:27017", "jwt_auth_proxy_test")
+	GetKeyring().Load()
 	a.InitializePublicRouter()
 	a.InitializeBackendRouter()
 	readMailTemplatesFromFile()
@@ -108,6 +110,13 @@ func clearTestDB() {
 	GetPendingActionRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
 	GetRefreshTokenRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
 	GetUserRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetRevokedTokenRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetOIDCClientRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetAuthorizationCodeRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetServiceClientRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetAuditLogRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetPhantomTokenRepository().GetCollection().DeleteMany(context.TODO(), bson.D{})
+	GetRevokedTokenRepository().SyncCache()
 }
 
 func executePublicTestRequest(req *http.Request) *httptest.ResponseRecorder {
@@ -134,6 +143,12 @@ func checkTestString(t *testing.T, expected, actual string) {
 	}
 }
 
+func checkTestInt(t *testing.T, expected, actual int) {
+	if expected != actual {
+		t.Errorf("Expected %d, got %d\n", expected, actual)
+	}
+}
+
 func checkStringNotEmpty(t *testing.T, s string) {
 	if strings.TrimSpace(s) == "" {
 		t.Fatalf("Expected non-empty string")
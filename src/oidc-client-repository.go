@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OIDCClient holds a relying party registered for the OpenID Connect provider mode
+type OIDCClient struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ClientID     string             `json:"clientId" bson:"clientId"`
+	HashedSecret string             `json:"-" bson:"secret,omitempty"`
+	Name         string             `json:"name" bson:"name"`
+	RedirectURIs []string           `json:"redirectUris" bson:"redirectUris"`
+	Public       bool               `json:"public" bson:"public"`
+	CreateDate   time.Time          `json:"createDate" bson:"createDate"`
+}
+
+// IsValidRedirectURI checks if the redirect URI exactly matches one of the registered redirect URIs
+func (c *OIDCClient) IsValidRedirectURI(redirectURI string) bool {
+	for _, uri := range c.RedirectURIs {
+		if uri == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+type OIDCClientRepository struct {
+}
+
+var _oidcClientRepositoryInstance *OIDCClientRepository
+var _oidcClientRepositoryOnce sync.Once
+
+func GetOIDCClientRepository() *OIDCClientRepository {
+	_oidcClientRepositoryOnce.Do(func() {
+		_oidcClientRepositoryInstance = &OIDCClientRepository{}
+		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
+		// Create unique index on 'clientId'
+		mod := mongo.IndexModel{
+			Keys: bson.M{
+				"clientId": 1,
+			},
+			Options: options.Index().SetUnique(true),
+		}
+		_, err := _oidcClientRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return _oidcClientRepositoryInstance
+}
+
+func (r *OIDCClientRepository) GetCollection() *mongo.Collection {
+	return GetDatatabase().Database.Collection("oidc_clients")
+}
+
+func (r *OIDCClientRepository) Create(c *OIDCClient) {
+	res, err := r.GetCollection().InsertOne(context.TODO(), c)
+	if err != nil {
+		log.Println(err)
+	}
+	c.ID = res.InsertedID.(primitive.ObjectID)
+}
+
+func (r *OIDCClientRepository) GetByClientID(clientID string) *OIDCClient {
+	var client OIDCClient
+	err := r.GetCollection().FindOne(context.TODO(), bson.M{"clientId": clientID}).Decode(&client)
+	if err != nil {
+		return nil
+	}
+	return &client
+}
+
+func (r *OIDCClientRepository) GetAll() []*OIDCClient {
+	results := make([]*OIDCClient, 0)
+	cur, err := r.GetCollection().Find(context.TODO(), bson.M{}, options.Find().SetSort(bson.M{"createDate": 1}))
+	if err != nil {
+		log.Println(err)
+		return results
+	}
+	for cur.Next(context.TODO()) {
+		var client OIDCClient
+		err := cur.Decode(&client)
+		if err != nil {
+			return results
+		}
+		results = append(results, &client)
+	}
+	cur.Close(context.TODO())
+	return results
+}
+
+func (r *OIDCClientRepository) Update(c *OIDCClient) {
+	_, err := r.GetCollection().UpdateOne(context.TODO(), bson.M{"_id": c.ID}, bson.M{"$set": c})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *OIDCClientRepository) Delete(c *OIDCClient) {
+	GetAuthorizationCodeRepository().DeleteAllForClient(c.ClientID)
+	_, err := r.GetCollection().DeleteOne(context.TODO(), bson.M{"_id": c.ID})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *OIDCClientRepository) FindUnusedClientID() string {
+	var clientID string = ""
+	for i := 1; i <= 20 && clientID == ""; i++ {
+		clientID = guuid.New().String()
+		if r.GetByClientID(clientID) != nil {
+			clientID = ""
+		}
+	}
+	return clientID
+}
+
+// GenerateSecret sets a new random client secret and returns it in plain text
+func (r *OIDCClientRepository) GenerateSecret(c *OIDCClient) (string, error) {
+	secret, hash, err := GenerateClientSecret()
+	if err != nil {
+		return "", err
+	}
+	c.HashedSecret = hash
+	return secret, nil
+}
+
+func (r *OIDCClientRepository) CheckSecret(c *OIDCClient, secret string) bool {
+	return CheckClientSecret(c.HashedSecret, secret)
+}
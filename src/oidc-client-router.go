@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OIDCClientRouter handles the backend requests for managing OIDC clients
+type OIDCClientRouter struct {
+}
+
+func (router *OIDCClientRouter) setupRoutes(s *mux.Router) {
+	s.HandleFunc("/{id}", router.getOne).Methods("GET")
+	s.HandleFunc("/{id}", router.update).Methods("PUT")
+	s.HandleFunc("/{id}", router.delete).Methods("DELETE")
+	s.HandleFunc("/{id}/secret", router.resetSecret).Methods("POST")
+	s.HandleFunc("/", router.create).Methods("POST")
+	s.HandleFunc("/", router.getAll).Methods("GET")
+}
+
+func (router *OIDCClientRouter) create(w http.ResponseWriter, r *http.Request) {
+	var data OIDCClientRequest
+	if UnmarshalValidateBody(r, &data) != nil {
+		log.Println("Received invalid create OIDC client request")
+		SendBadRequest(w)
+		return
+	}
+	client := &OIDCClient{
+		ClientID:     GetOIDCClientRepository().FindUnusedClientID(),
+		Name:         data.Name,
+		RedirectURIs: data.RedirectURIs,
+		Public:       data.Public,
+		CreateDate:   time.Now(),
+	}
+	res := &OIDCClientCredentials{ClientID: client.ClientID}
+	if !client.Public {
+		secret, err := GetOIDCClientRepository().GenerateSecret(client)
+		if err != nil {
+			log.Println("Could not generate OIDC client secret:", err)
+			SendInternalServerError(w)
+			return
+		}
+		res.ClientSecret = secret
+	}
+	GetOIDCClientRepository().Create(client)
+	SendCreatedJSON(w, client.ID, res)
+}
+
+func (router *OIDCClientRouter) getAll(w http.ResponseWriter, r *http.Request) {
+	SendJSON(w, GetOIDCClientRepository().GetAll())
+}
+
+func (router *OIDCClientRouter) getOne(w http.ResponseWriter, r *http.Request) {
+	client := router.getClientFromMuxVars(r)
+	if client == nil {
+		SendNotFound(w)
+		return
+	}
+	SendJSON(w, client)
+}
+
+func (router *OIDCClientRouter) update(w http.ResponseWriter, r *http.Request) {
+	client := router.getClientFromMuxVars(r)
+	if client == nil {
+		SendNotFound(w)
+		return
+	}
+	var data OIDCClientRequest
+	if UnmarshalValidateBody(r, &data) != nil {
+		SendBadRequest(w)
+		return
+	}
+	if data.Public != client.Public {
+		log.Println("Invalid update OIDC client request: client type can't be changed")
+		SendBadRequest(w)
+		return
+	}
+	client.Name = data.Name
+	client.RedirectURIs = data.RedirectURIs
+	GetOIDCClientRepository().Update(client)
+	SendUpdated(w)
+}
+
+func (router *OIDCClientRouter) delete(w http.ResponseWriter, r *http.Request) {
+	client := router.getClientFromMuxVars(r)
+	if client == nil {
+		SendNotFound(w)
+		return
+	}
+	GetOIDCClientRepository().Delete(client)
+	SendUpdated(w)
+}
+
+func (router *OIDCClientRouter) resetSecret(w http.ResponseWriter, r *http.Request) {
+	client := router.getClientFromMuxVars(r)
+	if client == nil {
+		SendNotFound(w)
+		return
+	}
+	if client.Public {
+		SendBadRequest(w)
+		return
+	}
+	secret, err := GetOIDCClientRepository().GenerateSecret(client)
+	if err != nil {
+		log.Println("Could not generate OIDC client secret:", err)
+		SendInternalServerError(w)
+		return
+	}
+	GetOIDCClientRepository().Update(client)
+	SendJSON(w, &OIDCClientCredentials{
+		ClientID:     client.ClientID,
+		ClientSecret: secret,
+	})
+}
+
+func (router *OIDCClientRouter) getClientFromMuxVars(r *http.Request) *OIDCClient {
+	vars := mux.Vars(r)
+	return GetOIDCClientRepository().GetByClientID(vars["id"])
+}
+
+type OIDCClientRequest struct {
+	Name         string   `json:"name" validate:"required"`
+	RedirectURIs []string `json:"redirectUris" validate:"required,min=1,dive,url"`
+	Public       bool     `json:"public"`
+}
+
+type OIDCClientCredentials struct {
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCreateOIDCClient(t *testing.T) {
+	clearTestDB()
+
+	payload := `{"name": "Grafana", "redirectUris": ["https://grafana.example.com/login/generic_oauth"]}`
+	req, _ := http.NewRequest("POST", "/oidc/clients/", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusCreated, res.Code)
+	var credentials OIDCClientCredentials
+	json.Unmarshal(res.Body.Bytes(), &credentials)
+	checkStringNotEmpty(t, credentials.ClientID)
+	checkStringNotEmpty(t, credentials.ClientSecret)
+
+	client := GetOIDCClientRepository().GetByClientID(credentials.ClientID)
+	if client == nil {
+		t.Fatal("Expected client to be created")
+	}
+	checkTestString(t, "Grafana", client.Name)
+	if !GetOIDCClientRepository().CheckSecret(client, credentials.ClientSecret) {
+		t.Fatal("Expected client secret to match")
+	}
+}
+
+func TestCreatePublicOIDCClient(t *testing.T) {
+	clearTestDB()
+
+	payload := `{"name": "SPA", "redirectUris": ["https://spa.example.com/cb"], "public": true}`
+	req, _ := http.NewRequest("POST", "/oidc/clients/", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusCreated, res.Code)
+	var credentials OIDCClientCredentials
+	json.Unmarshal(res.Body.Bytes(), &credentials)
+	checkTestString(t, "", credentials.ClientSecret)
+}
+
+func TestCreateOIDCClientInvalidRedirectURI(t *testing.T) {
+	clearTestDB()
+
+	payload := `{"name": "Test", "redirectUris": ["no-url"]}`
+	req, _ := http.NewRequest("POST", "/oidc/clients/", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestUpdateDeleteOIDCClient(t *testing.T) {
+	clearTestDB()
+
+	payload := `{"name": "Test", "redirectUris": ["https://client.example.com/cb"]}`
+	req, _ := http.NewRequest("POST", "/oidc/clients/", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	var credentials OIDCClientCredentials
+	json.Unmarshal(res.Body.Bytes(), &credentials)
+
+	payload = `{"name": "Test 2", "redirectUris": ["https://client.example.com/cb2"]}`
+	req, _ = http.NewRequest("PUT", "/oidc/clients/"+credentials.ClientID, bytes.NewBufferString(payload))
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req, _ = http.NewRequest("GET", "/oidc/clients/"+credentials.ClientID, nil)
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var client OIDCClient
+	json.Unmarshal(res.Body.Bytes(), &client)
+	checkTestString(t, "Test 2", client.Name)
+	checkTestString(t, "https://client.example.com/cb2", client.RedirectURIs[0])
+
+	req, _ = http.NewRequest("DELETE", "/oidc/clients/"+credentials.ClientID, nil)
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req, _ = http.NewRequest("GET", "/oidc/clients/"+credentials.ClientID, nil)
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNotFound, res.Code)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// OIDCRouter handles the OpenID Connect provider endpoints (authorization code flow with PKCE)
+type OIDCRouter struct {
+	authRouter *AuthRouter
+}
+
+func (router *OIDCRouter) setupRoutes(s *mux.Router) {
+	s.HandleFunc("/.well-known/openid-configuration", router.Discovery).Methods("GET")
+	s.HandleFunc("/oidc/authorize", router.Authorize).Methods("GET")
+	s.HandleFunc("/oidc/authorize", router.Consent).Methods("POST")
+	s.HandleFunc("/oidc/token", router.Token).Methods("POST")
+	s.HandleFunc("/oidc/userinfo", router.UserInfo).Methods("GET", "POST")
+}
+
+// Discovery handles /.well-known/openid-configuration requests
+func (router *OIDCRouter) Discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := GetConfig().OIDCIssuer
+	SendJSON(w, &OIDCDiscoveryResponse{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oidc/authorize",
+		TokenEndpoint:                     issuer + "/oidc/token",
+		UserInfoEndpoint:                  issuer + "/oidc/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{GetConfig().JwtSigningMethod},
+		ScopesSupported:                   []string{"openid", "email"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		ClaimsSupported:                   []string{"sub", "email", "email_verified"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		GrantTypesSupported:               []string{"authorization_code"},
+	})
+}
+
+// Authorize handles GET /oidc/authorize requests.
+// Valid authorization requests are redirected to the login page configured by OIDC_LOGIN_URL
+// which is expected to log the user in and pass the parameters on to POST /oidc/authorize.
+func (router *OIDCRouter) Authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data := &OIDCAuthorizeRequest{
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		ResponseType:        q.Get("response_type"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		Nonce:               q.Get("nonce"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+	client, errCode := router._ValidateAuthorizeRequest(data)
+	if client == nil {
+		log.Println("Invalid OIDC authorization request: invalid client or redirect URI")
+		SendBadRequest(w)
+		return
+	}
+	if errCode != "" {
+		log.Println("Invalid OIDC authorization request for client", client.ClientID, ":", errCode)
+		http.Redirect(w, r, router._GetErrorRedirectURI(data, errCode), http.StatusFound)
+		return
+	}
+	loginURL := GetConfig().OIDCLoginURL
+	if strings.Contains(loginURL, "?") {
+		loginURL += "&" + r.URL.RawQuery
+	} else {
+		loginURL += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, loginURL, http.StatusFound)
+}
+
+// Consent handles POST /oidc/authorize requests by the logged in user and returns the redirect URI including the authorization code
+func (router *OIDCRouter) Consent(w http.ResponseWriter, r *http.Request) {
+	if GetUserIDFromContext(r) == "" {
+		SendUnauthorized(w)
+		return
+	}
+	var data OIDCAuthorizeRequest
+	if UnmarshalBody(r, &data) != nil {
+		log.Println("Invalid OIDC authorization attempt: failed unmarshalling request")
+		SendBadRequest(w)
+		return
+	}
+	client, errCode := router._ValidateAuthorizeRequest(&data)
+	if client == nil {
+		log.Println("Invalid OIDC authorization attempt: invalid client or redirect URI")
+		SendBadRequest(w)
+		return
+	}
+	if errCode != "" {
+		log.Println("Invalid OIDC authorization attempt for client", client.ClientID, ":", errCode)
+		SendJSON(w, &OIDCAuthorizeResponse{RedirectURI: router._GetErrorRedirectURI(&data, errCode)})
+		return
+	}
+	user := GetUserRepository().GetOne(GetUserIDFromContext(r))
+	if user == nil || !user.Confirmed || !user.Enabled {
+		log.Println("Invalid OIDC authorization attempt: invalid UserID", GetUserIDFromContext(r))
+		SendUnauthorized(w)
+		return
+	}
+	code := &AuthorizationCode{
+		Code:          GetAuthorizationCodeRepository().FindUnusedCode(),
+		ClientID:      client.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   data.RedirectURI,
+		Scope:         data.Scope,
+		Nonce:         data.Nonce,
+		CodeChallenge: data.CodeChallenge,
+		CreateDate:    time.Now(),
+		ExpiryDate:    time.Now().Add(time.Second * GetConfig().OIDCCodeLifetime),
+	}
+	GetAuthorizationCodeRepository().Create(code)
+	log.Println("Issued OIDC authorization code for UserID", user.ID.Hex(), "to client", client.ClientID)
+	params := url.Values{}
+	params.Set("code", code.Code)
+	if data.State != "" {
+		params.Set("state", data.State)
+	}
+	SendJSON(w, &OIDCAuthorizeResponse{RedirectURI: router._AppendQuery(data.RedirectURI, params)})
+}
+
+// Token handles /oidc/token requests
+func (router *OIDCRouter) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		SendOAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	client := router._AuthenticateClient(r)
+	if client == nil {
+		log.Println("Invalid OIDC token request: client authentication failed")
+		SendOAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	code := GetAuthorizationCodeRepository().Consume(r.PostForm.Get("code"))
+	if code == nil || code.ClientID != client.ClientID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		log.Println("Invalid OIDC token request: invalid authorization code for client", client.ClientID)
+		SendOAuthError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	if !router._IsValidCodeVerifier(code.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		log.Println("Invalid OIDC token request: PKCE verification failed for client", client.ClientID)
+		SendOAuthError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	user := GetUserRepository().GetOne(code.UserID.Hex())
+	if user == nil || !user.Confirmed || !user.Enabled {
+		log.Println("Invalid OIDC token request: invalid UserID", code.UserID.Hex())
+		SendOAuthError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	idToken, err := router._CreateIDToken(user, code)
+	if err != nil {
+		log.Println("Could not sign ID token:", err)
+		SendInternalServerError(w)
+		return
+	}
+	log.Println("Issued OIDC tokens for UserID", user.ID.Hex(), "to client", client.ClientID)
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, &TokenResponse{
+		AccessToken: router._CreateAccessToken(user, client),
+		TokenType:   "Bearer",
+		ExpiresIn:   int64((GetConfig().AccessTokenLifetime * time.Minute).Seconds()),
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	})
+}
+
+// UserInfo handles /oidc/userinfo requests
+func (router *OIDCRouter) UserInfo(w http.ResponseWriter, r *http.Request) {
+	user := GetUserRepository().GetOne(GetUserIDFromContext(r))
+	if user == nil {
+		SendUnauthorized(w)
+		return
+	}
+	SendJSON(w, &OIDCUserInfoResponse{
+		Subject:       user.ID.Hex(),
+		Email:         user.Email,
+		EmailVerified: user.Confirmed,
+	})
+}
+
+// _ValidateAuthorizeRequest returns nil if the client or the redirect URI are invalid.
+// Otherwise, it returns the client and an OAuth2 error code if the request is invalid.
+func (router *OIDCRouter) _ValidateAuthorizeRequest(data *OIDCAuthorizeRequest) (*OIDCClient, string) {
+	client := GetOIDCClientRepository().GetByClientID(data.ClientID)
+	if client == nil || !client.IsValidRedirectURI(data.RedirectURI) {
+		return nil, ""
+	}
+	if data.ResponseType != "code" {
+		return client, "unsupported_response_type"
+	}
+	scopeOpenID := false
+	for _, scope := range strings.Fields(data.Scope) {
+		if scope == "openid" {
+			scopeOpenID = true
+		}
+	}
+	if !scopeOpenID {
+		return client, "invalid_scope"
+	}
+	if data.CodeChallenge == "" || data.CodeChallengeMethod != "S256" {
+		return client, "invalid_request"
+	}
+	return client, ""
+}
+
+func (router *OIDCRouter) _GetErrorRedirectURI(data *OIDCAuthorizeRequest, errCode string) string {
+	params := url.Values{}
+	params.Set("error", errCode)
+	if data.State != "" {
+		params.Set("state", data.State)
+	}
+	return router._AppendQuery(data.RedirectURI, params)
+}
+
+func (router *OIDCRouter) _AppendQuery(uri string, params url.Values) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + params.Encode()
+	}
+	return uri + "?" + params.Encode()
+}
+
+// _AuthenticateClient checks the client credentials sent via HTTP Basic authentication or in the request body.
+// Public clients don't have a secret, they are bound to the authorization code by PKCE.
+func (router *OIDCRouter) _AuthenticateClient(r *http.Request) *OIDCClient {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client := GetOIDCClientRepository().GetByClientID(clientID)
+	if client == nil {
+		return nil
+	}
+	if client.Public || GetOIDCClientRepository().CheckSecret(client, secret) {
+		return client
+	}
+	return nil
+}
+
+// _IsValidCodeVerifier checks the PKCE code verifier against the S256 code challenge (RFC 7636)
+func (router *OIDCRouter) _IsValidCodeVerifier(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// _CreateAccessToken returns an access token restricted to the userinfo endpoint.
+// It is issued for the client as its audience, so it is not accepted by the public API or for proxied requests.
+func (router *OIDCRouter) _CreateAccessToken(user *User, client *OIDCClient) string {
+	claims := NewClaims(user.ID.Hex(), GetConfig().AccessTokenLifetime)
+	claims.UserID = user.ID.Hex()
+	claims.TokenVersion = user.TokenVersion
+	claims.Scope = "openid"
+	claims.AuthorizedParty = client.ClientID
+	claims.Audience = Audience{client.ClientID}
+	return router.authRouter._IssueAccessToken(claims)
+}
+
+// IsOIDCAccessToken checks if the claims belong to an access token issued to an OIDC client
+func IsOIDCAccessToken(claims *Claims) bool {
+	return claims.AuthorizedParty != "" && !IsExternalToken(claims)
+}
+
+// IsUserInfoRequest checks if the request is directed to the OIDC userinfo endpoint
+func IsUserInfoRequest(r *http.Request) bool {
+	return GetRequestPath(r) == GetConfig().PublicAPIPath+"oidc/userinfo"
+}
+
+func (router *OIDCRouter) _CreateIDToken(user *User, code *AuthorizationCode) (string, error) {
+	claims := &IDTokenClaims{
+		Nonce:         code.Nonce,
+		Email:         user.Email,
+		EmailVerified: user.Confirmed,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    GetConfig().OIDCIssuer,
+			Subject:   user.ID.Hex(),
+			Audience:  code.ClientID,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(GetConfig().AccessTokenLifetime * time.Minute).Unix(),
+		},
+	}
+	return GetKeyring().SignedString(claims)
+}
+
+// OIDCAuthorizeRequest holds the parameters of an authorization request
+type OIDCAuthorizeRequest struct {
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	ResponseType        string `json:"response_type"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// OIDCAuthorizeResponse holds the URI the user agent has to be redirected to after authorization
+type OIDCAuthorizeResponse struct {
+	RedirectURI string `json:"redirectUri"`
+}
+
+// IDTokenClaims holds the payload of issued OpenID Connect ID Tokens
+type IDTokenClaims struct {
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	jwt.StandardClaims
+}
+
+// TokenResponse holds the response payload of the OAuth2 token endpoints
+type TokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	IDToken         string `json:"id_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+type OIDCUserInfoResponse struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+type OIDCDiscoveryResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+}
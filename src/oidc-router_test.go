@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const oidcTestVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk-oidc-test"
+
+func setupOIDCTest(t *testing.T) (*OIDCClientCredentials, func()) {
+	key, err := NewSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldAlg := GetConfig().JwtSigningMethod
+	oldKey := GetKeyring().ActiveKey()
+	GetConfig().EnableOIDC = true
+	GetConfig().OIDCIssuer = "http://localhost:8080/auth"
+	GetConfig().OIDCLoginURL = "http://localhost:3000/login"
+	GetConfig().JwtSigningMethod = "ES256"
+	GetKeyring()._SetEntries([]*keyringEntry{{Key: key, Active: true, CreateDate: time.Now()}})
+	GetApp().InitializePublicRouter()
+
+	clearTestDB()
+	payload := `{"name": "Test", "redirectUris": ["https://client.example.com/cb"]}`
+	req, _ := http.NewRequest("POST", "/oidc/clients/", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusCreated, res.Code)
+	var credentials OIDCClientCredentials
+	json.Unmarshal(res.Body.Bytes(), &credentials)
+
+	return &credentials, func() {
+		GetConfig().EnableOIDC = false
+		GetConfig().JwtSigningMethod = oldAlg
+		GetKeyring()._SetEntries([]*keyringEntry{{Key: oldKey, Active: true, CreateDate: time.Now()}})
+		GetApp().InitializePublicRouter()
+	}
+}
+
+func oidcTestChallenge() string {
+	sum := sha256.Sum256([]byte(oidcTestVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func oidcAuthorize(t *testing.T, clientID, accessToken string) string {
+	payload := `{"client_id": "` + clientID + `", "redirect_uri": "https://client.example.com/cb", "response_type": "code", "scope": "openid email", "state": "xyz", "nonce": "n-0S6", "code_challenge": "` + oidcTestChallenge() + `", "code_challenge_method": "S256"}`
+	req := newHTTPRequest("POST", "/auth/oidc/authorize", accessToken, bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var authorizeResponse OIDCAuthorizeResponse
+	json.Unmarshal(res.Body.Bytes(), &authorizeResponse)
+	redirectURI, err := url.Parse(authorizeResponse.RedirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, "xyz", redirectURI.Query().Get("state"))
+	checkStringNotEmpty(t, redirectURI.Query().Get("code"))
+	return redirectURI.Query().Get("code")
+}
+
+func oidcToken(credentials *OIDCClientCredentials, code, verifier string) (*TokenResponse, int) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", "https://client.example.com/cb")
+	form.Set("code_verifier", verifier)
+	req, _ := http.NewRequest("POST", "/auth/oidc/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(credentials.ClientID, credentials.ClientSecret)
+	res := executePublicTestRequest(req)
+	var tokenResponse TokenResponse
+	json.Unmarshal(res.Body.Bytes(), &tokenResponse)
+	return &tokenResponse, res.Code
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	_, restore := setupOIDCTest(t)
+	defer restore()
+
+	req, _ := http.NewRequest("GET", "/auth/.well-known/openid-configuration", nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var discovery OIDCDiscoveryResponse
+	json.Unmarshal(res.Body.Bytes(), &discovery)
+	checkTestString(t, "http://localhost:8080/auth", discovery.Issuer)
+	checkTestString(t, "http://localhost:8080/auth/oidc/token", discovery.TokenEndpoint)
+	checkTestString(t, "http://localhost:8080/auth/.well-known/jwks.json", discovery.JWKSURI)
+}
+
+func TestOIDCAuthorizeRedirectsToLogin(t *testing.T) {
+	credentials, restore := setupOIDCTest(t)
+	defer restore()
+
+	query := "client_id=" + credentials.ClientID + "&redirect_uri=" + url.QueryEscape("https://client.example.com/cb") + "&response_type=code&scope=openid&state=xyz&code_challenge=" + oidcTestChallenge() + "&code_challenge_method=S256"
+	req, _ := http.NewRequest("GET", "/auth/oidc/authorize?"+query, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusFound, res.Code)
+	checkTestString(t, "http://localhost:3000/login?"+query, res.Header().Get("Location"))
+
+	// Invalid redirect URI is not redirected to
+	req, _ = http.NewRequest("GET", "/auth/oidc/authorize?client_id="+credentials.ClientID+"&redirect_uri=https://evil.example.com&response_type=code&scope=openid", nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadRequest, res.Code)
+
+	// Missing PKCE challenge is reported to the client
+	req, _ = http.NewRequest("GET", "/auth/oidc/authorize?client_id="+credentials.ClientID+"&redirect_uri=https://client.example.com/cb&response_type=code&scope=openid&state=xyz", nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusFound, res.Code)
+	checkTestString(t, "https://client.example.com/cb?error=invalid_request&state=xyz", res.Header().Get("Location"))
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	credentials, restore := setupOIDCTest(t)
+	defer restore()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	code := oidcAuthorize(t, credentials.ClientID, loginResponse.AccessToken)
+	tokenResponse, status := oidcToken(credentials, code, oidcTestVerifier)
+	checkTestResponseCode(t, http.StatusOK, status)
+	checkTestString(t, "Bearer", tokenResponse.TokenType)
+
+	// Verify ID token
+	claims := &IDTokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenResponse.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return GetKeyring().ActiveKey().PublicKey, nil
+	})
+	if err != nil || !token.Valid {
+		t.Fatalf("Expected valid ID token, got: %s", err)
+	}
+	checkTestString(t, user.ID.Hex(), claims.Subject)
+	checkTestString(t, credentials.ClientID, claims.Audience)
+	checkTestString(t, "http://localhost:8080/auth", claims.Issuer)
+	checkTestString(t, "n-0S6", claims.Nonce)
+
+	// Call userinfo endpoint with access token
+	req := newHTTPRequest("GET", "/auth/oidc/userinfo", tokenResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var userInfo OIDCUserInfoResponse
+	json.Unmarshal(res.Body.Bytes(), &userInfo)
+	checkTestString(t, user.ID.Hex(), userInfo.Subject)
+	checkTestString(t, "foo@bar.com", userInfo.Email)
+
+	// The access token is restricted to the userinfo endpoint
+	for _, url := range []string{"/auth/sessions", "/some/route/test.html"} {
+		req = newHTTPRequest("GET", url, tokenResponse.AccessToken, nil)
+		res = executePublicTestRequest(req)
+		checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+	}
+
+	// Code can only be redeemed once
+	_, status = oidcToken(credentials, code, oidcTestVerifier)
+	checkTestResponseCode(t, http.StatusBadRequest, status)
+}
+
+func TestOIDCInvalidCodeVerifier(t *testing.T) {
+	credentials, restore := setupOIDCTest(t)
+	defer restore()
+	loginResponse := createLoginTestUser()
+
+	code := oidcAuthorize(t, credentials.ClientID, loginResponse.AccessToken)
+	_, status := oidcToken(credentials, code, strings.Repeat("x", 43))
+	checkTestResponseCode(t, http.StatusBadRequest, status)
+}
+
+func TestOIDCInvalidClientSecret(t *testing.T) {
+	credentials, restore := setupOIDCTest(t)
+	defer restore()
+	loginResponse := createLoginTestUser()
+
+	code := oidcAuthorize(t, credentials.ClientID, loginResponse.AccessToken)
+	credentials.ClientSecret = "invalid"
+	_, status := oidcToken(credentials, code, oidcTestVerifier)
+	checkTestResponseCode(t, http.StatusUnauthorized, status)
+}
+
+func TestOIDCAuthorizeRequiresLogin(t *testing.T) {
+	credentials, restore := setupOIDCTest(t)
+	defer restore()
+
+	payload := `{"client_id": "` + credentials.ClientID + `", "redirect_uri": "https://client.example.com/cb", "response_type": "code", "scope": "openid"}`
+	req := newHTTPRequest("POST", "/auth/oidc/authorize", "", bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
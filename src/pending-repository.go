@@ -6,7 +6,6 @@ import (
 	"sync"
 	"time"
 
-	guuid "github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -20,7 +19,8 @@ const PendingActionTypeInitPasswordReset = 3
 type PendingAction struct {
 	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	UserID     primitive.ObjectID `json:"userId" bson:"userId"`
-	Token      string             `json:"token" bson:"token"`
+	Token      string             `json:"token" bson:"-"`
+	TokenHash  string             `json:"-" bson:"tokenHash"`
 	ActionType int                `json:"actionType" bson:"actionType"`
 	Payload    string             `json:"payload" bson:"payload"`
 	CreateDate time.Time          `json:"createDate" bson:"createDate"`
@@ -36,11 +36,12 @@ var _pendingActionRepositoryOnce sync.Once
 func GetPendingActionRepository() *PendingActionRepository {
 	_pendingActionRepositoryOnce.Do(func() {
 		_pendingActionRepositoryInstance = &PendingActionRepository{}
+		GetDatatabase().MigrateTokenHashes(_pendingActionRepositoryInstance.GetCollection())
 		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
-		// Create unique index on 'token'
+		// Create unique index on 'tokenHash'
 		mod := mongo.IndexModel{
 			Keys: bson.M{
-				"token": 1,
+				"tokenHash": 1,
 			},
 			Options: options.Index().SetUnique(true),
 		}
@@ -72,6 +73,7 @@ func (r *PendingActionRepository) GetCollection() *mongo.Collection {
 }
 
 func (r *PendingActionRepository) Create(u *PendingAction) {
+	u.TokenHash = HashToken(u.Token)
 	res, err := r.GetCollection().InsertOne(context.TODO(), u)
 	if err != nil {
 		log.Println(err)
@@ -94,7 +96,7 @@ func (r *PendingActionRepository) GetOne(id string) *PendingAction {
 
 func (r *PendingActionRepository) GetByToken(token string) *PendingAction {
 	var pendingAction PendingAction
-	err := r.GetCollection().FindOne(context.TODO(), bson.M{"token": token}).Decode(&pendingAction)
+	err := r.GetCollection().FindOne(context.TODO(), bson.M{"tokenHash": HashToken(token)}).Decode(&pendingAction)
 	if err != nil {
 		return nil
 	}
@@ -102,6 +104,7 @@ func (r *PendingActionRepository) GetByToken(token string) *PendingAction {
 		r.Delete(&pendingAction)
 		return nil
 	}
+	pendingAction.Token = token
 	return &pendingAction
 }
 
@@ -147,8 +150,8 @@ func (r *PendingActionRepository) DeleteAllForUser(userID string) {
 func (r *PendingActionRepository) FindUnusedToken() string {
 	var token string = ""
 	for i := 1; i <= 20 && token == ""; i++ {
-		token = guuid.New().String()
-		if r.GetByToken(token) != nil {
+		token, _ = GenerateRandomToken()
+		if token != "" && r.GetByToken(token) != nil {
 			token = ""
 		}
 	}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -119,3 +121,28 @@ func TestPendingActionGetByTokenExpired(t *testing.T) {
 		t.Error("Expected pa1 to be nil")
 	}
 }
+
+func TestPendingActionStoredAsHash(t *testing.T) {
+	clearTestDB()
+
+	token := GetPendingActionRepository().FindUnusedToken()
+	pa1 := &PendingAction{
+		ActionType: 1,
+		CreateDate: time.Now(),
+		ExpiryDate: time.Now().Add(time.Duration(time.Minute) * 1),
+		UserID:     primitive.NewObjectID(),
+		Payload:    "",
+		Token:      token,
+	}
+	GetPendingActionRepository().Create(pa1)
+
+	count, _ := GetPendingActionRepository().GetCollection().CountDocuments(context.TODO(), bson.M{"token": token})
+	if count != 0 {
+		t.Error("Expected plain text token not to be stored")
+	}
+	pa1 = GetPendingActionRepository().GetByToken(token)
+	if pa1 == nil {
+		t.Fatal("Expected pa1 not to be nil")
+	}
+	checkTestString(t, HashToken(token), pa1.TokenHash)
+}
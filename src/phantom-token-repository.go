@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// PhantomToken maps an opaque reference token handed out to clients to the claims of the access token it represents
+type PhantomToken struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Token      string             `json:"token" bson:"-"`
+	TokenHash  string             `json:"-" bson:"tokenHash"`
+	UserID     primitive.ObjectID `json:"userId" bson:"userId"`
+	Claims     string             `json:"-" bson:"claims"`
+	CreateDate time.Time          `json:"createDate" bson:"createDate"`
+	ExpiryDate time.Time          `json:"expiryDate" bson:"expiryDate"`
+}
+
+type phantomTokenCacheEntry struct {
+	Claims     string
+	ExpiryDate time.Time
+}
+
+// PhantomTokenRepository stores reference tokens in MongoDB.
+// Lookups are cached in-process for PhantomTokenCacheTTL seconds.
+type PhantomTokenRepository struct {
+	mutex sync.RWMutex
+	cache map[string]*phantomTokenCacheEntry
+}
+
+var _phantomTokenRepositoryInstance *PhantomTokenRepository
+var _phantomTokenRepositoryOnce sync.Once
+
+func GetPhantomTokenRepository() *PhantomTokenRepository {
+	_phantomTokenRepositoryOnce.Do(func() {
+		_phantomTokenRepositoryInstance = &PhantomTokenRepository{
+			cache: make(map[string]*phantomTokenCacheEntry),
+		}
+		GetDatatabase().MigrateTokenHashes(_phantomTokenRepositoryInstance.GetCollection())
+		_phantomTokenRepositoryInstance._MigrateJWTs()
+		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
+		// Create unique index on 'tokenHash'
+		mod := mongo.IndexModel{
+			Keys: bson.M{
+				"tokenHash": 1,
+			},
+			Options: options.Index().SetUnique(true),
+		}
+		_, err := _phantomTokenRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return _phantomTokenRepositoryInstance
+}
+
+func (r *PhantomTokenRepository) GetCollection() *mongo.Collection {
+	return GetDatatabase().Database.Collection("phantom_tokens")
+}
+
+// Create stores a new reference token for the access token claims.
+// Only the claims are stored, a JWT is signed when the request is forwarded upstream.
+func (r *PhantomTokenRepository) Create(claims *Claims) (*PhantomToken, error) {
+	token, err := GenerateRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	e := &PhantomToken{
+		Token:      token,
+		TokenHash:  HashToken(token),
+		UserID:     GetDatatabase().GetObjectID(claims.UserID),
+		Claims:     string(claimsJSON),
+		CreateDate: time.Now(),
+		ExpiryDate: time.Unix(claims.ExpiresAt, 0),
+	}
+	res, err := r.GetCollection().InsertOne(context.TODO(), e)
+	if err != nil {
+		return nil, err
+	}
+	e.ID = res.InsertedID.(primitive.ObjectID)
+	return e, nil
+}
+
+// GetClaims returns the claims of the access token the reference token represents or nil if it is unknown or expired
+func (r *PhantomTokenRepository) GetClaims(token string) *Claims {
+	r.mutex.RLock()
+	e, ok := r.cache[token]
+	r.mutex.RUnlock()
+	if ok && e.ExpiryDate.After(time.Now()) {
+		return r._DecodeClaims(e.Claims)
+	}
+	var phantomToken PhantomToken
+	err := r.GetCollection().FindOne(context.TODO(), bson.M{"tokenHash": HashToken(token)}).Decode(&phantomToken)
+	if err != nil || phantomToken.ExpiryDate.Before(time.Now()) {
+		return nil
+	}
+	expiryDate := time.Now().Add(GetConfig().PhantomTokenCacheTTL * time.Second)
+	if phantomToken.ExpiryDate.Before(expiryDate) {
+		expiryDate = phantomToken.ExpiryDate
+	}
+	r.mutex.Lock()
+	r.cache[token] = &phantomTokenCacheEntry{
+		Claims:     phantomToken.Claims,
+		ExpiryDate: expiryDate,
+	}
+	r.mutex.Unlock()
+	return r._DecodeClaims(phantomToken.Claims)
+}
+
+// _DecodeClaims returns a new Claims struct for every lookup, so callers can't modify cached claims
+func (r *PhantomTokenRepository) _DecodeClaims(claimsJSON string) *Claims {
+	claims := &Claims{}
+	if err := json.Unmarshal([]byte(claimsJSON), claims); err != nil {
+		log.Println("Could not decode reference token claims:", err)
+		return nil
+	}
+	return claims
+}
+
+// _MigrateJWTs replaces the signed access tokens stored by previous versions in the 'jwt' field with their claims,
+// as anyone with read access to the database could otherwise use them as bearer tokens
+func (r *PhantomTokenRepository) _MigrateJWTs() {
+	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+	cur, err := r.GetCollection().Find(ctx, bson.M{"jwt": bson.M{"$exists": true}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cur.Close(ctx)
+	count := 0
+	for cur.Next(ctx) {
+		var doc struct {
+			ID  primitive.ObjectID `bson:"_id"`
+			JWT string             `bson:"jwt"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			log.Fatal(err)
+		}
+		update := bson.M{"$unset": bson.M{"jwt": ""}}
+		claims := &Claims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(doc.JWT, claims); err == nil {
+			claimsJSON, _ := json.Marshal(claims)
+			update["$set"] = bson.M{"claims": string(claimsJSON)}
+		}
+		if _, err := r.GetCollection().UpdateOne(ctx, bson.M{"_id": doc.ID}, update); err != nil {
+			log.Fatal(err)
+		}
+		count++
+	}
+	if count > 0 {
+		log.Println("Migrated", count, "reference tokens to stored claims")
+	}
+}
+
+// CleanUp removes the expired reference tokens from the database and the cache
+func (r *PhantomTokenRepository) CleanUp() {
+	_, err := r.GetCollection().DeleteMany(context.TODO(), bson.M{"expiryDate": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		log.Println(err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for token, e := range r.cache {
+		if e.ExpiryDate.Before(time.Now()) {
+			delete(r.cache, token)
+		}
+	}
+}
+
+// IsReferenceToken checks if the token is an opaque reference token rather than a JWT
+func IsReferenceToken(token string) bool {
+	return !strings.Contains(token, ".")
+}
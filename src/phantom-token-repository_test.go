@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func setupPhantomTokenTest() func() {
+	GetConfig().PhantomTokenEnable = true
+	return func() {
+		GetConfig().PhantomTokenEnable = false
+	}
+}
+
+func TestPhantomTokenLogin(t *testing.T) {
+	defer setupPhantomTokenTest()()
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	checkStringNotEmpty(t, loginResponse.AccessToken)
+	if !IsReferenceToken(loginResponse.AccessToken) || strings.Contains(loginResponse.AccessToken, user.ID.Hex()) {
+		t.Fatal("Expected opaque reference token")
+	}
+	req := newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	introspection, _ := introspectToken(loginResponse.AccessToken, "")
+	if !introspection.Active {
+		t.Fatal("Expected reference token to be active")
+	}
+	checkTestString(t, user.ID.Hex(), introspection.Subject)
+
+	req = newHTTPRequest("GET", "/auth/ping", "unknown", nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	// Signed JWTs are only sent upstream and rejected from clients
+	jwt, _ := SignAccessToken(NewAccessTokenClaims(user, 5))
+	req = newHTTPRequest("GET", "/auth/ping", jwt, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestPhantomTokenLogout(t *testing.T) {
+	defer setupPhantomTokenTest()()
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+
+	payload := `{"refreshToken": "` + loginResponse.RefreshToken + `"}`
+	req := newHTTPRequest("POST", "/auth/logout", loginResponse.AccessToken, bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	// Cached reference tokens are rejected as well
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestPhantomTokenProxy(t *testing.T) {
+	defer setupPhantomTokenTest()()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	req := newHTTPRequest("GET", "/some/route/test.html", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	authHeader := handler.Headers.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		t.Fatal("Expected Authorization: Bearer [...] header")
+	}
+	claims, err := ParseAccessToken(strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		t.Fatal("Expected upstream to receive a valid JWT, got error", err)
+	}
+	checkTestString(t, user.ID.Hex(), claims.UserID)
+	checkTestString(t, "foo@bar.com", claims.Email)
+}
+
+func TestPhantomTokenCleanUp(t *testing.T) {
+	defer setupPhantomTokenTest()()
+	clearTestDB()
+	claims := NewClaims("subject", -1)
+	phantomToken, err := GetPhantomTokenRepository().Create(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetPhantomTokenRepository().GetClaims(phantomToken.Token) != nil {
+		t.Error("Expected expired reference token not to be resolved")
+	}
+	GetPhantomTokenRepository().CleanUp()
+	count, _ := GetPhantomTokenRepository().GetCollection().CountDocuments(context.TODO(), bson.M{})
+	if count != 0 {
+		t.Error("Expected expired reference token to be deleted")
+	}
+}
+
+func TestPhantomTokenStoredHashed(t *testing.T) {
+	defer setupPhantomTokenTest()()
+	clearTestDB()
+	claims := NewClaims("subject", 1)
+	phantomToken, err := GetPhantomTokenRepository().Create(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc bson.M
+	GetPhantomTokenRepository().GetCollection().FindOne(context.TODO(), bson.M{"_id": phantomToken.ID}).Decode(&doc)
+	if _, ok := doc["token"]; ok {
+		t.Error("Expected plain text reference token not to be stored")
+	}
+	if _, ok := doc["jwt"]; ok {
+		t.Error("Expected no signed access token to be stored")
+	}
+	checkTestString(t, HashToken(phantomToken.Token), doc["tokenHash"].(string))
+	checkTestString(t, "subject", GetPhantomTokenRepository().GetClaims(phantomToken.Token).Subject)
+}
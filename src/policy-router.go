@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// PolicyRouter handles the backend requests for reloading and debugging the policy
+type PolicyRouter struct {
+}
+
+func (router *PolicyRouter) setupRoutes(s *mux.Router) {
+	s.HandleFunc("/reload", router.reload).Methods("POST")
+	s.HandleFunc("/evaluate", router.evaluate).Methods("POST")
+}
+
+// reload reads POLICY_FILE again
+func (router *PolicyRouter) reload(w http.ResponseWriter, r *http.Request) {
+	if GetConfig().PolicyFile == "" {
+		SendNotFound(w)
+		return
+	}
+	if err := ReloadPolicy(); err != nil {
+		log.Println("Could not reload policy:", err)
+		SendBadRequest(w)
+		return
+	}
+	SendUpdated(w)
+}
+
+// evaluate returns the policy's decision for a hypothetical request,
+// authenticated by the access token claims of the given user or the given claims (if any)
+func (router *PolicyRouter) evaluate(w http.ResponseWriter, r *http.Request) {
+	policy := GetPolicy()
+	if policy == nil {
+		SendNotFound(w)
+		return
+	}
+	var data PolicyEvaluationRequest
+	if UnmarshalValidateBody(r, &data) != nil {
+		SendBadRequest(w)
+		return
+	}
+	u, err := url.ParseRequestURI(data.Path)
+	if err != nil {
+		SendBadRequest(w)
+		return
+	}
+	req := &PolicyRequest{
+		Method:   strings.ToUpper(data.Method),
+		Host:     strings.ToLower(data.Host),
+		Path:     u.Path,
+		RemoteIP: data.RemoteIP,
+		Header:   make(http.Header),
+		Query:    u.Query(),
+	}
+	for name, value := range data.Headers {
+		req.Header.Set(name, value)
+	}
+	if data.UserID != "" {
+		user := GetUserRepository().GetOne(data.UserID)
+		if user == nil {
+			SendNotFound(w)
+			return
+		}
+		req.Claims = NewAccessTokenClaims(user, GetConfig().AccessTokenLifetime)
+	} else if data.Claims != nil {
+		b, _ := json.Marshal(data.Claims)
+		req.Claims = &Claims{}
+		if err := json.Unmarshal(b, req.Claims); err != nil {
+			SendBadRequest(w)
+			return
+		}
+	}
+	SendJSON(w, policy.Evaluate(req))
+}
+
+// PolicyEvaluationRequest describes a hypothetical proxied request.
+// Path may contain a query string.
+type PolicyEvaluationRequest struct {
+	Method   string                 `json:"method" validate:"required"`
+	Host     string                 `json:"host"`
+	Path     string                 `json:"path" validate:"required"`
+	Headers  map[string]string      `json:"headers"`
+	RemoteIP string                 `json:"remoteIp"`
+	UserID   string                 `json:"userId"`
+	Claims   map[string]interface{} `json:"claims"`
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	policyEffectAllow = "allow"
+	policyEffectDeny  = "deny"
+)
+
+// Policy decides about proxied requests. Rules are evaluated in order, the first matching rule's effect applies.
+// If no rule matches, the default effect applies.
+type Policy struct {
+	Default string        `yaml:"default"`
+	Rules   []*PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule matches requests by host, method and path (all optional), requiring authentication
+// and conditions over the request's attributes (if any)
+type PolicyRule struct {
+	Name          string             `yaml:"name"`
+	Hosts         []string           `yaml:"hosts"`
+	Methods       []string           `yaml:"methods"`
+	Paths         []string           `yaml:"paths"`
+	PathRegex     string             `yaml:"pathRegex"`
+	Authenticated bool               `yaml:"authenticated"`
+	Conditions    []*PolicyCondition `yaml:"conditions"`
+	Effect        string             `yaml:"effect"`
+	hostPatterns  []*regexp.Regexp
+	pathPatterns  []*regexp.Regexp
+	pathRegexp    *regexp.Regexp
+}
+
+// PolicyCondition compares an attribute of the request with exactly one operator.
+// Attributes are 'claims.<path>', 'user.<source>' (as in JWT_CLAIM_MAPPING), 'request.method', 'request.host',
+// 'request.path', 'request.remoteIp', 'request.header.<name>' and 'request.query.<name>'.
+type PolicyCondition struct {
+	Attribute     string        `yaml:"attribute"`
+	Equals        interface{}   `yaml:"equals"`
+	NotEquals     interface{}   `yaml:"notEquals"`
+	In            []interface{} `yaml:"in"`
+	Contains      interface{}   `yaml:"contains"`
+	Matches       string        `yaml:"matches"`
+	Exists        *bool         `yaml:"exists"`
+	matchesRegexp *regexp.Regexp
+}
+
+// PolicyRequest holds the attributes of a (possibly hypothetical) request the policy is evaluated for
+type PolicyRequest struct {
+	Method     string
+	Host       string
+	Path       string
+	RemoteIP   string
+	Header     http.Header
+	Query      url.Values
+	Claims     *Claims
+	claimsMap  map[string]interface{}
+	user       *User
+	userLoaded bool
+}
+
+// PolicyDecision is the result of a policy evaluation. Rule is 'default' if no rule matched.
+// Status is the response status of denied requests: 401 if unauthenticated, 403 otherwise.
+type PolicyDecision struct {
+	Effect string `json:"effect"`
+	Rule   string `json:"rule,omitempty"`
+	Status int    `json:"status"`
+}
+
+var _policyInstance *Policy
+var _policyMutex sync.RWMutex
+
+// GetPolicy returns the active policy or nil if POLICY_FILE is not set
+func GetPolicy() *Policy {
+	_policyMutex.RLock()
+	defer _policyMutex.RUnlock()
+	return _policyInstance
+}
+
+// SetPolicy replaces the active policy
+func SetPolicy(p *Policy) {
+	_policyMutex.Lock()
+	defer _policyMutex.Unlock()
+	_policyInstance = p
+}
+
+// ReloadPolicy reads POLICY_FILE. If the file is invalid, the active policy is kept.
+func ReloadPolicy() error {
+	if GetConfig().PolicyFile == "" {
+		return nil
+	}
+	policy, err := LoadPolicy(GetConfig().PolicyFile)
+	if err != nil {
+		return err
+	}
+	SetPolicy(policy)
+	log.Println("Loaded policy with", len(policy.Rules), "rules from", GetConfig().PolicyFile)
+	return nil
+}
+
+// LoadPolicy reads and validates a YAML policy file
+func LoadPolicy(fileName string) (*Policy, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(b)
+}
+
+// ParsePolicy parses and validates a YAML policy. Unknown fields are rejected.
+func ParsePolicy(b []byte) (*Policy, error) {
+	var policy Policy
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, errors.New("Invalid policy: " + err.Error())
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (p *Policy) Validate() error {
+	if !isValidPolicyEffect(p.Default) {
+		return errors.New("Policy default must be 'allow' or 'deny'")
+	}
+	for i, rule := range p.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("Invalid policy rule %s: %v", rule.DisplayName(i), err)
+		}
+	}
+	return nil
+}
+
+func (rule *PolicyRule) Validate() error {
+	if !isValidPolicyEffect(rule.Effect) {
+		return errors.New("effect must be 'allow' or 'deny'")
+	}
+	for i, method := range rule.Methods {
+		rule.Methods[i] = strings.ToUpper(method)
+	}
+	rule.hostPatterns = make([]*regexp.Regexp, 0)
+	for _, host := range rule.Hosts {
+		re, err := globToRegexp(strings.ToLower(host), '.')
+		if err != nil {
+			return err
+		}
+		rule.hostPatterns = append(rule.hostPatterns, re)
+	}
+	rule.pathPatterns = make([]*regexp.Regexp, 0)
+	for _, path := range rule.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return errors.New("path must start with '/': " + path)
+		}
+		re, err := globToRegexp(path, '/')
+		if err != nil {
+			return err
+		}
+		rule.pathPatterns = append(rule.pathPatterns, re)
+	}
+	if rule.PathRegex != "" {
+		re, err := regexp.Compile(rule.PathRegex)
+		if err != nil {
+			return err
+		}
+		rule.pathRegexp = re
+	}
+	for _, c := range rule.Conditions {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *PolicyCondition) Validate() error {
+	if !isValidPolicyAttribute(c.Attribute) {
+		return errors.New("invalid condition attribute: " + c.Attribute)
+	}
+	operators := 0
+	for _, set := range []bool{c.Equals != nil, c.NotEquals != nil, c.In != nil, c.Contains != nil, c.Matches != "", c.Exists != nil} {
+		if set {
+			operators++
+		}
+	}
+	if operators != 1 {
+		return errors.New("condition on " + c.Attribute + " must have exactly one operator")
+	}
+	if c.Matches != "" {
+		re, err := regexp.Compile(c.Matches)
+		if err != nil {
+			return err
+		}
+		c.matchesRegexp = re
+	}
+	return nil
+}
+
+func isValidPolicyEffect(effect string) bool {
+	return effect == policyEffectAllow || effect == policyEffectDeny
+}
+
+func isValidPolicyAttribute(attribute string) bool {
+	switch attribute {
+	case "request.method", "request.host", "request.path", "request.remoteIp":
+		return true
+	}
+	for _, prefix := range []string{"request.header.", "request.query."} {
+		if strings.HasPrefix(attribute, prefix) {
+			return len(attribute) > len(prefix)
+		}
+	}
+	if strings.HasPrefix(attribute, "user.") {
+		return IsValidUserSource(strings.TrimPrefix(attribute, "user."))
+	}
+	if strings.HasPrefix(attribute, "claims.") {
+		path := strings.TrimPrefix(attribute, "claims.")
+		return path != "" && !strings.Contains(path, "..") && !strings.HasPrefix(path, ".") && !strings.HasSuffix(path, ".")
+	}
+	return false
+}
+
+// globToRegexp converts a glob pattern into an anchored regular expression:
+// '**' matches any characters, '*' any characters except the separator, '?' a single character except the separator
+func globToRegexp(glob string, separator byte) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	notSeparator := "[^" + regexp.QuoteMeta(string(separator)) + "]"
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			sb.WriteString(notSeparator + "*")
+		case glob[i] == '?':
+			sb.WriteString(notSeparator)
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// DisplayName returns the rule's name or its position within the policy
+func (rule *PolicyRule) DisplayName(index int) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("#%d", index+1)
+}
+
+// Evaluate returns the decision of the first rule matching the request or the default decision
+func (p *Policy) Evaluate(req *PolicyRequest) *PolicyDecision {
+	res := &PolicyDecision{Effect: p.Default, Rule: "default"}
+	for i, rule := range p.Rules {
+		if rule.Matches(req) {
+			res = &PolicyDecision{Effect: rule.Effect, Rule: rule.DisplayName(i)}
+			break
+		}
+	}
+	switch {
+	case res.Effect == policyEffectAllow:
+		res.Status = http.StatusOK
+	case req.Claims == nil:
+		res.Status = http.StatusUnauthorized
+	default:
+		res.Status = http.StatusForbidden
+	}
+	return res
+}
+
+// Matches checks if the request matches the rule's host, method and path and satisfies all of its conditions
+func (rule *PolicyRule) Matches(req *PolicyRequest) bool {
+	if len(rule.hostPatterns) > 0 && !matchesAnyRegexp(rule.hostPatterns, strings.ToLower(req.Host)) {
+		return false
+	}
+	if len(rule.Methods) > 0 && !ContainsScope(rule.Methods, req.Method) {
+		return false
+	}
+	if len(rule.pathPatterns) > 0 && !matchesAnyRegexp(rule.pathPatterns, req.Path) {
+		return false
+	}
+	if rule.pathRegexp != nil && !rule.pathRegexp.MatchString(req.Path) {
+		return false
+	}
+	if rule.Authenticated && req.Claims == nil {
+		return false
+	}
+	for _, c := range rule.Conditions {
+		if !c.Holds(req) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAnyRegexp(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Holds checks if the condition is satisfied by the request.
+// Conditions on attributes which are not set only hold for 'exists: false'.
+func (c *PolicyCondition) Holds(req *PolicyRequest) bool {
+	value := req.Resolve(c.Attribute)
+	if c.Exists != nil {
+		return (value != nil) == *c.Exists
+	}
+	if value == nil {
+		return false
+	}
+	switch {
+	case c.Equals != nil:
+		return isEqualPolicyValue(value, c.Equals)
+	case c.NotEquals != nil:
+		return !isEqualPolicyValue(value, c.NotEquals)
+	case c.In != nil:
+		for _, item := range c.In {
+			if isEqualPolicyValue(value, item) {
+				return true
+			}
+		}
+		return false
+	case c.Contains != nil:
+		list, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, item := range list {
+			if isEqualPolicyValue(item, c.Contains) {
+				return true
+			}
+		}
+		return false
+	case c.matchesRegexp != nil:
+		return c.matchesRegexp.MatchString(FormatHeaderValue(value))
+	}
+	return false
+}
+
+// isEqualPolicyValue compares values by their string representation, so numbers and booleans
+// from the YAML policy match their JSON counterparts in claims
+func isEqualPolicyValue(a, b interface{}) bool {
+	return FormatHeaderValue(a) == FormatHeaderValue(b)
+}
+
+// NewPolicyRequest returns the policy attributes of the request, authenticated by the claims (if any)
+func NewPolicyRequest(r *http.Request, claims *Claims) *PolicyRequest {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return &PolicyRequest{
+		Method:   r.Method,
+		Host:     host,
+		Path:     GetRequestPath(r),
+		RemoteIP: GetRemoteIP(r),
+		Header:   r.Header,
+		Query:    r.URL.Query(),
+		Claims:   claims,
+	}
+}
+
+// Resolve returns the value of the attribute or nil if it is not set.
+// The user is only loaded if the attribute refers to a user attribute.
+func (req *PolicyRequest) Resolve(attribute string) interface{} {
+	switch attribute {
+	case "request.method":
+		return req.Method
+	case "request.host":
+		return req.Host
+	case "request.path":
+		return req.Path
+	case "request.remoteIp":
+		return req.RemoteIP
+	}
+	switch {
+	case strings.HasPrefix(attribute, "request.header."):
+		values := req.Header[http.CanonicalHeaderKey(strings.TrimPrefix(attribute, "request.header."))]
+		if len(values) == 0 {
+			return nil
+		}
+		return values[0]
+	case strings.HasPrefix(attribute, "request.query."):
+		values := req.Query[strings.TrimPrefix(attribute, "request.query.")]
+		if len(values) == 0 {
+			return nil
+		}
+		return values[0]
+	case strings.HasPrefix(attribute, "claims."):
+		if req.Claims == nil {
+			return nil
+		}
+		if req.claimsMap == nil {
+			req.claimsMap = ClaimsToMap(req.Claims)
+		}
+		return (&HeaderMapping{Source: strings.TrimPrefix(attribute, "claims.")}).Resolve(req.claimsMap, nil)
+	case strings.HasPrefix(attribute, "user."):
+		if !req.userLoaded && req.Claims != nil && req.Claims.UserID != "" {
+			req.user = GetUserRepository().GetOne(req.Claims.UserID)
+			req.userLoaded = true
+		}
+		return (&HeaderMapping{Source: attribute}).Resolve(nil, req.user)
+	}
+	return nil
+}
+
+// PolicyMiddleware rejects proxied requests denied by the policy with 403,
+// or with 401 if the request is not authenticated
+func PolicyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := GetPolicy()
+		if policy == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		decision := policy.Evaluate(NewPolicyRequest(r, GetClaimsFromContext(r)))
+		if decision.Effect == policyEffectAllow {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Println("Policy rule", decision.Rule, "denied", r.Method, r.URL.RequestURI(), "for UserID", GetUserIDFromContext(r))
+		if decision.Status == http.StatusUnauthorized {
+			SendUnauthorized(w)
+			return
+		}
+		SendForbidden(w)
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const testPolicy = `
+default: deny
+rules:
+  - name: public-read
+    methods: [GET, HEAD]
+    paths: ["/some/route/articles/**"]
+    effect: allow
+  - name: confirmed-write
+    methods: [POST]
+    paths: ["/some/route/articles/**"]
+    conditions:
+      - attribute: user.confirmed
+        equals: true
+    effect: allow
+  - name: pro-plan
+    pathRegex: "^/some/route/pro/[a-z]+\\.html$"
+    conditions:
+      - attribute: user.data.plan
+        in: [pro, enterprise]
+    effect: allow
+  - name: internal
+    hosts: ["*.internal.example.com"]
+    authenticated: true
+    conditions:
+      - attribute: request.header.X-Tenant
+        matches: "^[a-z]+$"
+      - attribute: claims.roles
+        contains: admin
+    effect: allow
+`
+
+func setupPolicyTest(t *testing.T) func() {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetPolicy(policy)
+	return func() {
+		SetPolicy(nil)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestInt(t, 4, len(policy.Rules))
+	checkTestString(t, "deny", policy.Default)
+
+	invalid := []string{
+		"rules: []",
+		"default: maybe",
+		"default: deny\nrules:\n  - effect: permit",
+		"default: deny\nrules:\n  - effect: allow\n    path: [/x]",
+		"default: deny\nrules:\n  - effect: allow\n    paths: [x]",
+		"default: deny\nrules:\n  - effect: allow\n    pathRegex: '['",
+		"default: deny\nrules:\n  - effect: allow\n    conditions:\n      - attribute: password\n        exists: true",
+		"default: deny\nrules:\n  - effect: allow\n    conditions:\n      - attribute: claims.email\n        equals: a\n        notEquals: b",
+		"default: deny\nrules:\n  - effect: allow\n    conditions:\n      - attribute: claims.email",
+	}
+	for _, s := range invalid {
+		if _, err := ParsePolicy([]byte(s)); err == nil {
+			t.Errorf("Expected error for policy '%s'", s)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	re, _ := globToRegexp("/api/*/items/**", '/')
+	for _, s := range []string{"/api/v1/items/", "/api/v1/items/1/details"} {
+		if !re.MatchString(s) {
+			t.Errorf("Expected glob to match '%s'", s)
+		}
+	}
+	for _, s := range []string{"/api/v1/v2/items/1", "/api/v1/items", "/apix/v1/items/1"} {
+		if re.MatchString(s) {
+			t.Errorf("Expected glob not to match '%s'", s)
+		}
+	}
+	re, _ = globToRegexp("*.example.com", '.')
+	if !re.MatchString("api.example.com") || re.MatchString("a.b.example.com") {
+		t.Error("Expected host glob to match a single label")
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, _ := ParsePolicy([]byte(testPolicy))
+	admin := &Claims{UserID: "123", Roles: []string{"admin"}}
+	tests := []struct {
+		req    *PolicyRequest
+		rule   string
+		status int
+	}{
+		{&PolicyRequest{Method: "GET", Path: "/some/route/articles/1"}, "public-read", http.StatusOK},
+		{&PolicyRequest{Method: "POST", Path: "/some/route/articles/1"}, "default", http.StatusUnauthorized},
+		{&PolicyRequest{Method: "GET", Host: "app.internal.example.com", Path: "/", Header: http.Header{"X-Tenant": {"acme"}}, Claims: admin}, "internal", http.StatusOK},
+		{&PolicyRequest{Method: "GET", Host: "app.internal.example.com", Path: "/", Header: http.Header{"X-Tenant": {"ACME"}}, Claims: admin}, "default", http.StatusForbidden},
+		{&PolicyRequest{Method: "GET", Host: "app.internal.example.com", Path: "/", Header: http.Header{"X-Tenant": {"acme"}}, Claims: &Claims{UserID: "123"}}, "default", http.StatusForbidden},
+		{&PolicyRequest{Method: "GET", Host: "app.example.com", Path: "/", Header: http.Header{"X-Tenant": {"acme"}}, Claims: admin}, "default", http.StatusForbidden},
+	}
+	for i, test := range tests {
+		decision := policy.Evaluate(test.req)
+		if decision.Rule != test.rule || decision.Status != test.status {
+			t.Errorf("Expected request #%d to be decided by rule %s with status %d, got %s with %d", i, test.rule, test.status, decision.Rule, decision.Status)
+		}
+	}
+}
+
+func TestPolicyProxy(t *testing.T) {
+	defer setupPolicyTest(t)()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	user := GetUserRepository().GetByEmail("foo@bar.com")
+
+	req := newHTTPRequest("GET", "/some/route/articles/1", "", nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+
+	req = newHTTPRequest("POST", "/some/route/articles/1", "", nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	// Invalid tokens are rejected instead of being evaluated anonymously
+	req = newHTTPRequest("GET", "/some/route/articles/1", "invalid", nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	// Route scopes are enforced as without policy
+	GetConfig().RouteScopes, _ = ParseRouteScopes("POST /some/route/articles:articles.write")
+	req = newHTTPRequest("POST", "/some/route/articles/1", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	GetConfig().RouteScopes = make([]*RouteScope, 0)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+	checkTestString(t, `Bearer error="insufficient_scope", scope="articles.write"`, res.Header().Get("WWW-Authenticate"))
+
+	req = newHTTPRequest("POST", "/some/route/articles/1", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	checkTestString(t, user.ID.Hex(), handler.Headers.Get("X-Auth-UserID"))
+
+	req = newHTTPRequest("GET", "/some/route/pro/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+
+	payload := `{"plan": "pro"}`
+	req, _ = http.NewRequest("PUT", "/users/"+user.ID.Hex()+"/data", bytes.NewBufferString(payload))
+	executeBackendTestRequest(req)
+	req = newHTTPRequest("GET", "/some/route/pro/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+}
+
+func TestPolicyEvaluateEndpoint(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+
+	payload := `{"method": "GET", "path": "/some/route/articles/1"}`
+	req, _ := http.NewRequest("POST", "/policy/evaluate", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNotFound, res.Code)
+
+	defer setupPolicyTest(t)()
+	tests := map[string]string{
+		`{"method": "post", "path": "/some/route/articles/1?draft=1"}`:                            `{"effect":"deny","rule":"default","status":401}`,
+		`{"method": "post", "path": "/some/route/articles/1", "userId": "` + user.ID.Hex() + `"}`: `{"effect":"allow","rule":"confirmed-write","status":200}`,
+		`{"method": "get", "host": "app.internal.example.com", "path": "/", "headers": {"X-Tenant": "acme"}, ` +
+			`"claims": {"userID": "123", "roles": ["admin"]}}`: `{"effect":"allow","rule":"internal","status":200}`,
+	}
+	for payload, expected := range tests {
+		req, _ := http.NewRequest("POST", "/policy/evaluate", bytes.NewBufferString(payload))
+		res := executeBackendTestRequest(req)
+		checkTestResponseCode(t, http.StatusOK, res.Code)
+		var decision PolicyDecision
+		json.Unmarshal(res.Body.Bytes(), &decision)
+		b, _ := json.Marshal(decision)
+		checkTestString(t, expected, string(b))
+	}
+
+	req, _ = http.NewRequest("POST", "/policy/evaluate", bytes.NewBufferString(`{"method": "GET", "path": "relative"}`))
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadRequest, res.Code)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"net/http"
 	"strings"
 	"testing"
@@ -184,6 +186,73 @@ func TestProxySuccessWhitelistedSubPath(t *testing.T) {
 	checkTestResponseCode(t, http.StatusOK, res.Code)
 }
 
+func TestProxySignsIdentityHeaders(t *testing.T) {
+	GetConfig().UpstreamSigningEnable = true
+	GetUpstreamSigner().key, _ = NewSigningKey(SigningMethodEdDSA.Alg())
+	defer func() { GetConfig().UpstreamSigningEnable = false }()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	req := newHTTPRequest("GET", "/some/route/test.html?a=1", loginResponse.AccessToken, nil)
+	req.Header.Set("Signature", "proxy=:forged:")
+	res := executePublicTestRequest(req)
+
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	checkTestString(t, user.ID.Hex(), handler.Headers.Get("X-Auth-UserID"))
+	params := strings.TrimPrefix(handler.Headers.Get("Signature-Input"), "proxy=")
+	if !strings.HasPrefix(params, `("@method" "@path" "@query" "x-auth-userid");created=`) {
+		t.Fatal("Expected signature to cover method, path, query and X-Auth-UserID, got", params)
+	}
+	signature := strings.TrimSuffix(strings.TrimPrefix(handler.Headers.Get("Signature"), "proxy=:"), ":")
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		t.Fatal("Expected base64 encoded signature")
+	}
+	upstreamReq := newHTTPRequest("GET", "/some/route/test.html?a=1", "", nil)
+	upstreamReq.Header = handler.Headers
+	base := BuildSignatureBase(upstreamReq, []string{"@method", "@path", "@query", "x-auth-userid"}, params)
+	if !ed25519.Verify(GetUpstreamSigner().key.PublicKey.(ed25519.PublicKey), []byte(base), sig) {
+		t.Error("Expected valid signature")
+	}
+}
+
+func TestProxyUnsignedRequestRejected(t *testing.T) {
+	GetConfig().UpstreamSigningEnable = true
+	key := GetUpstreamSigner().key
+	GetUpstreamSigner().key = nil
+	defer func() {
+		GetConfig().UpstreamSigningEnable = false
+		GetUpstreamSigner().key = key
+	}()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	req := newHTTPRequest("GET", "/some/whitelist/test.html", "", nil)
+	res := executePublicTestRequest(req)
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusBadGateway, res.Code)
+	if handler.Headers != nil {
+		t.Error("Expected request not to be forwarded")
+	}
+}
+
 type dummyProxyHandler struct {
 	Headers http.Header
 }
@@ -191,3 +260,31 @@ type dummyProxyHandler struct {
 func (h *dummyProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.Headers = r.Header
 }
+
+func TestProxySuccessWithClientToken(t *testing.T) {
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	credentials := createTestServiceClient(t, `{"name": "Cron", "scopes": [], "enabled": true}`)
+	tokenResponse, _ := requestClientToken(credentials, "")
+
+	req := newHTTPRequest("GET", "/some/route/test.html", tokenResponse.AccessToken, nil)
+	req.Header.Set("X-Auth-UserID", "FAKE")
+	res := executePublicTestRequest(req)
+
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	if handler.Headers.Get("X-Auth-ClientID") != credentials.ClientID {
+		t.Error("Expected X-Auth-ClientID header to match actual Client ID")
+	}
+	if handler.Headers.Get("X-Auth-UserID") != "" {
+		t.Error("Expected empty X-Auth-UserID header, got: " + handler.Headers.Get("X-Auth-UserID"))
+	}
+}
@@ -10,16 +10,102 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-
-	guuid "github.com/google/uuid"
 )
 
 type RefreshToken struct {
-	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	UserID     primitive.ObjectID `json:"userId" bson:"userId"`
-	Token      string             `json:"token" bson:"token"`
-	CreateDate time.Time          `json:"createDate" bson:"createDate"`
-	ExpiryDate time.Time          `json:"expiryDate" bson:"expiryDate"`
+	ID                primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID            primitive.ObjectID `json:"userId" bson:"userId"`
+	FamilyID          primitive.ObjectID `json:"familyId" bson:"familyId,omitempty"`
+	Token             string             `json:"token" bson:"-"`
+	TokenHash         string             `json:"-" bson:"tokenHash"`
+	Consumed          bool               `json:"consumed" bson:"consumed"`
+	CreateDate        time.Time          `json:"createDate" bson:"createDate"`
+	ExpiryDate        time.Time          `json:"expiryDate" bson:"expiryDate"`
+	ConsumedDate      time.Time          `json:"consumedDate" bson:"consumedDate,omitempty"`
+	SessionCreateDate time.Time          `json:"sessionCreateDate" bson:"sessionCreateDate,omitempty"`
+	LastUsedDate      time.Time          `json:"lastUsedDate" bson:"lastUsedDate,omitempty"`
+	IPAddress         string             `json:"ipAddress" bson:"ipAddress,omitempty"`
+	UserAgent         string             `json:"userAgent" bson:"userAgent,omitempty"`
+	JWKThumbprint     string             `json:"jkt,omitempty" bson:"jkt,omitempty"`
+	Sliding           bool               `json:"sliding" bson:"sliding,omitempty"`
+	MaxExpiryDate     time.Time          `json:"maxExpiryDate,omitempty" bson:"maxExpiryDate,omitempty"`
+	IdleTimeout       int                `json:"idleTimeout,omitempty" bson:"idleTimeout,omitempty"`
+	Scope             string             `json:"scope,omitempty" bson:"scope,omitempty"`
+	AuthMethods       []string           `json:"amr,omitempty" bson:"amr,omitempty"`
+	Profile           string             `json:"profile,omitempty" bson:"profile,omitempty"`
+	Lifetime          int                `json:"lifetime,omitempty" bson:"lifetime,omitempty"`
+}
+
+// Session describes a login session, represented by the unconsumed refresh token of a token family
+type Session struct {
+	ID           string    `json:"id"`
+	IPAddress    string    `json:"ipAddress"`
+	UserAgent    string    `json:"userAgent"`
+	CreateDate   time.Time `json:"createDate"`
+	LastUsedDate time.Time `json:"lastUsedDate"`
+	ExpiryDate   time.Time `json:"expiryDate"`
+	Profile      string    `json:"profile,omitempty"`
+	Current      bool      `json:"current"`
+}
+
+// GetFamilyID returns the ID of the token family (i.e. the login session) the token belongs to.
+// Tokens created before the introduction of token families form a family of their own.
+func (t *RefreshToken) GetFamilyID() primitive.ObjectID {
+	if t.FamilyID.IsZero() {
+		return t.ID
+	}
+	return t.FamilyID
+}
+
+// GetSession returns the session the token belongs to
+func (t *RefreshToken) GetSession() *Session {
+	s := &Session{
+		ID:           t.GetFamilyID().Hex(),
+		IPAddress:    t.IPAddress,
+		UserAgent:    t.UserAgent,
+		CreateDate:   t.SessionCreateDate,
+		LastUsedDate: t.LastUsedDate,
+		ExpiryDate:   t.ExpiryDate,
+		Profile:      t.Profile,
+	}
+	if s.CreateDate.IsZero() {
+		s.CreateDate = t.CreateDate
+	}
+	if s.LastUsedDate.IsZero() {
+		s.LastUsedDate = t.CreateDate
+	}
+	return s
+}
+
+// NextExpiryDate returns the expiry date of a token issued at now within the token's session:
+// the refresh token lifetime of the session's profile (if the session is new or sliding),
+// limited by the session's maximum age and idle timeout
+func (t *RefreshToken) NextExpiryDate(now time.Time) time.Time {
+	res := t.ExpiryDate
+	if res.IsZero() || t.Sliding {
+		lifetime := GetConfig().RefreshTokenLifetime
+		if t.Lifetime > 0 {
+			lifetime = time.Duration(t.Lifetime)
+		}
+		res = now.Add(time.Duration(time.Minute) * lifetime)
+	}
+	if !t.MaxExpiryDate.IsZero() && t.MaxExpiryDate.Before(res) {
+		res = t.MaxExpiryDate
+	}
+	if t.IdleTimeout > 0 && now.Add(time.Duration(t.IdleTimeout)*time.Minute).Before(res) {
+		res = now.Add(time.Duration(t.IdleTimeout) * time.Minute)
+	}
+	return res
+}
+
+// IsBeyondMaxAge checks if the token's session has exceeded its absolute maximum age
+func (t *RefreshToken) IsBeyondMaxAge(now time.Time) bool {
+	return !t.MaxExpiryDate.IsZero() && t.MaxExpiryDate.Before(now)
+}
+
+// IsIdle checks if the token's session has not been used within its idle timeout
+func (t *RefreshToken) IsIdle(now time.Time) bool {
+	return t.IdleTimeout > 0 && t.GetSession().LastUsedDate.Add(time.Duration(t.IdleTimeout)*time.Minute).Before(now)
 }
 
 type RefreshTokenRepository struct {
@@ -31,11 +117,12 @@ var _refreshTokenRepositoryOnce sync.Once
 func GetRefreshTokenRepository() *RefreshTokenRepository {
 	_refreshTokenRepositoryOnce.Do(func() {
 		_refreshTokenRepositoryInstance = &RefreshTokenRepository{}
+		GetDatatabase().MigrateTokenHashes(_refreshTokenRepositoryInstance.GetCollection())
 		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
-		// Create unique index on 'token'
+		// Create unique index on 'tokenHash'
 		mod := mongo.IndexModel{
 			Keys: bson.M{
-				"token": 1,
+				"tokenHash": 1,
 			},
 			Options: options.Index().SetUnique(true),
 		}
@@ -43,6 +130,17 @@ func GetRefreshTokenRepository() *RefreshTokenRepository {
 		if err != nil {
 			log.Fatal(err)
 		}
+		// Create non-unique index on 'familyId'
+		mod = mongo.IndexModel{
+			Keys: bson.M{
+				"familyId": 1,
+			},
+			Options: options.Index().SetUnique(false),
+		}
+		_, err = _refreshTokenRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
 	})
 	return _refreshTokenRepositoryInstance
 }
@@ -52,6 +150,7 @@ func (r *RefreshTokenRepository) GetCollection() *mongo.Collection {
 }
 
 func (r *RefreshTokenRepository) Create(u *RefreshToken) {
+	u.TokenHash = HashToken(u.Token)
 	res, err := r.GetCollection().InsertOne(context.TODO(), u)
 	if err != nil {
 		log.Println(err)
@@ -74,7 +173,7 @@ func (r *RefreshTokenRepository) GetOne(id string) *RefreshToken {
 
 func (r *RefreshTokenRepository) GetByToken(token string) *RefreshToken {
 	var refreshToken RefreshToken
-	err := r.GetCollection().FindOne(context.TODO(), bson.M{"token": token}).Decode(&refreshToken)
+	err := r.GetCollection().FindOne(context.TODO(), bson.M{"tokenHash": HashToken(token)}).Decode(&refreshToken)
 	if err != nil {
 		return nil
 	}
@@ -82,6 +181,7 @@ func (r *RefreshTokenRepository) GetByToken(token string) *RefreshToken {
 		r.Delete(&refreshToken)
 		return nil
 	}
+	refreshToken.Token = token
 	return &refreshToken
 }
 
@@ -92,6 +192,114 @@ func (r *RefreshTokenRepository) DeleteAllForUser(userID string) {
 	}
 }
 
+// GetSessionsForUser returns the user's active sessions, most recently used first
+func (r *RefreshTokenRepository) GetSessionsForUser(userID string) []*Session {
+	results := make([]*Session, 0)
+	filter := bson.M{
+		"userId":     GetDatatabase().GetObjectID(userID),
+		"consumed":   bson.M{"$ne": true},
+		"expiryDate": bson.M{"$gt": time.Now()},
+	}
+	cur, err := r.GetCollection().Find(context.TODO(), filter, options.Find().SetSort(bson.M{"createDate": -1}))
+	if err != nil {
+		log.Println(err)
+		return results
+	}
+	for cur.Next(context.TODO()) {
+		var refreshToken RefreshToken
+		if err := cur.Decode(&refreshToken); err != nil {
+			return results
+		}
+		results = append(results, refreshToken.GetSession())
+	}
+	cur.Close(context.TODO())
+	return results
+}
+
+// DeleteSession deletes all tokens of the user's session.
+// Returns false if the user has no such session.
+func (r *RefreshTokenRepository) DeleteSession(userID string, sessionID string) bool {
+	familyID := GetDatatabase().GetObjectID(sessionID)
+	if familyID.IsZero() {
+		return false
+	}
+	res, err := r.GetCollection().DeleteMany(context.TODO(), bson.M{
+		"userId": GetDatatabase().GetObjectID(userID),
+		"$or": bson.A{
+			bson.M{"familyId": familyID},
+			bson.M{"_id": familyID},
+		},
+	})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return res.DeletedCount > 0
+}
+
+// DeleteOtherSessions deletes all tokens of the user not belonging to the given session
+func (r *RefreshTokenRepository) DeleteOtherSessions(userID string, sessionID string) {
+	familyID := GetDatatabase().GetObjectID(sessionID)
+	_, err := r.GetCollection().DeleteMany(context.TODO(), bson.M{
+		"userId":   GetDatatabase().GetObjectID(userID),
+		"familyId": bson.M{"$ne": familyID},
+		"_id":      bson.M{"$ne": familyID},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// DeleteExcessSessions deletes the user's oldest sessions of the given profile exceeding max active sessions
+func (r *RefreshTokenRepository) DeleteExcessSessions(userID string, profile string, max int) {
+	filter := bson.M{
+		"userId":     GetDatatabase().GetObjectID(userID),
+		"profile":    profile,
+		"consumed":   bson.M{"$ne": true},
+		"expiryDate": bson.M{"$gt": time.Now()},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "sessionCreateDate", Value: -1}, {Key: "createDate", Value: -1}}).SetSkip(int64(max))
+	cur, err := r.GetCollection().Find(context.TODO(), filter, opts)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for cur.Next(context.TODO()) {
+		var refreshToken RefreshToken
+		if err := cur.Decode(&refreshToken); err != nil {
+			break
+		}
+		log.Println("Revoking session", refreshToken.GetFamilyID().Hex(), "for UserID", userID, "exceeding", max, "sessions of profile", profile)
+		r.DeleteFamily(refreshToken.GetFamilyID())
+	}
+	cur.Close(context.TODO())
+}
+
+// MarkConsumed flags the token as used.
+// Returns false if the token has already been consumed before, or an error if the database update failed.
+func (r *RefreshTokenRepository) MarkConsumed(u *RefreshToken) (bool, error) {
+	res, err := r.GetCollection().UpdateOne(context.TODO(), bson.M{"_id": u.ID, "consumed": bson.M{"$ne": true}}, bson.M{"$set": bson.M{
+		"consumed":     true,
+		"consumedDate": time.Now(),
+	}})
+	if err != nil {
+		log.Println(err)
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// DeleteFamily deletes all tokens belonging to the given token family
+func (r *RefreshTokenRepository) DeleteFamily(familyID primitive.ObjectID) {
+	_, err := r.GetCollection().DeleteMany(context.TODO(), bson.M{"$or": bson.A{
+		bson.M{"familyId": familyID},
+		bson.M{"_id": familyID},
+	}})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func (r *RefreshTokenRepository) Delete(u *RefreshToken) {
 	_, err := r.GetCollection().DeleteOne(context.TODO(), bson.M{"_id": u.ID})
 	if err != nil {
@@ -102,8 +310,8 @@ func (r *RefreshTokenRepository) Delete(u *RefreshToken) {
 func (r *RefreshTokenRepository) FindUnusedToken() string {
 	var token string = ""
 	for i := 1; i <= 20 && token == ""; i++ {
-		token = guuid.New().String()
-		if r.GetByToken(token) != nil {
+		token, _ = GenerateRandomToken()
+		if token != "" && r.GetByToken(token) != nil {
 			token = ""
 		}
 	}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -107,3 +109,162 @@ func TestRefreshTokenGetByTokenExpired(t *testing.T) {
 		t.Error("Expected t1 to be nil")
 	}
 }
+
+func TestRefreshTokenMarkConsumed(t *testing.T) {
+	clearTestDB()
+
+	t1 := &RefreshToken{
+		CreateDate: time.Now(),
+		ExpiryDate: time.Now().Add(time.Duration(time.Minute) * 1),
+		UserID:     primitive.NewObjectID(),
+		FamilyID:   primitive.NewObjectID(),
+		Token:      GetRefreshTokenRepository().FindUnusedToken(),
+	}
+	GetRefreshTokenRepository().Create(t1)
+
+	if ok, err := GetRefreshTokenRepository().MarkConsumed(t1); !ok || err != nil {
+		t.Error("Expected first MarkConsumed to succeed")
+	}
+	if ok, err := GetRefreshTokenRepository().MarkConsumed(t1); ok || err != nil {
+		t.Error("Expected second MarkConsumed to fail without error")
+	}
+	t1 = GetRefreshTokenRepository().GetOne(t1.ID.Hex())
+	if !t1.Consumed {
+		t.Error("Expected t1 to be consumed")
+	}
+}
+
+func TestRefreshTokenDeleteFamily(t *testing.T) {
+	clearTestDB()
+
+	familyID := primitive.NewObjectID()
+	t1 := &RefreshToken{
+		CreateDate: time.Now(),
+		ExpiryDate: time.Now().Add(time.Duration(time.Minute) * 1),
+		UserID:     primitive.NewObjectID(),
+		FamilyID:   familyID,
+		Token:      GetRefreshTokenRepository().FindUnusedToken(),
+	}
+	GetRefreshTokenRepository().Create(t1)
+	t2 := &RefreshToken{
+		CreateDate: time.Now(),
+		ExpiryDate: time.Now().Add(time.Duration(time.Minute) * 1),
+		UserID:     t1.UserID,
+		FamilyID:   familyID,
+		Token:      GetRefreshTokenRepository().FindUnusedToken(),
+	}
+	GetRefreshTokenRepository().Create(t2)
+	t3 := &RefreshToken{
+		CreateDate: time.Now(),
+		ExpiryDate: time.Now().Add(time.Duration(time.Minute) * 1),
+		UserID:     t1.UserID,
+		FamilyID:   primitive.NewObjectID(),
+		Token:      GetRefreshTokenRepository().FindUnusedToken(),
+	}
+	GetRefreshTokenRepository().Create(t3)
+
+	GetRefreshTokenRepository().DeleteFamily(familyID)
+
+	if GetRefreshTokenRepository().GetOne(t1.ID.Hex()) != nil || GetRefreshTokenRepository().GetOne(t2.ID.Hex()) != nil {
+		t.Error("Expected t1 and t2 to be deleted")
+	}
+	if GetRefreshTokenRepository().GetOne(t3.ID.Hex()) == nil {
+		t.Error("Expected t3 not to be deleted")
+	}
+}
+
+func TestRefreshTokenNextExpiryDate(t *testing.T) {
+	now := time.Now()
+	lifetime := time.Duration(time.Minute) * GetConfig().RefreshTokenLifetime
+
+	fixed := &RefreshToken{ExpiryDate: now.Add(time.Minute)}
+	if !fixed.NextExpiryDate(now).Equal(now.Add(time.Minute)) {
+		t.Error("Expected fixed expiry date to be kept")
+	}
+	sliding := &RefreshToken{ExpiryDate: now.Add(time.Minute), Sliding: true}
+	if !sliding.NextExpiryDate(now).Equal(now.Add(lifetime)) {
+		t.Error("Expected sliding expiry date to be extended by the refresh token lifetime")
+	}
+	sliding.MaxExpiryDate = now.Add(time.Hour)
+	if !sliding.NextExpiryDate(now).Equal(now.Add(time.Hour)) {
+		t.Error("Expected sliding expiry date to be limited by the maximum session age")
+	}
+	sliding.IdleTimeout = 10
+	if !sliding.NextExpiryDate(now).Equal(now.Add(10 * time.Minute)) {
+		t.Error("Expected expiry date to be limited by the idle timeout")
+	}
+}
+
+func TestRefreshTokenIsIdle(t *testing.T) {
+	now := time.Now()
+	token := &RefreshToken{CreateDate: now.Add(-time.Hour), LastUsedDate: now.Add(-20 * time.Minute)}
+	if token.IsIdle(now) {
+		t.Error("Expected token without idle timeout not to be idle")
+	}
+	token.IdleTimeout = 30
+	if token.IsIdle(now) {
+		t.Error("Expected token used within idle timeout not to be idle")
+	}
+	token.IdleTimeout = 10
+	if !token.IsIdle(now) {
+		t.Error("Expected token not used within idle timeout to be idle")
+	}
+	if token.IsBeyondMaxAge(now) {
+		t.Error("Expected token without maximum age not to be beyond maximum age")
+	}
+	token.MaxExpiryDate = now.Add(-time.Minute)
+	if !token.IsBeyondMaxAge(now) {
+		t.Error("Expected token to be beyond maximum age")
+	}
+}
+
+func TestRefreshTokenStoredAsHash(t *testing.T) {
+	clearTestDB()
+
+	token := GetRefreshTokenRepository().FindUnusedToken()
+	if len(token) != 43 {
+		t.Fatalf("Expected 256 bit base64url token, got '%s'", token)
+	}
+	t1 := &RefreshToken{
+		CreateDate: time.Now(),
+		ExpiryDate: time.Now().Add(time.Duration(time.Minute) * 1),
+		UserID:     primitive.NewObjectID(),
+		Token:      token,
+	}
+	GetRefreshTokenRepository().Create(t1)
+
+	var doc bson.M
+	GetRefreshTokenRepository().GetCollection().FindOne(context.TODO(), bson.M{"_id": t1.ID}).Decode(&doc)
+	if _, ok := doc["token"]; ok {
+		t.Error("Expected plain text token not to be stored")
+	}
+	checkTestString(t, HashToken(token), doc["tokenHash"].(string))
+	checkTestString(t, token, GetRefreshTokenRepository().GetByToken(token).Token)
+}
+
+func TestRefreshTokenMigrateTokenHashes(t *testing.T) {
+	clearTestDB()
+
+	col := GetRefreshTokenRepository().GetCollection()
+	col.InsertOne(context.TODO(), bson.M{
+		"userId":     primitive.NewObjectID(),
+		"token":      "5f3c6a2e-8f6b-4a51-9c1e-2b7d0e9a4c11",
+		"createDate": time.Now(),
+		"expiryDate": time.Now().Add(time.Minute),
+	})
+	col.InsertOne(context.TODO(), bson.M{
+		"userId":     primitive.NewObjectID(),
+		"token":      "0b8e4d7a-1c2f-4e9b-8a3d-6f5c2e1b9d07",
+		"createDate": time.Now(),
+		"expiryDate": time.Now().Add(time.Minute),
+	})
+	GetDatatabase().MigrateTokenHashes(col)
+
+	if GetRefreshTokenRepository().GetByToken("5f3c6a2e-8f6b-4a51-9c1e-2b7d0e9a4c11") == nil {
+		t.Error("Expected migrated token to be found")
+	}
+	count, _ := col.CountDocuments(context.TODO(), bson.M{"token": bson.M{"$exists": true}})
+	if count != 0 {
+		t.Error("Expected plain text tokens to be removed")
+	}
+}
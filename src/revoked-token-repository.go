@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RevokedToken holds a denylist entry for either a single access token (identified by its 'jti' claim)
+// or all access tokens of a user or service client issued before RevokeBefore
+type RevokedToken struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	TokenID      string             `json:"jti,omitempty" bson:"jti,omitempty"`
+	UserID       primitive.ObjectID `json:"userId" bson:"userId"`
+	ClientID     string             `json:"clientId,omitempty" bson:"clientId,omitempty"`
+	RevokeBefore time.Time          `json:"revokeBefore,omitempty" bson:"revokeBefore,omitempty"`
+	ExpiryDate   time.Time          `json:"expiryDate" bson:"expiryDate"`
+}
+
+// RevokedTokenRepository stores revoked access tokens in MongoDB.
+// Lookups are served from an in-process cache which is synchronized with the database periodically.
+type RevokedTokenRepository struct {
+	mutex sync.RWMutex
+	cache *revokedTokenCache
+}
+
+// revokedTokenCache maps revoked token IDs (prefixed with the subject key, so an entry only matches tokens
+// of the user or client it was created for) to their expiry, and subject keys to the latest RevokeBefore and its expiry.
+// The subject key is the user ID or 'client:' + client ID.
+type revokedTokenCache struct {
+	tokens  map[string]time.Time
+	users   map[string]time.Time
+	userExp map[string]time.Time
+}
+
+var _revokedTokenRepositoryInstance *RevokedTokenRepository
+var _revokedTokenRepositoryOnce sync.Once
+
+func GetRevokedTokenRepository() *RevokedTokenRepository {
+	_revokedTokenRepositoryOnce.Do(func() {
+		_revokedTokenRepositoryInstance = &RevokedTokenRepository{
+			cache: newRevokedTokenCache(),
+		}
+		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
+		// Create non-unique index on 'jti'
+		mod := mongo.IndexModel{
+			Keys: bson.M{
+				"jti": 1,
+			},
+			Options: options.Index().SetUnique(false),
+		}
+		_, err := _revokedTokenRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_revokedTokenRepositoryInstance.SyncCache()
+	})
+	return _revokedTokenRepositoryInstance
+}
+
+func (r *RevokedTokenRepository) GetCollection() *mongo.Collection {
+	return GetDatatabase().Database.Collection("revoked_tokens")
+}
+
+// Create stores the denylist entry. Returns an error if it could not be stored, as nothing has been revoked then.
+func (r *RevokedTokenRepository) Create(u *RevokedToken) error {
+	res, err := r.GetCollection().InsertOne(context.TODO(), u)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	u.ID = res.InsertedID.(primitive.ObjectID)
+	r._AddToCache(u)
+	return nil
+}
+
+// RevokeToken adds a single access token to the denylist
+func (r *RevokedTokenRepository) RevokeToken(claims *Claims) error {
+	if claims.Id == "" {
+		return nil
+	}
+	log.Println("Revoking access token", claims.Id, "for UserID", claims.UserID, "ClientID", claims.ClientID)
+	e := &RevokedToken{
+		TokenID:    claims.Id,
+		UserID:     GetDatatabase().GetObjectID(claims.UserID),
+		ClientID:   claims.ClientID,
+		ExpiryDate: time.Unix(claims.ExpiresAt, 0),
+	}
+	return r.Create(e)
+}
+
+// RevokeAllForUser revokes all access tokens issued to the user until now
+func (r *RevokedTokenRepository) RevokeAllForUser(userID string) error {
+	log.Println("Revoking all access tokens for UserID", userID)
+	e := &RevokedToken{
+		UserID:       GetDatatabase().GetObjectID(userID),
+		RevokeBefore: time.Now(),
+		ExpiryDate:   time.Now().Add(time.Duration(time.Minute) * GetConfig().MaxAccessTokenLifetime()),
+	}
+	return r.Create(e)
+}
+
+// RevokeAllForClient revokes all access tokens issued to the service client until now
+func (r *RevokedTokenRepository) RevokeAllForClient(clientID string) error {
+	log.Println("Revoking all access tokens for ClientID", clientID)
+	e := &RevokedToken{
+		ClientID:     clientID,
+		RevokeBefore: time.Now(),
+		ExpiryDate:   time.Now().Add(time.Duration(time.Minute) * GetConfig().MaxAccessTokenLifetime()),
+	}
+	return r.Create(e)
+}
+
+// IsRevoked checks if the access token has been revoked.
+// As the 'iat' claim has a precision of whole seconds, revoking all tokens of a user or client also revokes
+// tokens issued within the same second after the revocation.
+func (r *RevokedTokenRepository) IsRevoked(claims *Claims) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	key := revokedTokenSubjectKey(claims.UserID, claims.ClientID)
+	if expiry, ok := r.cache.tokens[key+"/"+claims.Id]; ok && claims.Id != "" && expiry.After(time.Now()) {
+		return true
+	}
+	if revokeBefore, ok := r.cache.users[key]; ok && r.cache.userExp[key].After(time.Now()) {
+		if claims.IssuedAt <= revokeBefore.Unix() {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncCache replaces the in-process cache with the non-expired entries from the database.
+// The new cache is built completely before it is swapped in, so lookups never see a partially filled cache.
+// Entries added to the old cache in the meantime are kept.
+func (r *RevokedTokenRepository) SyncCache() {
+	cur, err := r.GetCollection().Find(context.TODO(), bson.M{"expiryDate": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var entries []*RevokedToken
+	for cur.Next(context.TODO()) {
+		var e RevokedToken
+		if err := cur.Decode(&e); err != nil {
+			log.Println(err)
+			break
+		}
+		entries = append(entries, &e)
+	}
+	cur.Close(context.TODO())
+	cache := newRevokedTokenCache()
+	for _, e := range entries {
+		cache.add(e)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cache.merge(r.cache)
+	r.cache = cache
+}
+
+func (r *RevokedTokenRepository) CleanUp() {
+	_, err := r.GetCollection().DeleteMany(context.TODO(), bson.M{"expiryDate": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *RevokedTokenRepository) _AddToCache(e *RevokedToken) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cache.add(e)
+}
+
+func newRevokedTokenCache() *revokedTokenCache {
+	return &revokedTokenCache{
+		tokens:  make(map[string]time.Time),
+		users:   make(map[string]time.Time),
+		userExp: make(map[string]time.Time),
+	}
+}
+
+func (c *revokedTokenCache) add(e *RevokedToken) {
+	userID := ""
+	if !e.UserID.IsZero() {
+		userID = e.UserID.Hex()
+	}
+	key := revokedTokenSubjectKey(userID, e.ClientID)
+	if e.TokenID != "" {
+		c.tokens[key+"/"+e.TokenID] = e.ExpiryDate
+		return
+	}
+	c._AddUser(key, e.RevokeBefore, e.ExpiryDate)
+}
+
+func revokedTokenSubjectKey(userID, clientID string) string {
+	if clientID != "" {
+		return "client:" + clientID
+	}
+	return userID
+}
+
+// merge adds the non-expired entries of the other cache
+func (c *revokedTokenCache) merge(other *revokedTokenCache) {
+	now := time.Now()
+	for id, expiry := range other.tokens {
+		if expiry.After(now) && expiry.After(c.tokens[id]) {
+			c.tokens[id] = expiry
+		}
+	}
+	for key, revokeBefore := range other.users {
+		if other.userExp[key].After(now) {
+			c._AddUser(key, revokeBefore, other.userExp[key])
+		}
+	}
+}
+
+func (c *revokedTokenCache) _AddUser(key string, revokeBefore, expiry time.Time) {
+	if revokeBefore.After(c.users[key]) {
+		c.users[key] = revokeBefore
+	}
+	if expiry.After(c.userExp[key]) {
+		c.userExp[key] = expiry
+	}
+}
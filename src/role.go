@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// groupPrefix marks the entries of an access rule referring to groups instead of roles
+const groupPrefix = "group:"
+
+var roleNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// AccessRule allows proxied requests matching PathPrefix and Methods only for users with one of Roles.
+// Entries prefixed with 'group:' refer to the user's groups.
+type AccessRule struct {
+	Methods    []string
+	PathPrefix string
+	Roles      []string
+}
+
+// IsValidRoleName checks if the name can be used as a role or group
+func IsValidRoleName(name string) bool {
+	return roleNameRegexp.MatchString(name)
+}
+
+// ParseAccessRules parses a comma-separated list of '[METHOD[|METHOD...] ]prefix:role [role...]' entries,
+// e.g. 'GET /admin:admin support,POST|PUT|DELETE /admin:admin,/reports:group:finance'.
+// Entries without methods apply to all methods.
+func ParseAccessRules(s string) ([]*AccessRule, error) {
+	res := make([]*AccessRule, 0)
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid access rule: " + entry)
+		}
+		methods, prefix, ok := ParseRoute(parts[0])
+		roles := strings.Fields(parts[1])
+		if !ok || len(roles) == 0 {
+			return nil, errors.New("Invalid access rule: " + entry)
+		}
+		for _, role := range roles {
+			if !IsValidRoleName(strings.TrimPrefix(role, groupPrefix)) {
+				return nil, errors.New("Invalid role in access rule: " + role)
+			}
+		}
+		res = append(res, &AccessRule{
+			Methods:    methods,
+			PathPrefix: prefix,
+			Roles:      roles,
+		})
+	}
+	return res, nil
+}
+
+// ParseRoleMigrations parses a comma-separated list of 'source:roles' or 'source:groups' pairs of former claim mappings,
+// e.g. 'data.roles:roles,data.teams:groups'. Sources must be paths within the user's custom data.
+func ParseRoleMigrations(s string) ([]*ClaimMapping, error) {
+	res := make([]*ClaimMapping, 0)
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid role migration: " + pair)
+		}
+		m := &ClaimMapping{
+			Source: strings.TrimSpace(parts[0]),
+			Claim:  strings.TrimSpace(parts[1]),
+		}
+		if !strings.HasPrefix(m.Source, "data.") || !IsValidUserSource(m.Source) || (m.Claim != "roles" && m.Claim != "groups") {
+			return nil, errors.New("Invalid role migration: " + pair)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// MigrateRoleData adds the role and group names found in the users' custom data to their roles and groups.
+// Values which are not valid role names are skipped. The custom data is left unchanged.
+func MigrateRoleData(migrations []*ClaimMapping) error {
+	for _, m := range migrations {
+		users, err := GetUserRepository().GetWithData(m.Source)
+		if err != nil {
+			return err
+		}
+		log.Println("Migrating", m.Claim, "of", len(users), "users from", m.Source)
+		for _, user := range users {
+			var names []interface{}
+			switch value := m.Resolve(user).(type) {
+			case []interface{}:
+				names = value
+			case string:
+				names = []interface{}{value}
+			}
+			for _, name := range names {
+				s, ok := name.(string)
+				if !ok || !IsValidRoleName(s) {
+					log.Println("Skipping invalid", m.Claim, "value", name, "of UserID", user.ID.Hex())
+					continue
+				}
+				if m.Claim == "groups" {
+					GetUserRepository().AddGroup(user, s)
+				} else {
+					GetUserRepository().AddRole(user, s)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Matches checks if the access rule applies to the request
+func (rule *AccessRule) Matches(r *http.Request) bool {
+	return IsRouteMatch(r, rule.Methods, rule.PathPrefix)
+}
+
+// Allows checks if the claims contain one of the rule's roles or groups
+func (rule *AccessRule) Allows(claims *Claims) bool {
+	for _, role := range rule.Roles {
+		if strings.HasPrefix(role, groupPrefix) {
+			if ContainsScope(claims.Groups, strings.TrimPrefix(role, groupPrefix)) {
+				return true
+			}
+		} else if ContainsScope(claims.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAccessAllowed checks if the claims satisfy all access rules matching the request
+func IsAccessAllowed(r *http.Request, claims *Claims) bool {
+	for _, rule := range GetConfig().AccessRules {
+		if rule.Matches(r) && (claims == nil || !rule.Allows(claims)) {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessRuleMiddleware rejects proxied requests denied by the access rules with 403,
+// or with 401 if the request is not authenticated
+func AccessRuleMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := GetClaimsFromContext(r)
+		if IsAccessAllowed(r, claims) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if claims == nil {
+			log.Println("Denying unauthenticated access to", r.Method, r.URL.RequestURI())
+			SendUnauthorized(w)
+			return
+		}
+		log.Println("Denying access to", r.Method, r.URL.RequestURI(), "for UserID", claims.UserID, "ClientID", claims.ClientID)
+		SendForbidden(w)
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func setupAccessRuleTest() func() {
+	GetConfig().AccessRules, _ = ParseAccessRules("/some/route/admin:admin,GET /some/route/reports:group:finance admin")
+	return func() {
+		GetConfig().AccessRules = make([]*AccessRule, 0)
+	}
+}
+
+func TestParseAccessRules(t *testing.T) {
+	rules, err := ParseAccessRules("GET|HEAD /admin:admin support, /reports:group:finance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 access rules, got %d", len(rules))
+	}
+	checkTestString(t, "GET,HEAD", strings.Join(rules[0].Methods, ","))
+	checkTestString(t, "/admin", rules[0].PathPrefix)
+	checkTestString(t, "admin support", strings.Join(rules[0].Roles, " "))
+	checkTestString(t, "group:finance", strings.Join(rules[1].Roles, " "))
+
+	if !rules[1].Allows(&Claims{Groups: []string{"finance"}}) {
+		t.Error("Expected group rule to allow group member")
+	}
+	if rules[1].Allows(&Claims{Roles: []string{"finance"}}) {
+		t.Error("Expected group rule not to allow role of the same name")
+	}
+
+	for _, s := range []string{"/admin", "admin:admin", "/admin:", "GET POST /admin:admin", "/admin:ad/min", "/admin:group:"} {
+		if _, err := ParseAccessRules(s); err == nil {
+			t.Errorf("Expected error for access rule '%s'", s)
+		}
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+
+	for _, url := range []string{"/roles/admin", "/roles/support", "/roles/admin", "/groups/finance"} {
+		req := newHTTPRequest("PUT", "/users/"+user.ID.Hex()+url, "", nil)
+		res := executeBackendTestRequest(req)
+		checkTestResponseCode(t, http.StatusNoContent, res.Code)
+	}
+	user = GetUserRepository().GetOne(user.ID.Hex())
+	checkTestString(t, "admin support", strings.Join(user.Roles, " "))
+	checkTestString(t, "finance", strings.Join(user.Groups, " "))
+
+	loginResponse := loginUser("foo@bar.com", "12345678")
+	claims, err := ParseAccessToken(loginResponse.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, "admin support", strings.Join(claims.Roles, " "))
+	checkTestString(t, "finance", strings.Join(claims.Groups, " "))
+
+	req := newHTTPRequest("DELETE", "/users/"+user.ID.Hex()+"/roles/admin", "", nil)
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+	user = GetUserRepository().GetOne(user.ID.Hex())
+	checkTestString(t, "support", strings.Join(user.Roles, " "))
+
+	// Removed roles are not contained in refreshed tokens
+	loginResponse, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+	claims, _ = ParseAccessToken(loginResponse.AccessToken)
+	checkTestString(t, "support", strings.Join(claims.Roles, " "))
+
+	req = newHTTPRequest("PUT", "/users/"+user.ID.Hex()+"/roles/ad%20min", "", nil)
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadRequest, res.Code)
+
+	// Updating a stale user object doesn't undo concurrent role changes
+	stale := GetUserRepository().GetOne(user.ID.Hex())
+	req = newHTTPRequest("PUT", "/users/"+user.ID.Hex()+"/roles/editor", "", nil)
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+	stale.Enabled = false
+	GetUserRepository().Update(stale)
+	user = GetUserRepository().GetOne(user.ID.Hex())
+	checkTestString(t, "support editor", strings.Join(user.Roles, " "))
+}
+
+func TestRoleMigration(t *testing.T) {
+	migrations, err := ParseRoleMigrations("data.roles:roles, data.teams:groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"email:roles", "data.roles:plan", "data.roles", "data..x:roles"} {
+		if _, err := ParseRoleMigrations(s); err == nil {
+			t.Errorf("Expected error for role migration '%s'", s)
+		}
+	}
+
+	clearTestDB()
+	user := createTestUser(true)
+	payload := `{"roles": ["admin", "user", "in valid"], "teams": "finance"}`
+	req, _ := http.NewRequest("PUT", "/users/"+user.ID.Hex()+"/data", bytes.NewBufferString(payload))
+	executeBackendTestRequest(req)
+	GetUserRepository().AddRole(user, "support")
+
+	if err := MigrateRoleData(migrations); err != nil {
+		t.Fatal(err)
+	}
+	user = GetUserRepository().GetOne(user.ID.Hex())
+	checkTestString(t, "support admin user", strings.Join(user.Roles, " "))
+	checkTestString(t, "finance", strings.Join(user.Groups, " "))
+
+	loginResponse := loginUser("foo@bar.com", "12345678")
+	claims, _ := ParseAccessToken(loginResponse.AccessToken)
+	checkTestString(t, "support admin user", strings.Join(claims.Roles, " "))
+}
+
+func TestAccessRules(t *testing.T) {
+	defer setupAccessRuleTest()()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	user := GetUserRepository().GetByEmail("foo@bar.com")
+
+	req := newHTTPRequest("GET", "/some/route/test.html", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+
+	req = newHTTPRequest("GET", "/some/route/admin/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+
+	// Encoded paths are matched as the target server decodes them
+	req = newHTTPRequest("GET", "/some/route/%61dmin/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+
+	GetUserRepository().AddGroup(user, "finance")
+	loginResponse = loginUser("foo@bar.com", "12345678")
+	req = newHTTPRequest("GET", "/some/route/reports/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	req = newHTTPRequest("GET", "/some/route/admin/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+
+	GetUserRepository().AddRole(user, "admin")
+	loginResponse = loginUser("foo@bar.com", "12345678")
+	req = newHTTPRequest("POST", "/some/route/admin/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+}
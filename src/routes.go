@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"path"
 	"strings"
 
 	"github.com/dgrijalva/jwt-go"
@@ -30,7 +32,9 @@ func (c contextKey) String() string {
 
 var (
 	contextKeyUserID     = contextKey("UserID")
+	contextKeyClientID   = contextKey("ClientID")
 	contextKeyAuthHeader = contextKey("AuthHeader")
+	contextKeyClaims     = contextKey("Claims")
 )
 
 func SendNotFound(w http.ResponseWriter) {
@@ -45,6 +49,10 @@ func SendUnauthorized(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusUnauthorized)
 }
 
+func SendForbidden(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusForbidden)
+}
+
 func SendAleadyExists(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusConflict)
 }
@@ -54,6 +62,19 @@ func SendCreated(w http.ResponseWriter, id primitive.ObjectID) {
 	w.WriteHeader(http.StatusCreated)
 }
 
+func SendCreatedJSON(w http.ResponseWriter, id primitive.ObjectID, v interface{}) {
+	json, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		SendInternalServerError(w)
+		return
+	}
+	w.Header().Set("X-Object-ID", id.Hex())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
 func SendUpdated(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -73,6 +94,14 @@ func SendJSON(w http.ResponseWriter, v interface{}) {
 	w.Write(json)
 }
 
+// SendOAuthError sends an OAuth2 error response (RFC 6749, section 5.2)
+func SendOAuthError(w http.ResponseWriter, status int, errCode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&OAuthError{Error: errCode})
+}
+
 func UnmarshalBody(r *http.Request, o interface{}) error {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -105,6 +134,22 @@ func GetUserIDFromContext(r *http.Request) string {
 	return userID.(string)
 }
 
+func GetClientIDFromContext(r *http.Request) string {
+	clientID := r.Context().Value(contextKeyClientID)
+	if clientID == nil {
+		return ""
+	}
+	return clientID.(string)
+}
+
+func GetClaimsFromContext(r *http.Request) *Claims {
+	claims := r.Context().Value(contextKeyClaims)
+	if claims == nil {
+		return nil
+	}
+	return claims.(*Claims)
+}
+
 func GetAuthHeaderFromContext(r *http.Request) string {
 	authHeader := r.Context().Value(contextKeyAuthHeader)
 	if authHeader == nil {
@@ -113,9 +158,24 @@ func GetAuthHeaderFromContext(r *http.Request) string {
 	return authHeader.(string)
 }
 
+// GetRemoteIP returns the IP address of the client without the port
+func GetRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func SetCorsHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", GetConfig().CorsOrigin)
 	w.Header().Set("Access-Control-Allow-Headers", GetConfig().CorsHeaders)
+	if GetConfig().EnableCookies && GetConfig().CorsOrigin != "*" {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if GetConfig().DPoPNonceEnable {
+		w.Header().Set("Access-Control-Expose-Headers", dpopNonceHeader)
+	}
 }
 
 func CorsMiddleware(next http.Handler) http.Handler {
@@ -127,47 +187,137 @@ func CorsMiddleware(next http.Handler) http.Handler {
 
 func ExtractClaimsFromRequest(r *http.Request) (*Claims, string, error) {
 	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" && IsCookieAuthenticated(r) {
+		authHeader = "Bearer " + GetCookieValue(r, GetConfig().CookieAccessTokenName)
+	}
 	if authHeader == "" {
 		return nil, "", errors.New("JWT header verification failed: missing auth header")
 	}
-	if !strings.HasPrefix(authHeader, "Bearer ") {
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		authHeader = strings.TrimPrefix(authHeader, "Bearer ")
+	} else if GetConfig().DPoPEnable && strings.HasPrefix(authHeader, "DPoP ") {
+		authHeader = strings.TrimPrefix(authHeader, "DPoP ")
+	} else {
 		return nil, "", errors.New("JWT header verification failed: invalid auth header")
 	}
-	authHeader = strings.TrimPrefix(authHeader, "Bearer ")
+	claims, err := ResolveAccessToken(authHeader)
+	if err != nil {
+		return nil, "", errors.New("JWT header verification failed: " + err.Error())
+	}
+	if claims.ClientID != "" {
+		log.Println("Successfully verified JWT header for ClientID", claims.ClientID)
+	} else {
+		log.Println("Successfully verified JWT header for UserID", claims.UserID)
+	}
+	return claims, authHeader, nil
+}
+
+// ResolveAccessToken looks up the claims represented by a reference token in phantom token mode
+// and returns the access token's claims. Tokens of external issuers are verified with the issuer's keys.
+// In phantom token mode, JWTs signed by this service are not accepted from clients.
+func ResolveAccessToken(tokenString string) (*Claims, error) {
+	if issuer := GetExternalIssuer(tokenString); issuer != nil {
+		return issuer.ParseToken(tokenString)
+	}
+	if GetConfig().PhantomTokenEnable {
+		if !IsReferenceToken(tokenString) {
+			return nil, errors.New("JWT access tokens are not accepted in phantom token mode")
+		}
+		claims := GetPhantomTokenRepository().GetClaims(tokenString)
+		if claims == nil {
+			return nil, errors.New("unknown reference token")
+		}
+		if err := ValidateAccessTokenClaims(claims); err != nil {
+			return nil, err
+		}
+		return claims, nil
+	}
+	return ParseAccessToken(tokenString)
+}
+
+// ParseAccessToken verifies the signature, expiry and revocation state of an access token and returns its claims
+func ParseAccessToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(authHeader, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := GetKeyring().GetVerificationKey(kid)
+		if key == nil {
+			return nil, fmt.Errorf("Unknown key ID: %v", kid)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(GetConfig().JwtSigningKey), nil
+		return key.PublicKey, nil
 	})
 	if err != nil {
-		return nil, "", errors.New("JWT header verification failed: parsing JWT failed with: " + err.Error())
+		return nil, errors.New("parsing JWT failed with: " + err.Error())
 	}
 	if !token.Valid {
-		return nil, "", errors.New("JWT header verification failed: invalid JWT")
+		return nil, errors.New("invalid JWT")
 	}
-	log.Println("Successfully verified JWT header for UserID", claims.UserID)
-	return claims, authHeader, nil
+	if err := ValidateAccessTokenClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
 }
 
-func VerifyJwtMiddleware(next http.Handler) http.Handler {
-	var isWhitelistMatch = func(url string, whitelistedURL string) bool {
-		whitelistedURL = strings.TrimSpace(whitelistedURL)
-		if strings.HasSuffix(whitelistedURL, "/") {
-			whitelistedURL = whitelistedURL[:len(whitelistedURL)-1]
-		}
-		if whitelistedURL != "" && (url == whitelistedURL || strings.HasPrefix(url, whitelistedURL+"/")) {
-			return true
-		}
-		return false
+// ValidateAccessTokenClaims checks the expiry, issuer, audience and revocation state of verified access token claims
+func ValidateAccessTokenClaims(claims *Claims) error {
+	if err := claims.Valid(); err != nil {
+		return err
+	}
+	if claims.Issuer != GetConfig().JwtIssuer {
+		return fmt.Errorf("invalid issuer: %v", claims.Issuer)
+	}
+	// Tokens issued to OIDC clients carry the client as their audience instead of JWT_AUDIENCE
+	if !claims.Audience.ContainsAny(GetConfig().JwtAudience) && (claims.AuthorizedParty == "" || !claims.Audience.Contains(claims.AuthorizedParty)) {
+		return errors.New("invalid audience")
+	}
+	if claims.Subject == "" || claims.IssuedAt == 0 || claims.NotBefore == 0 || claims.ExpiresAt == 0 {
+		return errors.New("missing registered claims")
+	}
+	if GetRevokedTokenRepository().IsRevoked(claims) {
+		return errors.New("token has been revoked")
 	}
+	if claims.UserID != "" && GetTokenVersionCache().Get(claims.UserID) != claims.TokenVersion {
+		return errors.New("token version is stale")
+	}
+	return nil
+}
+
+// IsCookieAuthenticated checks if the request is authenticated by the access token cookie instead of the Authorization header
+func IsCookieAuthenticated(r *http.Request) bool {
+	return GetConfig().EnableCookies && r.Header.Get("Authorization") == "" && GetCookieValue(r, GetConfig().CookieAccessTokenName) != ""
+}
+
+// IsPathPrefixMatch checks if the URL equals the prefix or is located below it
+func IsPathPrefixMatch(url string, prefix string) bool {
+	prefix = strings.TrimSpace(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		prefix = prefix[:len(prefix)-1]
+	}
+	if prefix != "" && (url == prefix || strings.HasPrefix(url, prefix+"/") || strings.HasPrefix(url, prefix+"?")) {
+		return true
+	}
+	return false
+}
 
+// GetRequestPath returns the decoded and cleaned path of the request, as the target server will interpret it.
+// Route matching must not use the escaped request URI, as e.g. '/%61dmin' would not match the prefix '/admin'.
+func GetRequestPath(r *http.Request) string {
+	res := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && res != "/" {
+		res += "/"
+	}
+	return res
+}
+
+func VerifyJwtMiddleware(next http.Handler) http.Handler {
 	var IsWhitelisted = func(r *http.Request) bool {
-		url := r.URL.RequestURI()
+		url := GetRequestPath(r)
 		// Check for whitelisted public API paths
 		for _, whitelistedURL := range unauthorizedRoutes {
-			if isWhitelistMatch(url, whitelistedURL) {
+			if IsPathPrefixMatch(url, whitelistedURL) {
 				return true
 			}
 		}
@@ -175,10 +325,15 @@ func VerifyJwtMiddleware(next http.Handler) http.Handler {
 		if strings.HasPrefix(url, GetConfig().PublicAPIPath) {
 			return false
 		}
+		// Policy Mode: Requests without credentials are evaluated anonymously by the policy,
+		// requests with credentials are rejected if the token is invalid or fails the route requirements
+		if GetPolicy() != nil {
+			return r.Header.Get("Authorization") == "" && !IsCookieAuthenticated(r)
+		}
 		// Whitelist Mode: Check is URL is whitelisted, else assume auth token is required
 		if len(GetConfig().ProxyWhitelist) > 0 {
 			for _, whitelistedURL := range GetConfig().ProxyWhitelist {
-				if isWhitelistMatch(url, whitelistedURL) {
+				if IsPathPrefixMatch(url, whitelistedURL) {
 					return true
 				}
 			}
@@ -186,22 +341,44 @@ func VerifyJwtMiddleware(next http.Handler) http.Handler {
 		}
 		// Blacklist Mode: Check is URL is blacklisted, else assume auth token is NOT required
 		for _, blacklistedURL := range GetConfig().ProxyBlacklist {
-			if isWhitelistMatch(url, blacklistedURL) {
+			if IsPathPrefixMatch(url, blacklistedURL) {
 				return false
 			}
 		}
 		return true
 	}
 
+	// Service client, impersonation and external tokens are only accepted for proxied requests,
+	// the public API is reserved for users acting on their own behalf with tokens issued by the proxy
+	var IsDelegatedTokenForPublicAPI = func(r *http.Request, claims *Claims) bool {
+		return (claims.ClientID != "" || claims.Actor != nil || IsExternalToken(claims)) && strings.HasPrefix(GetRequestPath(r), GetConfig().PublicAPIPath)
+	}
+
+	// OIDC client tokens are only accepted by the userinfo endpoint
+	var IsOIDCTokenOutsideUserInfo = func(r *http.Request, claims *Claims) bool {
+		return IsOIDCAccessToken(claims) && !IsUserInfoRequest(r)
+	}
+
+	// State-changing requests authenticated by cookie require a matching CSRF header
+	var IsCSRFSafe = func(r *http.Request) bool {
+		return !IsCookieAuthenticated(r) || !IsStateChangingMethod(r.Method) || IsValidCSRFRequest(r)
+	}
+
+	var WithClaims = func(r *http.Request, claims *Claims, authHeader string) *http.Request {
+		ctx := context.WithValue(r.Context(), contextKeyUserID, claims.UserID)
+		ctx = context.WithValue(ctx, contextKeyClientID, claims.ClientID)
+		ctx = context.WithValue(ctx, contextKeyAuthHeader, authHeader)
+		ctx = context.WithValue(ctx, contextKeyClaims, claims)
+		return r.WithContext(ctx)
+	}
+
 	var HandleWhitelistReq = func(w http.ResponseWriter, r *http.Request) {
 		claims, authHeader, err := ExtractClaimsFromRequest(r)
-		if err != nil {
+		if err != nil || IsDelegatedTokenForPublicAPI(r, claims) || IsOIDCTokenOutsideUserInfo(r, claims) || !HasRequiredAudiences(GetRequestPath(r), claims) || !HasRequiredScopes(r, claims) || !HasRecentAuthentication(GetRequestPath(r), claims) || !IsCSRFSafe(r) || VerifyDPoPRequest(r, claims, authHeader) != nil {
 			next.ServeHTTP(w, r)
 			return
 		}
-		ctx := context.WithValue(r.Context(), contextKeyUserID, claims.UserID)
-		ctx = context.WithValue(ctx, contextKeyAuthHeader, authHeader)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, WithClaims(r, claims, authHeader))
 	}
 
 	var HandleNonWhitelistReq = func(w http.ResponseWriter, r *http.Request) {
@@ -211,9 +388,42 @@ func VerifyJwtMiddleware(next http.Handler) http.Handler {
 			SendUnauthorized(w)
 			return
 		}
-		ctx := context.WithValue(r.Context(), contextKeyUserID, claims.UserID)
-		ctx = context.WithValue(ctx, contextKeyAuthHeader, authHeader)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		if IsDelegatedTokenForPublicAPI(r, claims) {
+			log.Println("Rejecting service client, impersonation or external token for public API request from UserID", claims.UserID, "ClientID", claims.ClientID)
+			SendUnauthorized(w)
+			return
+		}
+		if IsOIDCTokenOutsideUserInfo(r, claims) {
+			log.Println("Rejecting OIDC client token outside the userinfo endpoint from UserID", claims.UserID, "for client", claims.AuthorizedParty)
+			SendUnauthorized(w)
+			return
+		}
+		if !HasRequiredAudiences(GetRequestPath(r), claims) {
+			log.Println("Rejecting token without required audience for", r.URL.RequestURI())
+			SendUnauthorized(w)
+			return
+		}
+		if !IsCSRFSafe(r) {
+			log.Println("Rejecting cookie authenticated request with invalid CSRF token for UserID", claims.UserID)
+			SendForbidden(w)
+			return
+		}
+		if err := VerifyDPoPRequest(r, claims, authHeader); err != nil {
+			log.Println("Rejecting request with invalid DPoP proof for UserID", claims.UserID, "ClientID", claims.ClientID, "-", err)
+			SendDPoPError(w, err)
+			return
+		}
+		if !HasRequiredScopes(r, claims) {
+			log.Println("Rejecting token without required scope for", r.Method, r.URL.RequestURI())
+			SendInsufficientScope(w, r)
+			return
+		}
+		if !HasRecentAuthentication(GetRequestPath(r), claims) {
+			log.Println("Rejecting token without recent authentication for", r.Method, r.URL.RequestURI(), "from UserID", claims.UserID)
+			SendStepUpRequired(w, r)
+			return
+		}
+		next.ServeHTTP(w, WithClaims(r, claims, authHeader))
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -247,9 +457,33 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	r.Header.Set("X-Forwarded-Host", r.Host)
 	r.Header.Set("X-Forwarded-Proto", getScheme(r.URL.Scheme))
 	r.Header.Set("Forwarded", fmt.Sprintf("for=%s;host=%s;proto=%s", r.RemoteAddr, r.Host, getScheme(r.URL.Scheme)))
-	r.Header.Set("X-Auth-UserID", GetUserIDFromContext(r))
+	r.Header.Del("X-Auth-ClientID")
+	r.Header.Del("Signature")
+	r.Header.Del("Signature-Input")
+	StripMappedHeaders(r)
+	SetMappedHeaders(r, GetClaimsFromContext(r))
+	if clientID := GetClientIDFromContext(r); clientID != "" {
+		r.Header.Set("X-Auth-ClientID", clientID)
+		r.Header.Del("X-Auth-UserID")
+	} else {
+		r.Header.Set("X-Auth-UserID", GetUserIDFromContext(r))
+	}
 	r.Header.Del("Authorization")
+	r.Header.Del(dpopHeader)
+	if GetConfig().EnableCookies {
+		StripSessionCookies(r)
+	}
 	authHeader := GetAuthHeaderFromContext(r)
+	if GetConfig().PhantomTokenEnable && authHeader != "" && IsReferenceToken(authHeader) {
+		// Upstreams receive a JWT signed with the active key instead of the client's reference token
+		jwt, err := SignAccessToken(GetClaimsFromContext(r))
+		if err != nil {
+			log.Println("Could not sign access token for upstream:", err)
+			SendInternalServerError(w)
+			return
+		}
+		authHeader = jwt
+	}
 	if authHeader != "" {
 		r.Header.Set("Authorization", "Bearer "+authHeader)
 	}
@@ -267,4 +501,13 @@ var unauthorizedRoutes = [...]string{
 	GetConfig().PublicAPIPath + "signup",
 	GetConfig().PublicAPIPath + "confirm",
 	GetConfig().PublicAPIPath + "initpwreset",
+	GetConfig().PublicAPIPath + ".well-known",
+	GetConfig().PublicAPIPath + "oidc/authorize",
+	GetConfig().PublicAPIPath + "oidc/token",
+	GetConfig().PublicAPIPath + "token",
+}
+
+// OAuthError holds the payload of OAuth2 error responses
+type OAuthError struct {
+	Error string `json:"error"`
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RoleScope grants Scopes to users with Role
+type RoleScope struct {
+	Role   string
+	Scopes []string
+}
+
+// RouteScope requires access tokens for proxied requests matching PathPrefix and Methods to contain Scopes
+type RouteScope struct {
+	Methods    []string
+	PathPrefix string
+	Scopes     []string
+}
+
+// ParseScope splits a space-separated scope string (RFC 6749, section 3.3) into its scope tokens
+func ParseScope(s string) ([]string, error) {
+	res := make([]string, 0)
+	for _, scope := range strings.Fields(s) {
+		if !scopeTokenRegexp.MatchString(scope) {
+			return nil, errors.New("Invalid scope: " + scope)
+		}
+		if !ContainsScope(res, scope) {
+			res = append(res, scope)
+		}
+	}
+	return res, nil
+}
+
+// ContainsScope checks if the scope list includes the scope
+func ContainsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRoleScopes parses a comma-separated list of 'role:scope [scope...]' pairs, e.g. 'admin:users.read users.write'
+func ParseRoleScopes(s string) ([]*RoleScope, error) {
+	res := make([]*RoleScope, 0)
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid role scope: " + pair)
+		}
+		scopes, err := ParseScope(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		rs := &RoleScope{
+			Role:   strings.TrimSpace(parts[0]),
+			Scopes: scopes,
+		}
+		if rs.Role == "" || len(rs.Scopes) == 0 {
+			return nil, errors.New("Invalid role scope: " + pair)
+		}
+		res = append(res, rs)
+	}
+	return res, nil
+}
+
+// ParseRouteScopes parses a comma-separated list of '[METHOD[|METHOD...] ]prefix:scope [scope...]' entries,
+// e.g. 'GET /billing:billing.read,POST|PUT /billing:billing.write,/admin:admin'.
+// Entries without methods apply to all methods.
+func ParseRouteScopes(s string) ([]*RouteScope, error) {
+	res := make([]*RouteScope, 0)
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid route scope: " + entry)
+		}
+		scopes, err := ParseScope(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		methods, prefix, ok := ParseRoute(parts[0])
+		if !ok || len(scopes) == 0 {
+			return nil, errors.New("Invalid route scope: " + entry)
+		}
+		rs := &RouteScope{
+			Methods:    methods,
+			PathPrefix: prefix,
+			Scopes:     scopes,
+		}
+		res = append(res, rs)
+	}
+	return res, nil
+}
+
+// ParseRoute parses a '[METHOD[|METHOD...] ]prefix' route. Returns false if the route is invalid.
+func ParseRoute(s string) ([]string, string, bool) {
+	methods := make([]string, 0)
+	route := strings.Fields(s)
+	switch len(route) {
+	case 1:
+	case 2:
+		for _, method := range strings.Split(route[0], "|") {
+			if method == "" {
+				return nil, "", false
+			}
+			methods = append(methods, strings.ToUpper(method))
+		}
+	default:
+		return nil, "", false
+	}
+	prefix := route[len(route)-1]
+	if !strings.HasPrefix(prefix, "/") {
+		return nil, "", false
+	}
+	return methods, prefix, true
+}
+
+// IsRouteMatch checks if the request matches the path prefix and one of the methods (any method if empty)
+func IsRouteMatch(r *http.Request, methods []string, prefix string) bool {
+	if !IsPathPrefixMatch(GetRequestPath(r), prefix) {
+		return false
+	}
+	if len(methods) == 0 {
+		return true
+	}
+	for _, method := range methods {
+		if method == r.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches checks if the route scope applies to the request
+func (rs *RouteScope) Matches(r *http.Request) bool {
+	return IsRouteMatch(r, rs.Methods, rs.PathPrefix)
+}
+
+// GetUserScopes returns the scopes granted to the user: JWT_USER_SCOPE plus the scopes of the user's roles
+func GetUserScopes(user *User) []string {
+	res := append([]string{}, GetConfig().UserScopes...)
+	roles := user.Roles
+	for _, rs := range GetConfig().RoleScopes {
+		if !ContainsScope(roles, rs.Role) {
+			continue
+		}
+		for _, scope := range rs.Scopes {
+			if !ContainsScope(res, scope) {
+				res = append(res, scope)
+			}
+		}
+	}
+	return res
+}
+
+// NarrowScope returns the scopes of requested which are included in granted.
+// If nothing has been requested, all granted scopes are returned.
+func NarrowScope(granted []string, requested []string) []string {
+	if len(requested) == 0 {
+		return granted
+	}
+	res := make([]string, 0)
+	for _, scope := range requested {
+		if ContainsScope(granted, scope) {
+			res = append(res, scope)
+		}
+	}
+	return res
+}
+
+// GetRequiredScopes returns the scopes required by all route scopes matching the request
+func GetRequiredScopes(r *http.Request) []string {
+	res := make([]string, 0)
+	for _, rs := range GetConfig().RouteScopes {
+		if !rs.Matches(r) {
+			continue
+		}
+		for _, scope := range rs.Scopes {
+			if !ContainsScope(res, scope) {
+				res = append(res, scope)
+			}
+		}
+	}
+	return res
+}
+
+// HasRequiredScopes checks if the claims contain all scopes required for the request
+func HasRequiredScopes(r *http.Request, claims *Claims) bool {
+	scopes := strings.Fields(claims.Scope)
+	for _, scope := range GetRequiredScopes(r) {
+		if !ContainsScope(scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// SendInsufficientScope sends a 403 response with the insufficient_scope error (RFC 6750, section 3.1)
+func SendInsufficientScope(w http.ResponseWriter, r *http.Request) {
+	scheme := "Bearer"
+	if strings.HasPrefix(r.Header.Get("Authorization"), "DPoP ") {
+		scheme = "DPoP"
+	}
+	w.Header().Set("WWW-Authenticate", scheme+` error="insufficient_scope", scope=`+strconv.Quote(strings.Join(GetRequiredScopes(r), " ")))
+	SendForbidden(w)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func setupScopeTest() func() {
+	GetConfig().UserScopes = []string{"profile"}
+	GetConfig().RoleScopes, _ = ParseRoleScopes("admin:users.read users.write")
+	GetConfig().RouteScopes, _ = ParseRouteScopes("POST|PUT /some/route:users.write,/some/route/admin:users.read")
+	return func() {
+		GetConfig().UserScopes = make([]string, 0)
+		GetConfig().RoleScopes = make([]*RoleScope, 0)
+		GetConfig().RouteScopes = make([]*RouteScope, 0)
+	}
+}
+
+func loginUserScope(username, password, scope string) (*LoginResponse, int) {
+	payload := `{"email": "` + username + `", "password": "` + password + `", "scope": "` + scope + `"}`
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	var loginResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &loginResponse)
+	return &loginResponse, res.Code
+}
+
+func getTestTokenScope(t *testing.T, accessToken string) string {
+	claims, err := ParseAccessToken(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.Scope
+}
+
+func TestParseRouteScopes(t *testing.T) {
+	routeScopes, err := ParseRouteScopes("get|post /billing:billing.read billing.write, /admin:admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routeScopes) != 2 {
+		t.Fatalf("Expected 2 route scopes, got %d", len(routeScopes))
+	}
+	checkTestString(t, "GET,POST", strings.Join(routeScopes[0].Methods, ","))
+	checkTestString(t, "/billing", routeScopes[0].PathPrefix)
+	checkTestString(t, "billing.read billing.write", strings.Join(routeScopes[0].Scopes, " "))
+	checkTestInt(t, 0, len(routeScopes[1].Methods))
+
+	for _, s := range []string{"/billing", "billing:read", "/billing:", "GET POST /billing:read", "| /billing:read", `/billing:"read"`} {
+		if _, err := ParseRouteScopes(s); err == nil {
+			t.Errorf("Expected error for route scope '%s'", s)
+		}
+	}
+	for _, s := range []string{"admin", ":users.read", "admin:"} {
+		if _, err := ParseRoleScopes(s); err == nil {
+			t.Errorf("Expected error for role scope '%s'", s)
+		}
+	}
+}
+
+func TestLoginScopes(t *testing.T) {
+	defer setupScopeTest()()
+	clearTestDB()
+	user := createTestUser(true)
+
+	loginResponse, code := loginUserScope("foo@bar.com", "12345678", "")
+	checkTestResponseCode(t, http.StatusOK, code)
+	checkTestString(t, "profile", getTestTokenScope(t, loginResponse.AccessToken))
+
+	req, _ := http.NewRequest("PUT", "/users/"+user.ID.Hex()+"/roles/admin", nil)
+	executeBackendTestRequest(req)
+	loginResponse, code = loginUserScope("foo@bar.com", "12345678", "")
+	checkTestResponseCode(t, http.StatusOK, code)
+	checkTestString(t, "profile users.read users.write", getTestTokenScope(t, loginResponse.AccessToken))
+
+	// Requested scopes are kept on refresh
+	loginResponse, code = loginUserScope("foo@bar.com", "12345678", "users.read")
+	checkTestResponseCode(t, http.StatusOK, code)
+	checkTestString(t, "users.read", getTestTokenScope(t, loginResponse.AccessToken))
+	loginResponse, code = refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+	checkTestString(t, "users.read", getTestTokenScope(t, loginResponse.AccessToken))
+
+	_, code = loginUserScope("foo@bar.com", "12345678", "profile billing")
+	checkTestResponseCode(t, http.StatusForbidden, code)
+}
+
+func TestRouteScopes(t *testing.T) {
+	defer setupScopeTest()()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+
+	req := newHTTPRequest("GET", "/some/route/test.html", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+
+	req = newHTTPRequest("POST", "/some/route/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+	checkTestString(t, `Bearer error="insufficient_scope", scope="users.write"`, res.Header().Get("WWW-Authenticate"))
+
+	req = newHTTPRequest("PUT", "/some/route/admin/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+	checkTestString(t, `Bearer error="insufficient_scope", scope="users.write users.read"`, res.Header().Get("WWW-Authenticate"))
+}
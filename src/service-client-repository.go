@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ServiceClient holds a machine client allowed to obtain access tokens using the OAuth2 client credentials grant
+type ServiceClient struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ClientID     string             `json:"clientId" bson:"clientId"`
+	HashedSecret string             `json:"-" bson:"secret"`
+	Name         string             `json:"name" bson:"name"`
+	Scopes       []string           `json:"scopes" bson:"scopes"`
+	Enabled      bool               `json:"enabled" bson:"enabled"`
+	CreateDate   time.Time          `json:"createDate" bson:"createDate"`
+}
+
+// HasScope checks if the client is allowed to request the given scope
+func (c *ServiceClient) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type ServiceClientRepository struct {
+}
+
+var _serviceClientRepositoryInstance *ServiceClientRepository
+var _serviceClientRepositoryOnce sync.Once
+
+func GetServiceClientRepository() *ServiceClientRepository {
+	_serviceClientRepositoryOnce.Do(func() {
+		_serviceClientRepositoryInstance = &ServiceClientRepository{}
+		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
+		// Create unique index on 'clientId'
+		mod := mongo.IndexModel{
+			Keys: bson.M{
+				"clientId": 1,
+			},
+			Options: options.Index().SetUnique(true),
+		}
+		_, err := _serviceClientRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return _serviceClientRepositoryInstance
+}
+
+func (r *ServiceClientRepository) GetCollection() *mongo.Collection {
+	return GetDatatabase().Database.Collection("service_clients")
+}
+
+func (r *ServiceClientRepository) Create(c *ServiceClient) {
+	res, err := r.GetCollection().InsertOne(context.TODO(), c)
+	if err != nil {
+		log.Println(err)
+	}
+	c.ID = res.InsertedID.(primitive.ObjectID)
+}
+
+func (r *ServiceClientRepository) GetByClientID(clientID string) *ServiceClient {
+	var client ServiceClient
+	err := r.GetCollection().FindOne(context.TODO(), bson.M{"clientId": clientID}).Decode(&client)
+	if err != nil {
+		return nil
+	}
+	return &client
+}
+
+func (r *ServiceClientRepository) GetAll() []*ServiceClient {
+	results := make([]*ServiceClient, 0)
+	cur, err := r.GetCollection().Find(context.TODO(), bson.M{}, options.Find().SetSort(bson.M{"createDate": 1}))
+	if err != nil {
+		log.Println(err)
+		return results
+	}
+	for cur.Next(context.TODO()) {
+		var client ServiceClient
+		err := cur.Decode(&client)
+		if err != nil {
+			return results
+		}
+		results = append(results, &client)
+	}
+	cur.Close(context.TODO())
+	return results
+}
+
+func (r *ServiceClientRepository) Update(c *ServiceClient) {
+	_, err := r.GetCollection().UpdateOne(context.TODO(), bson.M{"_id": c.ID}, bson.M{"$set": c})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *ServiceClientRepository) Delete(c *ServiceClient) {
+	_, err := r.GetCollection().DeleteOne(context.TODO(), bson.M{"_id": c.ID})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *ServiceClientRepository) FindUnusedClientID() string {
+	var clientID string = ""
+	for i := 1; i <= 20 && clientID == ""; i++ {
+		clientID = guuid.New().String()
+		if r.GetByClientID(clientID) != nil {
+			clientID = ""
+		}
+	}
+	return clientID
+}
+
+// GenerateSecret sets a new random client secret and returns it in plain text
+func (r *ServiceClientRepository) GenerateSecret(c *ServiceClient) (string, error) {
+	secret, hash, err := GenerateClientSecret()
+	if err != nil {
+		return "", err
+	}
+	c.HashedSecret = hash
+	return secret, nil
+}
+
+func (r *ServiceClientRepository) CheckSecret(c *ServiceClient, secret string) bool {
+	return CheckClientSecret(c.HashedSecret, secret)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ServiceClientRouter handles the backend requests for managing service clients
+type ServiceClientRouter struct {
+}
+
+// scopeTokenRegexp matches a single OAuth2 scope token (RFC 6749, section 3.3)
+var scopeTokenRegexp = regexp.MustCompile(`^[\x21\x23-\x5B\x5D-\x7E]+$`)
+
+func (router *ServiceClientRouter) setupRoutes(s *mux.Router) {
+	s.HandleFunc("/{id}", router.getOne).Methods("GET")
+	s.HandleFunc("/{id}", router.update).Methods("PUT")
+	s.HandleFunc("/{id}", router.delete).Methods("DELETE")
+	s.HandleFunc("/{id}/secret", router.resetSecret).Methods("POST")
+	s.HandleFunc("/", router.create).Methods("POST")
+	s.HandleFunc("/", router.getAll).Methods("GET")
+}
+
+func (router *ServiceClientRouter) create(w http.ResponseWriter, r *http.Request) {
+	var data ServiceClientRequest
+	if UnmarshalValidateBody(r, &data) != nil || !router.isValidScopeList(data.Scopes) {
+		log.Println("Received invalid create service client request")
+		SendBadRequest(w)
+		return
+	}
+	client := &ServiceClient{
+		ClientID:   GetServiceClientRepository().FindUnusedClientID(),
+		Name:       data.Name,
+		Scopes:     data.Scopes,
+		Enabled:    data.Enabled,
+		CreateDate: time.Now(),
+	}
+	secret, err := GetServiceClientRepository().GenerateSecret(client)
+	if err != nil {
+		log.Println("Could not generate service client secret:", err)
+		SendInternalServerError(w)
+		return
+	}
+	GetServiceClientRepository().Create(client)
+	SendCreatedJSON(w, client.ID, &OIDCClientCredentials{
+		ClientID:     client.ClientID,
+		ClientSecret: secret,
+	})
+}
+
+func (router *ServiceClientRouter) getAll(w http.ResponseWriter, r *http.Request) {
+	SendJSON(w, GetServiceClientRepository().GetAll())
+}
+
+func (router *ServiceClientRouter) getOne(w http.ResponseWriter, r *http.Request) {
+	client := router.getClientFromMuxVars(r)
+	if client == nil {
+		SendNotFound(w)
+		return
+	}
+	SendJSON(w, client)
+}
+
+func (router *ServiceClientRouter) update(w http.ResponseWriter, r *http.Request) {
+	client := router.getClientFromMuxVars(r)
+	if client == nil {
+		SendNotFound(w)
+		return
+	}
+	var data ServiceClientRequest
+	if UnmarshalValidateBody(r, &data) != nil || !router.isValidScopeList(data.Scopes) {
+		SendBadRequest(w)
+		return
+	}
+	client.Name = data.Name
+	client.Scopes = data.Scopes
+	client.Enabled = data.Enabled
+	GetServiceClientRepository().Update(client)
+	if err := GetRevokedTokenRepository().RevokeAllForClient(client.ClientID); err != nil {
+		log.Println("Could not revoke access tokens of ClientID", client.ClientID, ":", err)
+		SendInternalServerError(w)
+		return
+	}
+	SendUpdated(w)
+}
+
+func (router *ServiceClientRouter) delete(w http.ResponseWriter, r *http.Request) {
+	client := router.getClientFromMuxVars(r)
+	if client == nil {
+		SendNotFound(w)
+		return
+	}
+	if err := GetRevokedTokenRepository().RevokeAllForClient(client.ClientID); err != nil {
+		log.Println("Could not revoke access tokens of ClientID", client.ClientID, "- client not deleted:", err)
+		SendInternalServerError(w)
+		return
+	}
+	GetServiceClientRepository().Delete(client)
+	SendUpdated(w)
+}
+
+func (router *ServiceClientRouter) resetSecret(w http.ResponseWriter, r *http.Request) {
+	client := router.getClientFromMuxVars(r)
+	if client == nil {
+		SendNotFound(w)
+		return
+	}
+	secret, err := GetServiceClientRepository().GenerateSecret(client)
+	if err != nil {
+		log.Println("Could not generate service client secret:", err)
+		SendInternalServerError(w)
+		return
+	}
+	GetServiceClientRepository().Update(client)
+	if err := GetRevokedTokenRepository().RevokeAllForClient(client.ClientID); err != nil {
+		log.Println("Could not revoke access tokens of ClientID", client.ClientID, ":", err)
+		SendInternalServerError(w)
+		return
+	}
+	SendJSON(w, &OIDCClientCredentials{
+		ClientID:     client.ClientID,
+		ClientSecret: secret,
+	})
+}
+
+func (router *ServiceClientRouter) getClientFromMuxVars(r *http.Request) *ServiceClient {
+	vars := mux.Vars(r)
+	return GetServiceClientRepository().GetByClientID(vars["id"])
+}
+
+func (router *ServiceClientRouter) isValidScopeList(scopes []string) bool {
+	for _, scope := range scopes {
+		if !scopeTokenRegexp.MatchString(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+type ServiceClientRequest struct {
+	Name    string   `json:"name" validate:"required"`
+	Scopes  []string `json:"scopes"`
+	Enabled bool     `json:"enabled"`
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func createTestServiceClient(t *testing.T, payload string) *OIDCClientCredentials {
+	req, _ := http.NewRequest("POST", "/clients/", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusCreated, res.Code)
+	var credentials OIDCClientCredentials
+	json.Unmarshal(res.Body.Bytes(), &credentials)
+	return &credentials
+}
+
+func requestClientToken(credentials *OIDCClientCredentials, scope string) (*TokenResponse, int) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	req, _ := http.NewRequest("POST", "/auth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(credentials.ClientID, credentials.ClientSecret)
+	res := executePublicTestRequest(req)
+	var tokenResponse TokenResponse
+	json.Unmarshal(res.Body.Bytes(), &tokenResponse)
+	return &tokenResponse, res.Code
+}
+
+func TestCreateServiceClient(t *testing.T) {
+	clearTestDB()
+
+	credentials := createTestServiceClient(t, `{"name": "Cron", "scopes": ["reports:read", "reports:write"], "enabled": true}`)
+	checkStringNotEmpty(t, credentials.ClientID)
+	checkStringNotEmpty(t, credentials.ClientSecret)
+
+	client := GetServiceClientRepository().GetByClientID(credentials.ClientID)
+	if client == nil {
+		t.Fatal("Expected client to be created")
+	}
+	checkTestString(t, "Cron", client.Name)
+	if !client.HasScope("reports:write") {
+		t.Fatal("Expected client to have scope 'reports:write'")
+	}
+	if !GetServiceClientRepository().CheckSecret(client, credentials.ClientSecret) {
+		t.Fatal("Expected client secret to match")
+	}
+}
+
+func TestCreateServiceClientInvalidScope(t *testing.T) {
+	clearTestDB()
+
+	req, _ := http.NewRequest("POST", "/clients/", bytes.NewBufferString(`{"name": "Cron", "scopes": ["reports read"]}`))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	clearTestDB()
+	credentials := createTestServiceClient(t, `{"name": "Cron", "scopes": ["reports:read", "reports:write"], "enabled": true}`)
+
+	tokenResponse, status := requestClientToken(credentials, "")
+	checkTestResponseCode(t, http.StatusOK, status)
+	checkTestString(t, "Bearer", tokenResponse.TokenType)
+	checkTestString(t, "reports:read reports:write", tokenResponse.Scope)
+
+	tokenResponse, status = requestClientToken(credentials, "reports:read")
+	checkTestResponseCode(t, http.StatusOK, status)
+	checkTestString(t, "reports:read", tokenResponse.Scope)
+	req := newHTTPRequest("GET", "/some/route/test.html", tokenResponse.AccessToken, nil)
+	claims, _, err := ExtractClaimsFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, credentials.ClientID, claims.Subject)
+	checkTestString(t, credentials.ClientID, claims.ClientID)
+	checkTestString(t, "", claims.UserID)
+
+	_, status = requestClientToken(credentials, "admin")
+	checkTestResponseCode(t, http.StatusBadRequest, status)
+
+	credentials.ClientSecret = "invalid"
+	_, status = requestClientToken(credentials, "")
+	checkTestResponseCode(t, http.StatusUnauthorized, status)
+}
+
+func TestClientCredentialsGrantDisabledClient(t *testing.T) {
+	clearTestDB()
+	credentials := createTestServiceClient(t, `{"name": "Cron", "scopes": [], "enabled": false}`)
+
+	_, status := requestClientToken(credentials, "")
+	checkTestResponseCode(t, http.StatusUnauthorized, status)
+}
+
+func TestClientTokenRevokedOnDisable(t *testing.T) {
+	clearTestDB()
+	credentials := createTestServiceClient(t, `{"name": "Cron", "scopes": [], "enabled": true}`)
+	tokenResponse, _ := requestClientToken(credentials, "")
+
+	req, _ := http.NewRequest("PUT", "/clients/"+credentials.ClientID, bytes.NewBufferString(`{"name": "Cron", "scopes": [], "enabled": false}`))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req = newHTTPRequest("GET", "/some/route/test.html", tokenResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestClientTokenRejectedForPublicAPI(t *testing.T) {
+	clearTestDB()
+	credentials := createTestServiceClient(t, `{"name": "Cron", "scopes": [], "enabled": true}`)
+	tokenResponse, _ := requestClientToken(credentials, "")
+
+	req := newHTTPRequest("POST", "/auth/logout", tokenResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
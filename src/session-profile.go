@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSessionProfile is the name of the profile built from REFRESH_TOKEN_LIFETIME and REFRESH_TOKEN_SLIDING
+const defaultSessionProfile = "default"
+
+// SessionProfile defines the refresh token lifetime in minutes, sliding expiration and maximum number
+// of concurrent sessions per user (0 = unlimited) of the login sessions started with the profile
+type SessionProfile struct {
+	Name        string
+	Lifetime    time.Duration
+	Sliding     bool
+	MaxSessions int
+}
+
+// ParseSessionProfiles parses a comma-separated list of 'name:lifetime[:sliding[:maxSessions]]' entries,
+// e.g. 'kiosk:30:0:1,persistent:43200:1:5'. The default profile is always included and may be overridden.
+func ParseSessionProfiles(s string, defaultProfile *SessionProfile) ([]*SessionProfile, error) {
+	res := []*SessionProfile{defaultProfile}
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) < 2 || len(parts) > 4 || !claimNameRegexp.MatchString(parts[0]) {
+			return nil, errors.New("Invalid session profile: " + entry)
+		}
+		profile := &SessionProfile{Name: parts[0]}
+		lifetime, err := strconv.Atoi(parts[1])
+		if err != nil || lifetime <= 0 {
+			return nil, errors.New("Invalid session profile lifetime: " + entry)
+		}
+		profile.Lifetime = time.Duration(lifetime)
+		if len(parts) > 2 {
+			if parts[2] != "0" && parts[2] != "1" {
+				return nil, errors.New("Invalid session profile sliding flag: " + entry)
+			}
+			profile.Sliding = (parts[2] == "1")
+		}
+		if len(parts) > 3 {
+			if profile.MaxSessions, err = strconv.Atoi(parts[3]); err != nil || profile.MaxSessions < 0 {
+				return nil, errors.New("Invalid session profile max sessions: " + entry)
+			}
+		}
+		if names[profile.Name] {
+			return nil, errors.New("Duplicate session profile: " + profile.Name)
+		}
+		names[profile.Name] = true
+		if profile.Name == defaultSessionProfile {
+			res[0] = profile
+		} else {
+			res = append(res, profile)
+		}
+	}
+	return res, nil
+}
+
+// FindSessionProfile returns the profile with the given name or nil if there is none
+func FindSessionProfile(profiles []*SessionProfile, name string) *SessionProfile {
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile
+		}
+	}
+	return nil
+}
+
+// GetSessionProfile returns the profile for a login with or without the remember me option
+func GetSessionProfile(rememberMe bool) *SessionProfile {
+	name := GetConfig().SessionProfile
+	if rememberMe {
+		name = GetConfig().RememberMeProfile
+	}
+	return FindSessionProfile(GetConfig().SessionProfiles, name)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func setupSessionProfileTest() func() {
+	defaultProfile := &SessionProfile{Name: defaultSessionProfile, Lifetime: GetConfig().RefreshTokenLifetime}
+	GetConfig().SessionProfiles, _ = ParseSessionProfiles("kiosk:30:0:1,persistent:43200:1:2", defaultProfile)
+	GetConfig().SessionProfile = "kiosk"
+	GetConfig().RememberMeProfile = "persistent"
+	return func() {
+		GetConfig().SessionProfiles = []*SessionProfile{defaultProfile}
+		GetConfig().SessionProfile = defaultSessionProfile
+		GetConfig().RememberMeProfile = defaultSessionProfile
+	}
+}
+
+func loginUserRememberMe(username, password string, rememberMe bool) *LoginResponse {
+	payload := `{"email": "` + username + `", "password": "` + password + `", "rememberMe": ` + strconv.FormatBool(rememberMe) + `}`
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	var loginResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &loginResponse)
+	return &loginResponse
+}
+
+func TestParseSessionProfiles(t *testing.T) {
+	defaultProfile := &SessionProfile{Name: defaultSessionProfile, Lifetime: 60}
+	profiles, err := ParseSessionProfiles("kiosk:30, persistent:43200:1:5", defaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 3 {
+		t.Fatalf("Expected 3 session profiles, got %d", len(profiles))
+	}
+	checkTestString(t, defaultSessionProfile, profiles[0].Name)
+	kiosk := FindSessionProfile(profiles, "kiosk")
+	if kiosk == nil || kiosk.Lifetime != 30 || kiosk.Sliding || kiosk.MaxSessions != 0 {
+		t.Fatalf("Unexpected kiosk profile %v", kiosk)
+	}
+	persistent := FindSessionProfile(profiles, "persistent")
+	if persistent == nil || persistent.Lifetime != 43200 || !persistent.Sliding || persistent.MaxSessions != 5 {
+		t.Fatalf("Unexpected persistent profile %v", persistent)
+	}
+
+	profiles, _ = ParseSessionProfiles("default:120:1", defaultProfile)
+	if len(profiles) != 1 || profiles[0].Lifetime != 120 || !profiles[0].Sliding {
+		t.Fatal("Expected default profile to be overridden")
+	}
+
+	for _, s := range []string{"kiosk", "kiosk:0", "kiosk:x", "kiosk:30:2", "kiosk:30:0:-1", "kiosk:30:0:1:1", "in valid:30", "kiosk:30,kiosk:60"} {
+		if _, err := ParseSessionProfiles(s, defaultProfile); err == nil {
+			t.Errorf("Expected error for session profile '%s'", s)
+		}
+	}
+}
+
+func TestLoginRememberMe(t *testing.T) {
+	defer setupSessionProfileTest()()
+	clearTestDB()
+	createTestUser(true)
+
+	loginResponse := loginUserRememberMe("foo@bar.com", "12345678", false)
+	checkTestString(t, "kiosk", loginResponse.SessionProfile)
+	checkTestInt(t, int((GetConfig().AccessTokenLifetime * time.Minute).Seconds()), int(loginResponse.ExpiresIn))
+	if loginResponse.RefreshExpiresIn <= 29*60 || loginResponse.RefreshExpiresIn > 30*60 {
+		t.Fatalf("Expected refresh token to expire in 30 minutes, got %d seconds", loginResponse.RefreshExpiresIn)
+	}
+	refreshToken := GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken)
+	checkTestString(t, "kiosk", refreshToken.Profile)
+	checkTestInt(t, 30, refreshToken.Lifetime)
+
+	loginResponse = loginUserRememberMe("foo@bar.com", "12345678", true)
+	checkTestString(t, "persistent", loginResponse.SessionProfile)
+	if loginResponse.RefreshExpiresIn <= 43199*60 || loginResponse.RefreshExpiresIn > 43200*60 {
+		t.Fatalf("Expected refresh token to expire in 30 days, got %d seconds", loginResponse.RefreshExpiresIn)
+	}
+
+	// The profile is kept on refresh
+	loginResponse, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+	checkTestString(t, "persistent", loginResponse.SessionProfile)
+	refreshToken = GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken)
+	checkTestString(t, "persistent", refreshToken.Profile)
+	if !refreshToken.Sliding {
+		t.Fatal("Expected persistent session to use sliding expiration")
+	}
+}
+
+func TestSessionProfileMaxSessions(t *testing.T) {
+	defer setupSessionProfileTest()()
+	clearTestDB()
+	user := createTestUser(true)
+
+	first := loginUserRememberMe("foo@bar.com", "12345678", true)
+	loginUserRememberMe("foo@bar.com", "12345678", true)
+	loginUserRememberMe("foo@bar.com", "12345678", false)
+	checkTestInt(t, 3, len(GetRefreshTokenRepository().GetSessionsForUser(user.ID.Hex())))
+
+	// The oldest persistent session is revoked, kiosk sessions are limited separately
+	loginUserRememberMe("foo@bar.com", "12345678", true)
+	loginUserRememberMe("foo@bar.com", "12345678", false)
+	checkTestInt(t, 3, len(GetRefreshTokenRepository().GetSessionsForUser(user.ID.Hex())))
+	if GetRefreshTokenRepository().GetByToken(first.RefreshToken) != nil {
+		t.Fatal("Expected oldest persistent session to be revoked")
+	}
+	_, code := refreshTokens(first.AccessToken, first.RefreshToken)
+	if code == http.StatusOK {
+		t.Fatal("Expected refresh of revoked session to fail")
+	}
+}
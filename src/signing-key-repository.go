@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StoredSigningKey holds an encrypted JWT signing key shared by all replicas
+type StoredSigningKey struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	KeyID        string             `json:"keyId" bson:"keyId"`
+	Algorithm    string             `json:"algorithm" bson:"algorithm"`
+	EncryptedKey string             `json:"-" bson:"key"`
+	Active       bool               `json:"active" bson:"active"`
+	CreateDate   time.Time          `json:"createDate" bson:"createDate"`
+	RetireDate   time.Time          `json:"retireDate" bson:"retireDate,omitempty"`
+}
+
+type SigningKeyRepository struct {
+}
+
+var _signingKeyRepositoryInstance *SigningKeyRepository
+var _signingKeyRepositoryOnce sync.Once
+
+func GetSigningKeyRepository() *SigningKeyRepository {
+	_signingKeyRepositoryOnce.Do(func() {
+		_signingKeyRepositoryInstance = &SigningKeyRepository{}
+		ctx, _ := context.WithTimeout(context.Background(), 15*time.Second)
+		// Create unique index on 'keyId'
+		mod := mongo.IndexModel{
+			Keys: bson.M{
+				"keyId": 1,
+			},
+			Options: options.Index().SetUnique(true),
+		}
+		_, err := _signingKeyRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
+	})
+	return _signingKeyRepositoryInstance
+}
+
+func (r *SigningKeyRepository) GetCollection() *mongo.Collection {
+	return GetDatatabase().Database.Collection("signing_keys")
+}
+
+func (r *SigningKeyRepository) Create(k *StoredSigningKey) error {
+	res, err := r.GetCollection().InsertOne(context.TODO(), k)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	k.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetAll returns all stored keys, newest first.
+// Returns an error instead of a partial result if reading the keys fails.
+func (r *SigningKeyRepository) GetAll() ([]*StoredSigningKey, error) {
+	var results []*StoredSigningKey
+	cur, err := r.GetCollection().Find(context.TODO(), bson.M{}, options.Find().SetSort(bson.M{"createDate": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.TODO())
+	for cur.Next(context.TODO()) {
+		var key StoredSigningKey
+		if err := cur.Decode(&key); err != nil {
+			return nil, err
+		}
+		results = append(results, &key)
+	}
+	return results, cur.Err()
+}
+
+// Retire deactivates the key if it is still active.
+// Returns false if another replica has already retired the key.
+func (r *SigningKeyRepository) Retire(keyID string) bool {
+	res, err := r.GetCollection().UpdateOne(context.TODO(), bson.M{"keyId": keyID, "active": true}, bson.M{"$set": bson.M{
+		"active":     false,
+		"retireDate": time.Now(),
+	}})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return res.ModifiedCount == 1
+}
+
+func (r *SigningKeyRepository) Delete(k *StoredSigningKey) {
+	_, err := r.GetCollection().DeleteOne(context.TODO(), bson.M{"_id": k.ID})
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningKey holds a key pair (or HMAC secret) used for signing and verifying JWTs
+type SigningKey struct {
+	Method     jwt.SigningMethod
+	KeyID      string
+	PrivateKey interface{}
+	PublicKey  interface{}
+}
+
+// LoadSigningKey creates the signing key according to the configured algorithm.
+// Asymmetric keys are read from the PEM file if it exists, otherwise a new key is generated
+// and saved to the file (if a file name is given).
+func LoadSigningKey(alg, fileName string) (*SigningKey, error) {
+	if IsSymmetricSigningMethod(alg) {
+		return NewHMACSigningKey(alg, GetConfig().JwtSigningKey)
+	}
+	if fileName == "" {
+		log.Println("Generating ephemeral", alg, "JWT signing key...")
+		return NewSigningKey(alg)
+	}
+	if _, err := os.Stat(fileName); err == nil {
+		log.Println("Reading JWT signing key from", fileName, "...")
+		pemBytes, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigningKeyFromPEM(alg, pemBytes)
+	}
+	log.Println("Generating", alg, "JWT signing key and saving it to", fileName, "...")
+	key, err := NewSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.SavePrivateKey(fileName); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func IsSymmetricSigningMethod(alg string) bool {
+	return alg == jwt.SigningMethodHS512.Alg()
+}
+
+func IsSupportedSigningMethod(alg string) bool {
+	switch alg {
+	case jwt.SigningMethodHS512.Alg(), jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg(), SigningMethodEdDSA.Alg():
+		return true
+	}
+	return false
+}
+
+// NewHMACSigningKey returns the HMAC key for the secret. The key ID is derived from the secret,
+// so that all replicas sharing the secret and restarted instances use the same key ID.
+func NewHMACSigningKey(alg, secret string) (*SigningKey, error) {
+	if !IsSymmetricSigningMethod(alg) {
+		return nil, errors.New("Not a symmetric signing method: " + alg)
+	}
+	key := &SigningKey{
+		Method:     jwt.GetSigningMethod(alg),
+		KeyID:      hmacKeyID(secret),
+		PrivateKey: []byte(secret),
+		PublicKey:  []byte(secret),
+	}
+	return key, nil
+}
+
+// hmacKeyID returns the truncated SHA-256 hash of the secret
+func hmacKeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// NewRandomHMACSigningKey generates a new random HMAC secret
+func NewRandomHMACSigningKey(alg string) (*SigningKey, error) {
+	secret := make([]byte, 64)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return NewHMACSigningKey(alg, base64.RawURLEncoding.EncodeToString(secret))
+}
+
+// NewSigningKey generates a new random asymmetric key for the given algorithm
+func NewSigningKey(alg string) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	var err error
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case SigningMethodEdDSA.Alg():
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.New("Unsupported asymmetric signing method: " + alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newAsymmetricSigningKey(alg, privateKey)
+}
+
+// NewSigningKeyFromPEM parses a PKCS#8, PKCS#1 (RSA) or SEC 1 (EC) encoded private key
+func NewSigningKeyFromPEM(alg string, pemBytes []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("Could not decode PEM private key")
+	}
+	var privateKey interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Unsupported private key type")
+	}
+	return newAsymmetricSigningKey(alg, signer)
+}
+
+func newAsymmetricSigningKey(alg string, privateKey crypto.Signer) (*SigningKey, error) {
+	switch privateKey.(type) {
+	case *rsa.PrivateKey:
+		if alg != jwt.SigningMethodRS256.Alg() {
+			return nil, errors.New("RSA key does not match signing method " + alg)
+		}
+	case *ecdsa.PrivateKey:
+		if alg != jwt.SigningMethodES256.Alg() || privateKey.Public().(*ecdsa.PublicKey).Curve != elliptic.P256() {
+			return nil, errors.New("EC key does not match signing method " + alg)
+		}
+	case ed25519.PrivateKey:
+		if alg != SigningMethodEdDSA.Alg() {
+			return nil, errors.New("Ed25519 key does not match signing method " + alg)
+		}
+	default:
+		return nil, errors.New("Unsupported private key type")
+	}
+	key := &SigningKey{
+		Method:     jwt.GetSigningMethod(alg),
+		PrivateKey: privateKey,
+		PublicKey:  privateKey.Public(),
+	}
+	jwk, err := key.JWK()
+	if err != nil {
+		return nil, err
+	}
+	if key.KeyID, err = jwk.Thumbprint(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (key *SigningKey) IsSymmetric() bool {
+	return IsSymmetricSigningMethod(key.Method.Alg())
+}
+
+// SignedString signs the claims and returns the compact serialized JWT
+func (key *SigningKey) SignedString(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.KeyID != "" {
+		token.Header["kid"] = key.KeyID
+	}
+	return token.SignedString(key.PrivateKey)
+}
+
+// JWK returns the public key as JSON Web Key
+func (key *SigningKey) JWK() (*JWK, error) {
+	if key.IsSymmetric() {
+		return nil, errors.New("Symmetric keys can't be published as JWK")
+	}
+	return NewJWK(key.PublicKey, key.Method.Alg(), key.KeyID)
+}
+
+func (key *SigningKey) MarshalPrivateKeyPEM() ([]byte, error) {
+	if key.IsSymmetric() {
+		return nil, errors.New("Symmetric keys can't be encoded as PEM")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func (key *SigningKey) SavePrivateKey(fileName string) error {
+	pemBytes, err := key.MarshalPrivateKeyPEM()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, pemBytes, 0600)
+}
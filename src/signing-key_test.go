@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestSigningKeySignVerify(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, err := NewSigningKey(alg)
+		if err != nil {
+			t.Fatalf("Could not generate %s key: %s", alg, err)
+		}
+		checkStringNotEmpty(t, key.KeyID)
+		claims := &Claims{
+			Email:  "foo@bar.com",
+			UserID: "123",
+			StandardClaims: jwt.StandardClaims{
+				ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			},
+		}
+		jwtString, err := key.SignedString(claims)
+		if err != nil {
+			t.Fatalf("Could not sign %s token: %s", alg, err)
+		}
+		res := &Claims{}
+		token, err := jwt.ParseWithClaims(jwtString, res, func(token *jwt.Token) (interface{}, error) {
+			checkTestString(t, alg, token.Method.Alg())
+			checkTestString(t, key.KeyID, token.Header["kid"].(string))
+			return key.PublicKey, nil
+		})
+		if err != nil || !token.Valid {
+			t.Fatalf("Expected %s token to be valid, got: %s", alg, err)
+		}
+		checkTestString(t, "foo@bar.com", res.Email)
+	}
+}
+
+func TestSigningKeyPEM(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, _ := NewSigningKey(alg)
+		pemBytes, err := key.MarshalPrivateKeyPEM()
+		if err != nil {
+			t.Fatalf("Could not encode %s key: %s", alg, err)
+		}
+		key2, err := NewSigningKeyFromPEM(alg, pemBytes)
+		if err != nil {
+			t.Fatalf("Could not decode %s key: %s", alg, err)
+		}
+		checkTestString(t, key.KeyID, key2.KeyID)
+	}
+}
+
+func TestHMACSigningKeyID(t *testing.T) {
+	key, _ := NewHMACSigningKey("HS512", "secret-1")
+	key2, _ := NewHMACSigningKey("HS512", "secret-1")
+	key3, _ := NewHMACSigningKey("HS512", "secret-2")
+	checkStringNotEmpty(t, key.KeyID)
+	checkTestString(t, key.KeyID, key2.KeyID)
+	if key.KeyID == key3.KeyID {
+		t.Fatal("Expected different key IDs for different secrets")
+	}
+}
+
+func TestSigningKeyPEMWrongMethod(t *testing.T) {
+	key, _ := NewSigningKey("ES256")
+	pemBytes, _ := key.MarshalPrivateKeyPEM()
+	if _, err := NewSigningKeyFromPEM("RS256", pemBytes); err == nil {
+		t.Fatal("Expected error when loading EC key for RS256")
+	}
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, _ := NewSigningKey(alg)
+		jwk, err := key.JWK()
+		if err != nil {
+			t.Fatalf("Could not create %s JWK: %s", alg, err)
+		}
+		publicKey, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatalf("Could not parse %s JWK: %s", alg, err)
+		}
+		jwk2, _ := NewJWK(publicKey, alg, "")
+		thumbprint, _ := jwk2.Thumbprint()
+		checkTestString(t, key.KeyID, thumbprint)
+	}
+}
+
+func TestHMACSigningKeyNoJWK(t *testing.T) {
+	key, _ := NewHMACSigningKey("HS512", "secret")
+	if _, err := key.JWK(); err == nil {
+		t.Fatal("Expected HMAC key not to be exported as JWK")
+	}
+}
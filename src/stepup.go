@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authentication Context Class Reference values set in the 'acr' claim
+const (
+	acrSingleFactor = "1"
+	acrMultiFactor  = "2"
+)
+
+// StepUpRoute requires access tokens for proxied requests matching PathPrefix to be issued
+// for an authentication within MaxAge minutes
+type StepUpRoute struct {
+	PathPrefix string
+	MaxAge     time.Duration
+}
+
+// ParseStepUpRoutes parses a comma-separated list of 'prefix:minutes' pairs, e.g. '/billing:5'
+func ParseStepUpRoutes(s string) ([]*StepUpRoute, error) {
+	res := make([]*StepUpRoute, 0)
+	if strings.TrimSpace(s) == "" {
+		return res, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid step-up route: " + pair)
+		}
+		minutes, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || minutes <= 0 {
+			return nil, errors.New("Invalid step-up route: " + pair)
+		}
+		route := &StepUpRoute{
+			PathPrefix: strings.TrimSpace(parts[0]),
+			MaxAge:     time.Duration(minutes),
+		}
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return nil, errors.New("Invalid step-up route: " + pair)
+		}
+		res = append(res, route)
+	}
+	return res, nil
+}
+
+// GetStepUpMaxAge returns the strictest maximum authentication age in minutes of all step-up routes matching the URL,
+// or 0 if no route matches
+func GetStepUpMaxAge(url string) time.Duration {
+	var res time.Duration
+	for _, route := range GetConfig().StepUpRoutes {
+		if IsPathPrefixMatch(url, route.PathPrefix) && (res == 0 || route.MaxAge < res) {
+			res = route.MaxAge
+		}
+	}
+	return res
+}
+
+// HasRecentAuthentication checks if the claims satisfy the step-up routes matching the URL
+func HasRecentAuthentication(url string, claims *Claims) bool {
+	maxAge := GetStepUpMaxAge(url)
+	if maxAge == 0 {
+		return true
+	}
+	return claims.AuthTime > 0 && time.Unix(claims.AuthTime, 0).Add(maxAge*time.Minute).After(time.Now())
+}
+
+// SendStepUpRequired sends a 401 response with the insufficient_user_authentication error
+// and the required maximum authentication age in seconds (RFC 9470, section 3)
+func SendStepUpRequired(w http.ResponseWriter, r *http.Request) {
+	scheme := "Bearer"
+	if strings.HasPrefix(r.Header.Get("Authorization"), "DPoP ") {
+		scheme = "DPoP"
+	}
+	maxAge := int64((GetStepUpMaxAge(GetRequestPath(r)) * time.Minute).Seconds())
+	w.Header().Set("WWW-Authenticate", scheme+` error="insufficient_user_authentication", `+
+		`error_description="A more recent authentication is required", max_age=`+strconv.FormatInt(maxAge, 10))
+	SendUnauthorized(w)
+}
+
+// authenticationMethods returns the Authentication Method Reference values (RFC 8176) for a password login
+func authenticationMethods(otp bool) []string {
+	if otp {
+		return []string{"pwd", "otp", "mfa"}
+	}
+	return []string{"pwd"}
+}
+
+// authenticationContextClass returns the 'acr' value for the authentication methods used
+func authenticationContextClass(amr []string) string {
+	for _, method := range amr {
+		if method == "otp" {
+			return acrMultiFactor
+		}
+	}
+	return acrSingleFactor
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func setupStepUpTest() func() {
+	GetConfig().StepUpRoutes, _ = ParseStepUpRoutes("/some/route/billing:5,/some/route:60")
+	return func() {
+		GetConfig().StepUpRoutes = make([]*StepUpRoute, 0)
+	}
+}
+
+func stepUp(accessToken, payload string) (*LoginResponse, int) {
+	req := newHTTPRequest("POST", "/auth/stepup", accessToken, bytes.NewBufferString(payload))
+	res := executePublicTestRequest(req)
+	var loginResponse LoginResponse
+	json.Unmarshal(res.Body.Bytes(), &loginResponse)
+	return &loginResponse, res.Code
+}
+
+func TestParseStepUpRoutes(t *testing.T) {
+	routes, err := ParseStepUpRoutes("/billing:5, /admin:15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 step-up routes, got %d", len(routes))
+	}
+	checkTestString(t, "/billing", routes[0].PathPrefix)
+	checkTestInt(t, 5, int(routes[0].MaxAge))
+
+	for _, s := range []string{"/billing", "billing:5", "/billing:0", "/billing:x"} {
+		if _, err := ParseStepUpRoutes(s); err == nil {
+			t.Errorf("Expected error for step-up route '%s'", s)
+		}
+	}
+}
+
+func TestStepUpMaxAge(t *testing.T) {
+	defer setupStepUpTest()()
+	checkTestInt(t, 5, int(GetStepUpMaxAge("/some/route/billing/invoices")))
+	checkTestInt(t, 60, int(GetStepUpMaxAge("/some/route/test.html")))
+	checkTestInt(t, 0, int(GetStepUpMaxAge("/other/route")))
+
+	claims := &Claims{AuthTime: time.Now().Add(-10 * time.Minute).Unix()}
+	if HasRecentAuthentication("/some/route/billing", claims) {
+		t.Fatal("Expected authentication to be too old for billing route")
+	}
+	if !HasRecentAuthentication("/some/route/test.html", claims) {
+		t.Fatal("Expected authentication to be recent enough for route")
+	}
+	if HasRecentAuthentication("/some/route/test.html", &Claims{}) {
+		t.Fatal("Expected claims without auth_time to be rejected")
+	}
+}
+
+func TestLoginAuthClaims(t *testing.T) {
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+	claims, err := ParseAccessToken(loginResponse.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, "pwd", strings.Join(claims.AuthMethods, " "))
+	checkTestString(t, acrSingleFactor, claims.AuthContext)
+	if claims.AuthTime == 0 || claims.AuthTime > time.Now().Unix() {
+		t.Fatalf("Expected auth_time to be set, got %d", claims.AuthTime)
+	}
+
+	// Refreshed tokens keep the time and methods of the login
+	authTime := claims.AuthTime
+	GetRefreshTokenRepository().GetCollection().UpdateOne(context.TODO(), bson.M{"tokenHash": HashToken(loginResponse.RefreshToken)}, bson.M{"$set": bson.M{
+		"sessionCreateDate": time.Unix(authTime, 0).Add(-time.Hour),
+	}})
+	loginResponse, code := refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	checkTestResponseCode(t, http.StatusOK, code)
+	claims, _ = ParseAccessToken(loginResponse.AccessToken)
+	checkTestInt(t, int(authTime-3600), int(claims.AuthTime))
+	checkTestString(t, "pwd", strings.Join(claims.AuthMethods, " "))
+}
+
+func TestLoginAuthClaimsOTP(t *testing.T) {
+	clearTestDB()
+	_, secret := createOTPTestUser(true)
+	passcode, _ := totp.GenerateCode(secret, time.Now().UTC())
+	loginResponse := loginUserOTP("foo@bar.com", "12345678", passcode)
+	claims, err := ParseAccessToken(loginResponse.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, "pwd otp mfa", strings.Join(claims.AuthMethods, " "))
+	checkTestString(t, acrMultiFactor, claims.AuthContext)
+
+	// OTP users step up with their second factor
+	_, code := stepUp(loginResponse.AccessToken, `{"password": "12345678"}`)
+	checkTestResponseCode(t, http.StatusUnauthorized, code)
+	passcode, _ = totp.GenerateCode(secret, time.Now().UTC())
+	stepUpResponse, code := stepUp(loginResponse.AccessToken, `{"otp": "`+passcode+`"}`)
+	checkTestResponseCode(t, http.StatusOK, code)
+	claims, _ = ParseAccessToken(stepUpResponse.AccessToken)
+	checkTestString(t, "otp", strings.Join(claims.AuthMethods, " "))
+	checkTestString(t, acrMultiFactor, claims.AuthContext)
+}
+
+func TestStepUpRoutes(t *testing.T) {
+	defer setupStepUpTest()()
+	handler := &dummyProxyHandler{}
+	var proxy *http.Server = &http.Server{
+		Addr:    "0.0.0.0:8090",
+		Handler: handler,
+	}
+	go func() {
+		proxy.ListenAndServe()
+	}()
+
+	clearTestDB()
+	loginResponse := createLoginTestUser()
+
+	req := newHTTPRequest("GET", "/some/route/billing/invoices", loginResponse.AccessToken, nil)
+	res := executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+
+	// Sessions started more than 5 minutes ago require a step-up for the billing route
+	GetRefreshTokenRepository().GetCollection().UpdateOne(context.TODO(), bson.M{"tokenHash": HashToken(loginResponse.RefreshToken)}, bson.M{"$set": bson.M{
+		"sessionCreateDate": time.Now().Add(-10 * time.Minute),
+	}})
+	loginResponse, _ = refreshTokens(loginResponse.AccessToken, loginResponse.RefreshToken)
+	req = newHTTPRequest("GET", "/some/route/billing/invoices", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+	checkTestString(t, `Bearer error="insufficient_user_authentication", error_description="A more recent authentication is required", max_age=300`, res.Header().Get("WWW-Authenticate"))
+
+	req = newHTTPRequest("GET", "/some/route/test.html", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+
+	_, code := stepUp(loginResponse.AccessToken, `{"password": "invalid123"}`)
+	checkTestResponseCode(t, http.StatusUnauthorized, code)
+	stepUpResponse, code := stepUp(loginResponse.AccessToken, `{"password": "12345678"}`)
+	checkTestResponseCode(t, http.StatusOK, code)
+	checkStringNotEmpty(t, stepUpResponse.AccessToken)
+	if stepUpResponse.RefreshToken != "" {
+		t.Fatal("Expected step-up not to issue a refresh token")
+	}
+
+	req = newHTTPRequest("GET", "/some/route/billing/invoices", stepUpResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	proxy.Shutdown(context.TODO())
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+}
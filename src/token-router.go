@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// TokenRouter handles the backend requests for inspecting tokens
+type TokenRouter struct {
+}
+
+func (router *TokenRouter) setupRoutes(s *mux.Router) {
+	s.HandleFunc("/introspect", router.introspect).Methods("POST")
+}
+
+// introspect handles token introspection requests (RFC 7662)
+func (router *TokenRouter) introspect(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+		log.Println("Received invalid token introspection request")
+		SendOAuthError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	token := r.PostForm.Get("token")
+	var res *IntrospectionResponse
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		if res = router._IntrospectRefreshToken(token); res == nil {
+			res = router._IntrospectAccessToken(token)
+		}
+	} else {
+		if res = router._IntrospectAccessToken(token); res == nil {
+			res = router._IntrospectRefreshToken(token)
+		}
+	}
+	if res == nil {
+		res = &IntrospectionResponse{Active: false}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, res)
+}
+
+func (router *TokenRouter) _IntrospectAccessToken(token string) *IntrospectionResponse {
+	claims, err := ResolveAccessToken(token)
+	if err != nil {
+		return nil
+	}
+	res := &IntrospectionResponse{
+		Active:    true,
+		TokenType: "access_token",
+		ClientID:  claims.ClientID,
+		Scope:     claims.Scope,
+		Actor:     claims.Actor,
+		Cnf:       claims.Confirmation,
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		TokenID:   claims.Id,
+	}
+	if claims.ClientID != "" {
+		client := GetServiceClientRepository().GetByClientID(claims.ClientID)
+		if client == nil || !client.Enabled {
+			return nil
+		}
+		res.Subject = claims.ClientID
+		return res
+	}
+	user := GetUserRepository().GetOne(claims.UserID)
+	if user == nil || !user.Confirmed || !user.Enabled {
+		return nil
+	}
+	res.Subject = user.ID.Hex()
+	res.Username = user.Email
+	res.User = router._GetUserState(user)
+	return res
+}
+
+func (router *TokenRouter) _IntrospectRefreshToken(token string) *IntrospectionResponse {
+	refreshToken := GetRefreshTokenRepository().GetByToken(token)
+	if refreshToken == nil || refreshToken.Consumed {
+		return nil
+	}
+	user := GetUserRepository().GetOne(refreshToken.UserID.Hex())
+	if user == nil || !user.Confirmed || !user.Enabled {
+		return nil
+	}
+	return &IntrospectionResponse{
+		Active:    true,
+		TokenType: "refresh_token",
+		Subject:   user.ID.Hex(),
+		Username:  user.Email,
+		ExpiresAt: refreshToken.ExpiryDate.Unix(),
+		IssuedAt:  refreshToken.CreateDate.Unix(),
+		User:      router._GetUserState(user),
+	}
+}
+
+func (router *TokenRouter) _GetUserState(user *User) *IntrospectionUserState {
+	return &IntrospectionUserState{
+		ID:         user.ID.Hex(),
+		Email:      user.Email,
+		Confirmed:  user.Confirmed,
+		Enabled:    user.Enabled,
+		OTPEnabled: user.OTPEnabled,
+	}
+}
+
+// IntrospectionResponse holds the response payload of token introspection requests.
+// Inactive tokens only carry the 'active' member.
+type IntrospectionResponse struct {
+	Active    bool                    `json:"active"`
+	TokenType string                  `json:"token_type,omitempty"`
+	Subject   string                  `json:"sub,omitempty"`
+	Username  string                  `json:"username,omitempty"`
+	ClientID  string                  `json:"client_id,omitempty"`
+	Scope     string                  `json:"scope,omitempty"`
+	ExpiresAt int64                   `json:"exp,omitempty"`
+	IssuedAt  int64                   `json:"iat,omitempty"`
+	TokenID   string                  `json:"jti,omitempty"`
+	Actor     *ActorClaim             `json:"act,omitempty"`
+	Cnf       *ConfirmationClaim      `json:"cnf,omitempty"`
+	User      *IntrospectionUserState `json:"user,omitempty"`
+}
+
+// IntrospectionUserState holds the account state of the user a token has been issued to
+type IntrospectionUserState struct {
+	ID         string `json:"id"`
+	Email      string `json:"email"`
+	Confirmed  bool   `json:"confirmed"`
+	Enabled    bool   `json:"enabled"`
+	OTPEnabled bool   `json:"otpEnabled"`
+}
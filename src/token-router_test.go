@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func introspectToken(token, hint string) (*IntrospectionResponse, int) {
+	form := url.Values{}
+	form.Set("token", token)
+	if hint != "" {
+		form.Set("token_type_hint", hint)
+	}
+	req, _ := http.NewRequest("POST", "/tokens/introspect", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := executeBackendTestRequest(req)
+	var introspection IntrospectionResponse
+	json.Unmarshal(res.Body.Bytes(), &introspection)
+	return &introspection, res.Code
+}
+
+func TestIntrospectAccessToken(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	res, status := introspectToken(loginResponse.AccessToken, "")
+	checkTestResponseCode(t, http.StatusOK, status)
+	if !res.Active {
+		t.Fatal("Expected access token to be active")
+	}
+	checkTestString(t, "access_token", res.TokenType)
+	checkTestString(t, user.ID.Hex(), res.Subject)
+	checkTestString(t, "foo@bar.com", res.Username)
+	if res.User == nil || !res.User.Enabled || !res.User.Confirmed {
+		t.Fatal("Expected user state in response")
+	}
+	if res.ExpiresAt == 0 {
+		t.Fatal("Expected exp in response")
+	}
+}
+
+func TestIntrospectRefreshToken(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	res, status := introspectToken(loginResponse.RefreshToken, "refresh_token")
+	checkTestResponseCode(t, http.StatusOK, status)
+	if !res.Active {
+		t.Fatal("Expected refresh token to be active")
+	}
+	checkTestString(t, "refresh_token", res.TokenType)
+	checkTestString(t, user.ID.Hex(), res.Subject)
+}
+
+func TestIntrospectInactiveTokens(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	res, _ := introspectToken("invalid", "")
+	if res.Active {
+		t.Fatal("Expected invalid token to be inactive")
+	}
+
+	// Disabled user
+	user.Enabled = false
+	GetUserRepository().Update(user)
+	res, _ = introspectToken(loginResponse.AccessToken, "")
+	if res.Active || res.Subject != "" {
+		t.Fatal("Expected access token of disabled user to be inactive")
+	}
+	res, _ = introspectToken(loginResponse.RefreshToken, "")
+	if res.Active {
+		t.Fatal("Expected refresh token of disabled user to be inactive")
+	}
+}
+
+func TestIntrospectRevokedAccessToken(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	GetRevokedTokenRepository().RevokeAllForUser(user.ID.Hex())
+	res, status := introspectToken(loginResponse.AccessToken, "access_token")
+	checkTestResponseCode(t, http.StatusOK, status)
+	if res.Active {
+		t.Fatal("Expected revoked access token to be inactive")
+	}
+}
+
+func TestIntrospectMissingToken(t *testing.T) {
+	_, status := introspectToken("", "")
+	checkTestResponseCode(t, http.StatusBadRequest, status)
+}
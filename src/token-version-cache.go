@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type tokenVersionCacheEntry struct {
+	Version    int
+	ExpiryDate time.Time
+}
+
+// TokenVersionCache holds the users' current token versions for a short time,
+// so verifying an access token doesn't require a database lookup per request
+type TokenVersionCache struct {
+	mutex   sync.RWMutex
+	entries map[string]*tokenVersionCacheEntry
+}
+
+var _tokenVersionCacheInstance *TokenVersionCache
+var _tokenVersionCacheOnce sync.Once
+
+func GetTokenVersionCache() *TokenVersionCache {
+	_tokenVersionCacheOnce.Do(func() {
+		_tokenVersionCacheInstance = &TokenVersionCache{
+			entries: make(map[string]*tokenVersionCacheEntry),
+		}
+	})
+	return _tokenVersionCacheInstance
+}
+
+// Get returns the user's current token version or -1 if the user doesn't exist
+func (c *TokenVersionCache) Get(userID string) int {
+	c.mutex.RLock()
+	e, ok := c.entries[userID]
+	c.mutex.RUnlock()
+	if ok && e.ExpiryDate.After(time.Now()) {
+		return e.Version
+	}
+	version := -1
+	if user := GetUserRepository().GetOne(userID); user != nil {
+		version = user.TokenVersion
+	}
+	c.Set(userID, version)
+	return version
+}
+
+func (c *TokenVersionCache) Set(userID string, version int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[userID] = &tokenVersionCacheEntry{
+		Version:    version,
+		ExpiryDate: time.Now().Add(GetConfig().TokenVersionCacheTTL * time.Second),
+	}
+}
+
+// CleanUp removes the expired entries
+func (c *TokenVersionCache) CleanUp() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for userID, e := range c.entries {
+		if e.ExpiryDate.Before(time.Now()) {
+			delete(c.entries, userID)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamSignatureLabel is the label of the signature in the Signature and Signature-Input headers
+const upstreamSignatureLabel = "proxy"
+
+// upstreamIdentityHeaders lists the headers carrying the authenticated identity to the upstream
+var upstreamIdentityHeaders = []string{"X-Auth-UserID", "X-Auth-ClientID"}
+
+// UpstreamSigner signs requests forwarded to the upstream using HTTP Message Signatures (RFC 9421),
+// so upstreams can verify the identity headers have been set by the proxy
+type UpstreamSigner struct {
+	key *SigningKey
+}
+
+var _upstreamSignerInstance *UpstreamSigner
+var _upstreamSignerOnce sync.Once
+
+func GetUpstreamSigner() *UpstreamSigner {
+	_upstreamSignerOnce.Do(func() {
+		_upstreamSignerInstance = &UpstreamSigner{}
+	})
+	return _upstreamSignerInstance
+}
+
+// Load reads the Ed25519 signing key from UpstreamSigningKeyFile, generating it if the file doesn't exist
+func (s *UpstreamSigner) Load() {
+	if !GetConfig().UpstreamSigningEnable {
+		return
+	}
+	key, err := LoadSigningKey(SigningMethodEdDSA.Alg(), GetConfig().UpstreamSigningKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.key = key
+}
+
+// Sign adds the Signature-Input and Signature headers covering method, path, query, identity headers
+// and mapped headers of the request
+func (s *UpstreamSigner) Sign(r *http.Request) error {
+	if s.key == nil {
+		return errors.New("upstream signature key not loaded")
+	}
+	components := []string{"@method", "@path", "@query"}
+	headers := append([]string{}, upstreamIdentityHeaders...)
+	for _, m := range GetConfig().HeaderMappings {
+		headers = append(headers, m.Header)
+	}
+	for _, header := range headers {
+		if _, ok := r.Header[http.CanonicalHeaderKey(header)]; ok {
+			components = append(components, strings.ToLower(header))
+		}
+	}
+	params := BuildSignatureParams(components, time.Now().Unix(), GetConfig().UpstreamSigningKeyID)
+	sig := ed25519.Sign(s.key.PrivateKey.(ed25519.PrivateKey), []byte(BuildSignatureBase(r, components, params)))
+	r.Header.Set("Signature-Input", upstreamSignatureLabel+"="+params)
+	r.Header.Set("Signature", upstreamSignatureLabel+"=:"+base64.StdEncoding.EncodeToString(sig)+":")
+	return nil
+}
+
+// upstreamSigningTransport signs requests to the upstream if UPSTREAM_SIGNATURE_ENABLE is set.
+// Requests which can't be signed are not sent, so the proxy responds with 502 instead of forwarding them unsigned.
+type upstreamSigningTransport struct {
+	next http.RoundTripper
+}
+
+func (t *upstreamSigningTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !GetConfig().UpstreamSigningEnable {
+		return t.next.RoundTrip(r)
+	}
+	signed := r.Clone(r.Context())
+	if err := GetUpstreamSigner().Sign(signed); err != nil {
+		return nil, errors.New("could not sign upstream request: " + err.Error())
+	}
+	return t.next.RoundTrip(signed)
+}
+
+// BuildSignatureParams returns the serialized signature parameters (RFC 9421, section 2.3)
+func BuildSignatureParams(components []string, created int64, keyID string) string {
+	quoted := make([]string, len(components))
+	for i, c := range components {
+		quoted[i] = strconv.Quote(c)
+	}
+	return "(" + strings.Join(quoted, " ") + ");created=" + strconv.FormatInt(created, 10) +
+		";keyid=" + strconv.Quote(keyID) + ";alg=\"ed25519\""
+}
+
+// BuildSignatureBase returns the signature base for the covered components of the request (RFC 9421, section 2.5)
+func BuildSignatureBase(r *http.Request, components []string, params string) string {
+	var b strings.Builder
+	for _, c := range components {
+		var value string
+		switch c {
+		case "@method":
+			value = r.Method
+		case "@path":
+			value = r.URL.EscapedPath()
+			if value == "" {
+				value = "/"
+			}
+		case "@query":
+			value = "?" + r.URL.RawQuery
+		default:
+			values := r.Header[http.CanonicalHeaderKey(c)]
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.TrimSpace(v)
+			}
+			value = strings.Join(trimmed, ", ")
+		}
+		b.WriteString(strconv.Quote(c) + ": " + value + "\n")
+	}
+	b.WriteString("\"@signature-params\": " + params)
+	return b.String()
+}
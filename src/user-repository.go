@@ -22,7 +22,11 @@ type User struct {
 	Enabled        bool               `json:"enabled" bson:"enabled"`
 	OTPEnabled     bool               `json:"otpEnabled" bson:"otpEnabled"`
 	OTPSecret      string             `bson:"otpSecret"`
+	TokenVersion   int                `json:"tokenVersion" bson:"tokenVersion"`
 	CreateDate     time.Time          `json:"createDate" bson:"createDate"`
+	Identities     []ExternalIdentity `json:"identities,omitempty" bson:"identities,omitempty"`
+	Roles          []string           `json:"roles,omitempty" bson:"roles,omitempty"`
+	Groups         []string           `json:"groups,omitempty" bson:"groups,omitempty"`
 	Data           interface{}        `json:"data" bson:"data,omitempty"`
 }
 
@@ -51,6 +55,17 @@ func GetUserRepository() *UserRepository {
 		if err != nil {
 			log.Fatal(err)
 		}
+		// Create index on the identities of external issuers
+		mod = mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "identities.issuer", Value: 1},
+				{Key: "identities.subject", Value: 1},
+			},
+		}
+		_, err = _userRepositoryInstance.GetCollection().Indexes().CreateOne(ctx, mod)
+		if err != nil {
+			log.Fatal(err)
+		}
 	})
 	return _userRepositoryInstance
 }
@@ -89,16 +104,133 @@ func (r *UserRepository) GetByEmail(email string) *User {
 	return &user
 }
 
+// GetByExternalIdentity returns the user linked to the subject of an external issuer
+func (r *UserRepository) GetByExternalIdentity(issuer, subject string) *User {
+	var user User
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}
+	err := r.GetCollection().FindOne(context.TODO(), filter).Decode(&user)
+	if err != nil {
+		return nil
+	}
+	return &user
+}
+
+// GetWithData returns all users whose custom data contains the dot-separated path, e.g. 'data.roles'
+func (r *UserRepository) GetWithData(path string) ([]*User, error) {
+	var results []*User
+	cur, err := r.GetCollection().Find(context.TODO(), bson.M{path: bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.TODO())
+	for cur.Next(context.TODO()) {
+		var user User
+		if err := cur.Decode(&user); err != nil {
+			return nil, err
+		}
+		results = append(results, &user)
+	}
+	return results, cur.Err()
+}
+
+// AddExternalIdentity links the user to the subject of an external issuer
+func (r *UserRepository) AddExternalIdentity(u *User, identity ExternalIdentity) {
+	_, err := r.GetCollection().UpdateOne(context.TODO(), bson.M{"_id": u.ID}, bson.M{"$addToSet": bson.M{"identities": identity}})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	u.Identities = append(u.Identities, identity)
+}
+
+// AddRole assigns the role to the user
+func (r *UserRepository) AddRole(u *User, role string) {
+	if r._UpdateList(u, "$addToSet", "roles", role) && !ContainsScope(u.Roles, role) {
+		u.Roles = append(u.Roles, role)
+	}
+}
+
+// RemoveRole removes the role from the user
+func (r *UserRepository) RemoveRole(u *User, role string) {
+	if r._UpdateList(u, "$pull", "roles", role) {
+		u.Roles = removeString(u.Roles, role)
+	}
+}
+
+// AddGroup adds the user to the group
+func (r *UserRepository) AddGroup(u *User, group string) {
+	if r._UpdateList(u, "$addToSet", "groups", group) && !ContainsScope(u.Groups, group) {
+		u.Groups = append(u.Groups, group)
+	}
+}
+
+// RemoveGroup removes the user from the group
+func (r *UserRepository) RemoveGroup(u *User, group string) {
+	if r._UpdateList(u, "$pull", "groups", group) {
+		u.Groups = removeString(u.Groups, group)
+	}
+}
+
+func (r *UserRepository) _UpdateList(u *User, op, field, value string) bool {
+	_, err := r.GetCollection().UpdateOne(context.TODO(), bson.M{"_id": u.ID}, bson.M{op: bson.M{field: value}})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func removeString(list []string, s string) []string {
+	res := make([]string, 0)
+	for _, item := range list {
+		if item != s {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
 func (r *UserRepository) Update(u *User) {
-	_, err := r.GetCollection().UpdateOne(context.TODO(), bson.M{"_id": u.ID}, bson.M{"$set": u})
+	b, err := bson.Marshal(u)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var set bson.M
+	if err := bson.Unmarshal(b, &set); err != nil {
+		log.Println(err)
+		return
+	}
+	// The token version is only changed by BumpTokenVersion, roles and groups only by AddRole, RemoveRole, AddGroup
+	// and RemoveGroup, so a stale user object can't reset them
+	delete(set, "tokenVersion")
+	delete(set, "roles")
+	delete(set, "groups")
+	_, err = r.GetCollection().UpdateOne(context.TODO(), bson.M{"_id": u.ID}, bson.M{"$set": set})
 	if err != nil {
 		log.Println(err)
 	}
 }
 
+// BumpTokenVersion invalidates all access tokens and refresh tokens issued to the user so far
+func (r *UserRepository) BumpTokenVersion(u *User) {
+	var updated User
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := r.GetCollection().FindOneAndUpdate(context.TODO(), bson.M{"_id": u.ID}, bson.M{"$inc": bson.M{"tokenVersion": 1}}, opts).Decode(&updated)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println("Bumped token version for UserID", u.ID.Hex(), "to", updated.TokenVersion)
+	u.TokenVersion = updated.TokenVersion
+	GetTokenVersionCache().Set(u.ID.Hex(), u.TokenVersion)
+	GetRefreshTokenRepository().DeleteAllForUser(u.ID.Hex())
+}
+
 func (r *UserRepository) Delete(u *User) {
 	GetPendingActionRepository().DeleteAllForUser(u.ID.Hex())
 	GetRefreshTokenRepository().DeleteAllForUser(u.ID.Hex())
+	GetAuthorizationCodeRepository().DeleteAllForUser(u.ID.Hex())
 	_, err := r.GetCollection().DeleteOne(context.TODO(), bson.M{"_id": u.ID})
 	if err != nil {
 		log.Println(err)
@@ -22,6 +22,18 @@ func (router *UserRouter) setupRoutes(s *mux.Router) {
 	s.HandleFunc("/{id}/data", router.getUserData).Methods("GET")
 	s.HandleFunc("/{id}/data", router.setUserData).Methods("PUT")
 	s.HandleFunc("/{id}/checkpw", router.checkPassword).Methods("POST")
+	s.HandleFunc("/{id}/roles/{role}", router.addRole).Methods("PUT")
+	s.HandleFunc("/{id}/roles/{role}", router.removeRole).Methods("DELETE")
+	s.HandleFunc("/{id}/groups/{group}", router.addGroup).Methods("PUT")
+	s.HandleFunc("/{id}/groups/{group}", router.removeGroup).Methods("DELETE")
+	s.HandleFunc("/{id}/tokens/revoke", router.revokeAllTokens).Methods("POST")
+	s.HandleFunc("/{id}/logout-all", router.logoutAll).Methods("POST")
+	s.HandleFunc("/{id}/tokens/{jti}/revoke", router.revokeToken).Methods("POST")
+	s.HandleFunc("/{id}/sessions", router.getSessions).Methods("GET")
+	s.HandleFunc("/{id}/sessions/revoke-others", router.revokeOtherSessions).Methods("POST")
+	s.HandleFunc("/{id}/sessions/{sid}", router.revokeSession).Methods("DELETE")
+	s.HandleFunc("/{id}/impersonate", router.impersonate).Methods("POST")
+	s.HandleFunc("/{id}/audit", router.getAuditLog).Methods("GET")
 	s.HandleFunc("/", router.Create).Methods("POST")
 	s.HandleFunc("/", router.getAll).Methods("GET")
 }
@@ -75,6 +87,11 @@ func (router *UserRouter) delete(w http.ResponseWriter, r *http.Request) {
 		SendNotFound(w)
 		return
 	}
+	if err := GetRevokedTokenRepository().RevokeAllForUser(user.ID.Hex()); err != nil {
+		log.Println("Could not revoke access tokens of UserID", user.ID.Hex(), "- user not deleted:", err)
+		SendInternalServerError(w)
+		return
+	}
 	GetUserRepository().Delete(user)
 	SendUpdated(w)
 }
@@ -100,6 +117,7 @@ func (router *UserRouter) setEmail(w http.ResponseWriter, r *http.Request) {
 	}
 	user.Email = data.Email
 	GetUserRepository().Update(user)
+	GetUserRepository().BumpTokenVersion(user)
 	SendUpdated(w)
 }
 
@@ -116,6 +134,7 @@ func (router *UserRouter) setPassword(w http.ResponseWriter, r *http.Request) {
 	}
 	user.HashedPassword = GetUserRepository().GetHashedPassword(data.Password)
 	GetUserRepository().Update(user)
+	GetUserRepository().BumpTokenVersion(user)
 	SendUpdated(w)
 }
 
@@ -127,6 +146,12 @@ func (router *UserRouter) disableUser(w http.ResponseWriter, r *http.Request) {
 	}
 	user.Enabled = false
 	GetUserRepository().Update(user)
+	GetUserRepository().BumpTokenVersion(user)
+	if err := GetRevokedTokenRepository().RevokeAllForUser(user.ID.Hex()); err != nil {
+		log.Println("Could not revoke access tokens of UserID", user.ID.Hex(), ":", err)
+		SendInternalServerError(w)
+		return
+	}
 	SendUpdated(w)
 }
 
@@ -157,6 +182,40 @@ func (router *UserRouter) setUserData(w http.ResponseWriter, r *http.Request) {
 	SendUpdated(w)
 }
 
+func (router *UserRouter) addRole(w http.ResponseWriter, r *http.Request) {
+	router._UpdateRoles(w, r, "role", GetUserRepository().AddRole)
+}
+
+func (router *UserRouter) removeRole(w http.ResponseWriter, r *http.Request) {
+	router._UpdateRoles(w, r, "role", GetUserRepository().RemoveRole)
+}
+
+func (router *UserRouter) addGroup(w http.ResponseWriter, r *http.Request) {
+	router._UpdateRoles(w, r, "group", GetUserRepository().AddGroup)
+}
+
+func (router *UserRouter) removeGroup(w http.ResponseWriter, r *http.Request) {
+	router._UpdateRoles(w, r, "group", GetUserRepository().RemoveGroup)
+}
+
+// _UpdateRoles applies the update to the user and the role or group named by the mux variable.
+// The change is reflected in the next access token issued on login or refresh.
+func (router *UserRouter) _UpdateRoles(w http.ResponseWriter, r *http.Request, key string, update func(*User, string)) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	name := mux.Vars(r)[key]
+	if !IsValidRoleName(name) {
+		SendBadRequest(w)
+		return
+	}
+	update(user, name)
+	log.Println("Updated", key, name, "of UserID", user.ID.Hex())
+	SendUpdated(w)
+}
+
 func (router *UserRouter) getUserData(w http.ResponseWriter, r *http.Request) {
 	user := router.getUserFromMuxVars(w, r)
 	if user == nil {
@@ -188,6 +247,154 @@ func (router *UserRouter) checkPassword(w http.ResponseWriter, r *http.Request)
 	SendJSON(w, result)
 }
 
+func (router *UserRouter) revokeAllTokens(w http.ResponseWriter, r *http.Request) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	GetRefreshTokenRepository().DeleteAllForUser(user.ID.Hex())
+	if err := GetRevokedTokenRepository().RevokeAllForUser(user.ID.Hex()); err != nil {
+		log.Println("Could not revoke access tokens of UserID", user.ID.Hex(), ":", err)
+		SendInternalServerError(w)
+		return
+	}
+	SendUpdated(w)
+}
+
+func (router *UserRouter) logoutAll(w http.ResponseWriter, r *http.Request) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	GetUserRepository().BumpTokenVersion(user)
+	SendUpdated(w)
+}
+
+func (router *UserRouter) revokeToken(w http.ResponseWriter, r *http.Request) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	vars := mux.Vars(r)
+	err := GetRevokedTokenRepository().Create(&RevokedToken{
+		TokenID:    vars["jti"],
+		UserID:     user.ID,
+		ExpiryDate: time.Now().Add(time.Duration(time.Minute) * GetConfig().MaxAccessTokenLifetime()),
+	})
+	if err != nil {
+		log.Println("Could not revoke access token", vars["jti"], "of UserID", user.ID.Hex(), ":", err)
+		SendInternalServerError(w)
+		return
+	}
+	SendUpdated(w)
+}
+
+func (router *UserRouter) getSessions(w http.ResponseWriter, r *http.Request) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	SendJSON(w, GetRefreshTokenRepository().GetSessionsForUser(user.ID.Hex()))
+}
+
+func (router *UserRouter) revokeSession(w http.ResponseWriter, r *http.Request) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	vars := mux.Vars(r)
+	if !GetRefreshTokenRepository().DeleteSession(user.ID.Hex(), vars["sid"]) {
+		SendNotFound(w)
+		return
+	}
+	SendUpdated(w)
+}
+
+func (router *UserRouter) revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	var data RevokeOtherSessionsRequest
+	if UnmarshalValidateBody(r, &data) != nil {
+		SendBadRequest(w)
+		return
+	}
+	GetRefreshTokenRepository().DeleteOtherSessions(user.ID.Hex(), data.SessionID)
+	SendUpdated(w)
+}
+
+// impersonate issues a short-lived access token for the user on behalf of an actor (RFC 8693 style)
+func (router *UserRouter) impersonate(w http.ResponseWriter, r *http.Request) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	var data ImpersonateRequest
+	if UnmarshalValidateBody(r, &data) != nil {
+		SendBadRequest(w)
+		return
+	}
+	if !user.Confirmed || !user.Enabled {
+		log.Println("Denied impersonation of unconfirmed or disabled UserID", user.ID.Hex(), "by", data.Actor)
+		SendBadRequest(w)
+		return
+	}
+	if GetConfig().ImpersonationDenyOTP && user.OTPEnabled {
+		log.Println("Denied impersonation of UserID", user.ID.Hex(), "with OTP enabled by", data.Actor)
+		SendForbidden(w)
+		return
+	}
+	claims := NewAccessTokenClaims(user, GetConfig().ImpersonationLifetime)
+	claims.Actor = &ActorClaim{Subject: data.Actor}
+	accessToken, err := SignAccessToken(claims)
+	if err != nil {
+		log.Println("Could not sign access token:", err)
+		SendInternalServerError(w)
+		return
+	}
+	// The token is only handed out if its issuance has been recorded
+	err = GetAuditLogRepository().Create(&AuditLogEntry{
+		Action:     AuditActionImpersonate,
+		UserID:     user.ID,
+		Actor:      data.Actor,
+		Reason:     data.Reason,
+		TokenID:    claims.Id,
+		RemoteAddr: r.RemoteAddr,
+		CreateDate: time.Now(),
+		ExpiryDate: time.Unix(claims.ExpiresAt, 0),
+	})
+	if err != nil {
+		log.Println("Could not record impersonation of UserID", user.ID.Hex(), "by", data.Actor, "- no token issued")
+		SendInternalServerError(w)
+		return
+	}
+	log.Println("Issued impersonation token", claims.Id, "for UserID", user.ID.Hex(), "to", data.Actor)
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, &TokenResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: "urn:ietf:params:oauth:token-type:access_token",
+		TokenType:       "Bearer",
+		ExpiresIn:       int64((GetConfig().ImpersonationLifetime * time.Minute).Seconds()),
+	})
+}
+
+func (router *UserRouter) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	user := router.getUserFromMuxVars(w, r)
+	if user == nil {
+		SendNotFound(w)
+		return
+	}
+	SendJSON(w, GetAuditLogRepository().GetAllForUser(user.ID.Hex()))
+}
+
 func (router *UserRouter) getAll(w http.ResponseWriter, r *http.Request) {
 	// TODO Implement method
 	SendInternalServerError(w)
@@ -227,6 +434,15 @@ type SetPasswordRequest struct {
 	Password string `json:"password" validate:"required,min=8,max=32"`
 }
 
+type RevokeOtherSessionsRequest struct {
+	SessionID string `json:"sessionId" validate:"required"`
+}
+
+type ImpersonateRequest struct {
+	Actor  string `json:"actor" validate:"required"`
+	Reason string `json:"reason"`
+}
+
 type BoolResult struct {
 	Result bool `json:"result"`
 }
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -369,6 +372,233 @@ func TestCheckPasswordNegative(t *testing.T) {
 	}
 }
 
+func TestDisableUserRevokesAccessToken(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	req, _ := http.NewRequest("PUT", "/users/"+user.ID.Hex()+"/disable", nil)
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestRevokeAllTokens(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	req, _ := http.NewRequest("POST", "/users/"+user.ID.Hex()+"/tokens/revoke", nil)
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	if GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken) != nil {
+		t.Error("Expected refresh token to be deleted")
+	}
+}
+
+func TestRevokeAllTokensCoversLongestLifetime(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	GetConfig().ImpersonationLifetime = GetConfig().AccessTokenLifetime + 60
+	defer func() {
+		GetConfig().ImpersonationLifetime = 5
+	}()
+
+	req, _ := http.NewRequest("POST", "/users/"+user.ID.Hex()+"/tokens/revoke", nil)
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	var e RevokedToken
+	GetRevokedTokenRepository().GetCollection().FindOne(context.TODO(), bson.M{"userId": user.ID}).Decode(&e)
+	if e.ExpiryDate.Before(time.Now().Add((GetConfig().AccessTokenLifetime + 59) * time.Minute)) {
+		t.Errorf("Expected denylist entry to outlive impersonation tokens, expires %v", e.ExpiryDate)
+	}
+}
+
+func TestRevokeSingleToken(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+	loginResponse2 := loginUser("foo@bar.com", "12345678")
+
+	claims := &Claims{}
+	new(jwt.Parser).ParseUnverified(loginResponse.AccessToken, claims)
+
+	// Revoking the token ID for another user doesn't affect the token
+	otherUser := &User{Email: "other@bar.com", CreateDate: time.Now(), Confirmed: true, Enabled: true}
+	GetUserRepository().Create(otherUser)
+	req, _ := http.NewRequest("POST", "/users/"+otherUser.ID.Hex()+"/tokens/"+claims.Id+"/revoke", nil)
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req, _ = http.NewRequest("POST", "/users/"+user.ID.Hex()+"/tokens/"+claims.Id+"/revoke", nil)
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse2.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+}
+
+func TestImpersonateUser(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+
+	payload := `{"actor": "support@example.com", "reason": "Ticket #123"}`
+	req, _ := http.NewRequest("POST", "/users/"+user.ID.Hex()+"/impersonate", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var tokenResponse TokenResponse
+	json.Unmarshal(res.Body.Bytes(), &tokenResponse)
+	checkTestString(t, "urn:ietf:params:oauth:token-type:access_token", tokenResponse.IssuedTokenType)
+
+	req = newHTTPRequest("GET", "/some/route/test.html", tokenResponse.AccessToken, nil)
+	claims, _, err := ExtractClaimsFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestString(t, user.ID.Hex(), claims.UserID)
+	if claims.Actor == nil {
+		t.Fatal("Expected act claim")
+	}
+	checkTestString(t, "support@example.com", claims.Actor.Subject)
+
+	// Impersonation tokens can't be used for the public API
+	req = newHTTPRequest("GET", "/auth/ping", tokenResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	req, _ = http.NewRequest("GET", "/users/"+user.ID.Hex()+"/audit", nil)
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var entries []*AuditLogEntry
+	json.Unmarshal(res.Body.Bytes(), &entries)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 audit log entry, got %d", len(entries))
+	}
+	checkTestString(t, AuditActionImpersonate, entries[0].Action)
+	checkTestString(t, "support@example.com", entries[0].Actor)
+	checkTestString(t, "Ticket #123", entries[0].Reason)
+	checkTestString(t, claims.Id, entries[0].TokenID)
+}
+
+func TestImpersonateOTPUserDenied(t *testing.T) {
+	clearTestDB()
+	user, _ := createOTPTestUser(true)
+	GetConfig().ImpersonationDenyOTP = true
+	defer func() { GetConfig().ImpersonationDenyOTP = false }()
+
+	payload := `{"actor": "support@example.com"}`
+	req, _ := http.NewRequest("POST", "/users/"+user.ID.Hex()+"/impersonate", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusForbidden, res.Code)
+	if len(GetAuditLogRepository().GetAllForUser(user.ID.Hex())) != 0 {
+		t.Fatal("Expected no audit log entry")
+	}
+}
+
+func TestImpersonateMissingActor(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+
+	req, _ := http.NewRequest("POST", "/users/"+user.ID.Hex()+"/impersonate", bytes.NewBufferString(`{}`))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+func TestBackendSessions(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginUser("foo@bar.com", "12345678")
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	req, _ := http.NewRequest("GET", "/users/"+user.ID.Hex()+"/sessions", nil)
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusOK, res.Code)
+	var sessions []*Session
+	json.Unmarshal(res.Body.Bytes(), &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+
+	claims := &Claims{}
+	new(jwt.Parser).ParseUnverified(loginResponse.AccessToken, claims)
+	payload := `{"sessionId": "` + claims.SessionID + `"}`
+	req, _ = http.NewRequest("POST", "/users/"+user.ID.Hex()+"/sessions/revoke-others", bytes.NewBufferString(payload))
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+	if len(GetRefreshTokenRepository().GetSessionsForUser(user.ID.Hex())) != 1 {
+		t.Fatal("Expected 1 remaining session")
+	}
+
+	req, _ = http.NewRequest("DELETE", "/users/"+user.ID.Hex()+"/sessions/"+claims.SessionID, nil)
+	res = executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+	if len(GetRefreshTokenRepository().GetSessionsForUser(user.ID.Hex())) != 0 {
+		t.Fatal("Expected no remaining session")
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	req, _ := http.NewRequest("POST", "/users/"+user.ID.Hex()+"/logout-all", nil)
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+	if GetRefreshTokenRepository().GetByToken(loginResponse.RefreshToken) != nil {
+		t.Fatal("Expected refresh token to be deleted")
+	}
+
+	// New logins get the new token version
+	loginResponse = loginUser("foo@bar.com", "12345678")
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+}
+
+func TestSetPasswordBumpsTokenVersion(t *testing.T) {
+	clearTestDB()
+	user := createTestUser(true)
+	loginResponse := loginUser("foo@bar.com", "12345678")
+
+	payload := `{"password": "abcdefgh"}`
+	req, _ := http.NewRequest("PUT", "/users/"+user.ID.Hex()+"/password", bytes.NewBufferString(payload))
+	res := executeBackendTestRequest(req)
+	checkTestResponseCode(t, http.StatusNoContent, res.Code)
+
+	req = newHTTPRequest("GET", "/auth/ping", loginResponse.AccessToken, nil)
+	res = executePublicTestRequest(req)
+	checkTestResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	// Subsequent updates don't reset the token version
+	user = GetUserRepository().GetOne(user.ID.Hex())
+	checkTestInt(t, 1, user.TokenVersion)
+	user.TokenVersion = 0
+	GetUserRepository().Update(user)
+	checkTestInt(t, 1, GetUserRepository().GetOne(user.ID.Hex()).TokenVersion)
+}
+
 type dummyUser struct {
 	ID         string        `json:"id"`
 	Email      string        `json:"email"`